@@ -0,0 +1,345 @@
+// Package clipboard implements copy and paste, using the selection of a
+// wl_data_device.
+//
+// Copying means creating a wl_data_source, offering it as the selection, and
+// writing the data to whatever pipe the compositor hands it when another
+// client pastes. Pasting means keeping track of the wl_data_offer the
+// compositor sends for the current selection, and the mime types it offers,
+// and asking for the data to be written to a pipe. A Clipboard does both.
+package clipboard
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"zenhack.net/go/wayland"
+)
+
+var (
+	// Read was asked for a mime type which the selection doesn't offer,
+	// or there is no selection.
+	ErrUnavailable = errors.New("clipboard: no data of that type")
+
+	// The clipboard has been closed.
+	ErrClosed = errors.New("clipboard: closed")
+)
+
+// A time in the past, for canceling reads with a deadline.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// A Clipboard manages the selection of a seat.
+//
+// Event handlers (including the functions passed to Offer, which are started
+// from them) run on whichever goroutine dispatches the data device's queue,
+// which is initially the seat's.
+type Clipboard struct {
+	manager *wayland.DataDeviceManager
+	device  *wayland.DataDevice
+
+	removeListeners []func()
+
+	lock sync.Mutex
+
+	// Offers introduced by the data_offer event which haven't been
+	// identified yet as the selection (or a drag and drop offer, which we
+	// leave to others), and the mime types they offer.
+	pending map[*wayland.DataOffer]*[]string
+
+	selection *wayland.DataOffer
+	mimeTypes []string
+	onChange  func(mimeTypes []string)
+
+	source *wayland.DataSource // The selection we offered, if it's current.
+	closed bool
+}
+
+// Create a Clipboard for seat.
+func New(manager *wayland.DataDeviceManager, seat *wayland.Seat) (*Clipboard, error) {
+	device, err := manager.GetDataDevice(seat)
+	if err != nil {
+		return nil, err
+	}
+	c := &Clipboard{
+		manager: manager,
+		device:  device,
+		pending: make(map[*wayland.DataOffer]*[]string),
+	}
+	c.removeListeners = []func(){
+		device.AddDataOfferListener(c.dataOffer),
+		device.AddEnterListener(c.enter),
+		device.AddSelectionListener(c.selectionChanged),
+	}
+	return c, nil
+}
+
+// Return the underlying data device.
+func (c *Clipboard) Device() *wayland.DataDevice {
+	return c.device
+}
+
+func (c *Clipboard) dataOffer(offer *wayland.DataOffer) {
+	if offer == nil {
+		return
+	}
+	mimeTypes := &[]string{}
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		offer.Destroy()
+		return
+	}
+	c.pending[offer] = mimeTypes
+	c.lock.Unlock()
+	offer.AddOfferListener(func(mimeType string) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		*mimeTypes = append(*mimeTypes, mimeType)
+	})
+}
+
+// The offer is for drag and drop, so not our business.
+func (c *Clipboard) enter(serial uint32, surface *wayland.Surface, x, y wayland.Fixed, offer *wayland.DataOffer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pending, offer)
+}
+
+func (c *Clipboard) selectionChanged(offer *wayland.DataOffer) {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		if offer != nil {
+			offer.Destroy()
+		}
+		return
+	}
+	if c.selection != nil {
+		c.selection.Destroy()
+	}
+	c.selection = offer
+	c.mimeTypes = nil
+	if mimeTypes, ok := c.pending[offer]; ok {
+		c.mimeTypes = *mimeTypes
+	}
+	// Any other pending offers are stale, since the compositor
+	// introduces each one immediately before using it, so nothing else
+	// will adopt them.
+	for o := range c.pending {
+		if o != offer {
+			o.Destroy()
+		}
+	}
+	c.pending = make(map[*wayland.DataOffer]*[]string)
+	mimeTypes := c.mimeTypes
+	onChange := c.onChange
+	c.lock.Unlock()
+	if onChange != nil {
+		onChange(mimeTypes)
+	}
+}
+
+// Set a callback to be invoked whenever the selection changes, with the mime
+// types offered by the new selection (none if there isn't one).
+func (c *Clipboard) OnChange(cb func(mimeTypes []string)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onChange = cb
+}
+
+// Return the mime types offered by the current selection.
+func (c *Clipboard) MimeTypes() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.mimeTypes...)
+}
+
+// Report whether the current selection offers the given mime type.
+func (c *Clipboard) Has(mimeType string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.has(mimeType)
+}
+
+func (c *Clipboard) has(mimeType string) bool {
+	for _, m := range c.mimeTypes {
+		if m == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the selection (i.e. copy), offering the given mime types. serial must
+// be that of the input event which triggered the copy; compositors ignore
+// requests from clients without keyboard focus.
+//
+// When another client pastes, the function for the mime type it asks for is
+// called on a new goroutine, and should write the data to its argument.
+// The pipe is closed when the function returns.
+func (c *Clipboard) Offer(serial uint32, data map[string]func(io.Writer)) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	source, err := c.manager.CreateDataSource()
+	if err != nil {
+		return err
+	}
+	source.OnSend(func(mimeType string, fd int) {
+		f := os.NewFile(uintptr(fd), "clipboard")
+		write, ok := data[mimeType]
+		if !ok {
+			f.Close()
+			return
+		}
+		go func() {
+			defer f.Close()
+			write(f)
+		}()
+	})
+	source.OnCancelled(func() {
+		c.lock.Lock()
+		if c.source == source {
+			c.source = nil
+		}
+		c.lock.Unlock()
+		source.Destroy()
+	})
+	for mimeType := range data {
+		if err := source.Offer(mimeType); err != nil {
+			source.Destroy()
+			return err
+		}
+	}
+	if err := c.device.SetSelection(source, serial); err != nil {
+		source.Destroy()
+		return err
+	}
+	// The old source gets a cancelled event, and is destroyed then.
+	c.source = source
+	return nil
+}
+
+// Clear the selection, if it's ours. serial is as for Offer.
+func (c *Clipboard) Clear(serial uint32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if c.source == nil {
+		return nil
+	}
+	return c.device.SetSelection(nil, serial)
+}
+
+// Read (i.e. paste) the current selection, as the given mime type. Reads
+// from the returned ReadCloser fail once ctx is canceled. The caller must
+// close it.
+//
+// The data is sent by the client which owns the selection, which may be this
+// one, so the ReadCloser must not be read from the goroutine which
+// dispatches events.
+func (c *Clipboard) Read(ctx context.Context, mimeType string) (io.ReadCloser, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.selection == nil || !c.has(mimeType) {
+		return nil, ErrUnavailable
+	}
+	return Receive(ctx, c.selection, mimeType)
+}
+
+// Ask for the offer's data as mimeType, and return a reader for it, which
+// the caller must close. Reads fail once ctx is canceled. This is what Read
+// uses, but it works with any offer, e.g. for drag and drop.
+func Receive(ctx context.Context, offer *wayland.DataOffer, mimeType string) (io.ReadCloser, error) {
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_CLOEXEC); err != nil {
+		return nil, err
+	}
+	// Only our end is non-blocking; the write end goes to the source
+	// client, which may well expect blocking writes.
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+		return nil, err
+	}
+	err := offer.Receive(mimeType, fds[1])
+	// The write end has been sent (or not, if err != nil); either way
+	// we're done with our copy. Closing it means we'll see EOF once the
+	// other side closes theirs.
+	unix.Close(fds[1])
+	if err != nil {
+		unix.Close(fds[0])
+		return nil, err
+	}
+	// Since it's non-blocking, os.File will use the runtime's poller,
+	// so we can interrupt reads with a deadline.
+	r := &reader{
+		File: os.NewFile(uintptr(fds[0]), "clipboard"),
+		done: make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.File.SetReadDeadline(aLongTimeAgo)
+		case <-r.done:
+		}
+	}()
+	return r, nil
+}
+
+// A reader is the read end of a pipe, which stops being readable when a
+// context is canceled.
+type reader struct {
+	*os.File
+	once sync.Once
+	done chan struct{}
+}
+
+func (r *reader) Close() error {
+	r.once.Do(func() { close(r.done) })
+	return r.File.Close()
+}
+
+// Release the data device, and destroy the current selection offer and
+// source, if any. Since wl_data_device.release is new in version 2, with
+// older compositors the device lingers until the connection is closed.
+func (c *Clipboard) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for _, remove := range c.removeListeners {
+		remove()
+	}
+	if c.selection != nil {
+		c.selection.Destroy()
+		c.selection = nil
+	}
+	for o := range c.pending {
+		o.Destroy()
+	}
+	c.pending = nil
+	c.mimeTypes = nil
+	if c.source != nil {
+		c.source.Destroy()
+		c.source = nil
+	}
+	if c.device.Version() >= 2 {
+		return c.device.Release()
+	}
+	return nil
+}
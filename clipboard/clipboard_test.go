@@ -0,0 +1,238 @@
+package clipboard
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/internal/wltest"
+)
+
+// A server which records the requests it receives.
+type recorder struct {
+	lock     sync.Mutex
+	requests []wltest.Request
+}
+
+func (r *recorder) handle(req wltest.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests = append(r.requests, req)
+}
+
+// Return the recorded requests with the given sender and opcode.
+func (r *recorder) find(sender wayland.ObjectId, opcode uint16) []wltest.Request {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ret []wltest.Request
+	for _, req := range r.requests {
+		if req.Sender == sender && req.Opcode == opcode {
+			ret = append(ret, req)
+		}
+	}
+	return ret
+}
+
+// Return all of the fds received, and forget them. The server doesn't know
+// which requests take fds, so they may be recorded with an earlier request
+// than the one they belong to.
+func (r *recorder) takeFds() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ret []int
+	for i := range r.requests {
+		ret = append(ret, r.requests[i].Fds...)
+		r.requests[i].Fds = nil
+	}
+	return ret
+}
+
+// Request opcodes.
+const (
+	managerCreateDataSource = 0
+	managerGetDataDevice    = 1
+	sourceOffer             = 0
+	sourceDestroy           = 1
+	offerReceive            = 1
+	offerDestroy            = 2
+	deviceSetSelection      = 1
+)
+
+// Event opcodes.
+const (
+	deviceDataOffer = 0
+	deviceSelection = 5
+	offerOffer      = 0
+	sourceSend      = 1
+	sourceCancelled = 2
+)
+
+func TestClipboard(t *testing.T) {
+	client, server := wltest.NewClient(t)
+	rec := &recorder{}
+	server.Serve(rec.handle)
+	server.Advertise(1, "wl_data_device_manager", 3)
+	server.Advertise(2, "wl_seat", 5)
+	roundtrip := func() {
+		t.Helper()
+		if err := client.Roundtrip(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roundtrip()
+	globals := client.Globals()
+	obj, err := globals.BindGlobal(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := obj.(*wayland.DataDeviceManager)
+	obj, err = globals.BindGlobal(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(manager, obj.(*wayland.Seat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var changes [][]string
+	c.OnChange(func(mimeTypes []string) {
+		changes = append(changes, mimeTypes)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Paste:
+	deviceId := c.Device().Id()
+	offerId := wayland.ObjectId(0xff000000)
+	server.SendEvent(deviceId, deviceDataOffer, offerId)
+	server.SendEvent(offerId, offerOffer, "text/plain")
+	server.SendEvent(offerId, offerOffer, "text/html")
+	server.SendEvent(deviceId, deviceSelection, offerId)
+	roundtrip()
+	want := []string{"text/plain", "text/html"}
+	if got := c.MimeTypes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got mime types %v, expected %v", got, want)
+	}
+	if !reflect.DeepEqual(changes, [][]string{want}) {
+		t.Errorf("Bad OnChange calls: %v", changes)
+	}
+	if _, err := c.Read(ctx, "image/png"); err != ErrUnavailable {
+		t.Errorf("Expected ErrUnavailable, but got %v", err)
+	}
+	r, err := c.Read(ctx, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundtrip()
+	reqs := rec.find(offerId, offerReceive)
+	fds := rec.takeFds()
+	if len(reqs) != 1 || len(fds) != 1 {
+		t.Fatalf("Expected one receive request with an fd, but got %v, %v", reqs, fds)
+	}
+	if flags, err := unix.FcntlInt(uintptr(fds[0]), unix.F_GETFL, 0); err != nil || flags&unix.O_NONBLOCK != 0 {
+		t.Errorf("The pipe's write end should be blocking, but has flags %#x (%v)", flags, err)
+	}
+	w := os.NewFile(uintptr(fds[0]), "pipe")
+	w.WriteString("pasted")
+	w.Close()
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "pasted" {
+		t.Errorf("Read %q, %v", data, err)
+	}
+
+	// A read should be interrupted when its context is canceled:
+	readCtx, cancelRead := context.WithCancel(ctx)
+	r, err = c.Read(readCtx, "text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundtrip()
+	fds = rec.takeFds()
+	cancelRead()
+	if _, err := r.Read(make([]byte, 1)); err == nil {
+		t.Error("Read not interrupted")
+	}
+	r.Close()
+	for _, fd := range fds {
+		os.NewFile(uintptr(fd), "pipe").Close()
+	}
+
+	// Copy:
+	if err := c.Offer(7, map[string]func(io.Writer){
+		"text/plain": func(w io.Writer) { io.WriteString(w, "copied") },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	roundtrip()
+	req := rec.find(manager.Id(), managerCreateDataSource)
+	if len(req) != 1 {
+		t.Fatalf("Expected one create_data_source, but got %v", req)
+	}
+	sourceId := wayland.ObjectId(req[0].Arg(0))
+	if req := rec.find(sourceId, sourceOffer); len(req) != 1 {
+		t.Errorf("Expected one offer, but got %v", req)
+	}
+	req = rec.find(deviceId, deviceSetSelection)
+	if len(req) != 1 || wayland.ObjectId(req[0].Arg(0)) != sourceId || req[0].Arg(1) != 7 {
+		t.Fatalf("Bad set_selection: %v", req)
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SendEvent(sourceId, sourceSend, "text/plain", wltest.Fd(pw.Fd()))
+	pw.Close()
+	roundtrip()
+	data, err = io.ReadAll(pr)
+	pr.Close()
+	if err != nil || string(data) != "copied" {
+		t.Errorf("Read %q, %v", data, err)
+	}
+
+	// When something else takes the selection, the old offer and source
+	// should be destroyed:
+	server.SendEvent(sourceId, sourceCancelled)
+	server.SendEvent(deviceId, deviceSelection, wayland.ObjectId(0))
+	roundtrip()
+	roundtrip()
+	if len(rec.find(sourceId, sourceDestroy)) != 1 {
+		t.Error("Source not destroyed")
+	}
+	if len(rec.find(offerId, offerDestroy)) != 1 {
+		t.Error("Offer not destroyed")
+	}
+	if got := c.MimeTypes(); len(got) != 0 {
+		t.Errorf("Expected no mime types, but got %v", got)
+	}
+	if _, err := c.Read(ctx, "text/plain"); err != ErrUnavailable {
+		t.Errorf("Expected ErrUnavailable, but got %v", err)
+	}
+
+	// Offers which never become the selection should be destroyed, both
+	// when another offer does and when the clipboard is closed:
+	staleId, selectionId, unusedId := offerId+1, offerId+2, offerId+3
+	server.SendEvent(deviceId, deviceDataOffer, staleId)
+	server.SendEvent(deviceId, deviceDataOffer, selectionId)
+	server.SendEvent(deviceId, deviceSelection, selectionId)
+	server.SendEvent(deviceId, deviceDataOffer, unusedId)
+	roundtrip()
+	roundtrip()
+	if len(rec.find(staleId, offerDestroy)) != 1 || len(rec.find(selectionId, offerDestroy)) != 0 {
+		t.Error("Stale offer not destroyed when the selection changed")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	roundtrip()
+	if len(rec.find(selectionId, offerDestroy)) != 1 || len(rec.find(unusedId, offerDestroy)) != 1 {
+		t.Error("Offers not destroyed by Close")
+	}
+}
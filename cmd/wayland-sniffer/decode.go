@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTruncated  = errors.New("message truncated")
+	ErrMissingNul = errors.New("string missing NUL terminator")
+)
+
+// A decoded message.
+type Record struct {
+	Time time.Time
+
+	// The connection the message was sent on; see Conn.
+	Conn int
+
+	// True for requests (client to server), false for events.
+	Request bool
+
+	Sender uint32
+	Opcode uint16
+
+	// The sender's interface, or "" if the sender isn't known.
+	Interface string
+
+	// The message as described by the protocol, or nil if it couldn't be
+	// identified.
+	Message *Message
+
+	// The arguments which were decoded. If Err is non-nil, there may be
+	// fewer of these than in the protocol description.
+	Args []Value
+
+	// Any problem decoding the message.
+	Err error
+
+	// The whole message, header included, and the file descriptors which
+	// accompanied it.
+	Data []byte
+	Fds  []int
+}
+
+// A decoded argument.
+type Value struct {
+	Arg Arg
+
+	// One of:
+	//
+	// - int32, for int arguments
+	// - uint32, for uint, object and new_id arguments
+	// - float64, for fixed arguments
+	// - string, or nil for null strings
+	// - []byte, for arrays
+	// - int, for fds: the number of the fd as received by the sniffer,
+	//   or -1 if it was missing.
+	Value interface{}
+
+	// For object and new_id arguments, the object's interface, if known.
+	Interface string
+
+	// For new_ids whose interface is given in the message (as in
+	// wl_registry.bind), the version.
+	Version uint32
+}
+
+// An entry in a connection's object table. iface is nil if the interface
+// isn't one we know about.
+type object struct {
+	name    string
+	iface   *Interface
+	version uint32
+}
+
+// The state of a proxied connection which is shared by both directions:
+// chiefly the object table, so that object arguments can be shown with their
+// interfaces.
+type Conn struct {
+	id     int
+	ifaces Interfaces
+
+	lock    sync.Mutex
+	objects map[uint32]object
+}
+
+func NewConn(id int, ifaces Interfaces) *Conn {
+	display := ifaces["wl_display"]
+	return &Conn{
+		id:     id,
+		ifaces: ifaces,
+		objects: map[uint32]object{
+			1: {name: "wl_display", iface: display, version: 1},
+		},
+	}
+}
+
+// One direction of a connection, which buffers data until whole messages
+// have arrived.
+type Stream struct {
+	conn    *Conn
+	request bool
+	data    []byte
+	fds     []int
+
+	// Set if the stream became impossible to decode, because of a bad
+	// message header.
+	broken bool
+}
+
+// Return the stream of requests (if request is true) or events on the
+// connection.
+func (c *Conn) Stream(request bool) *Stream {
+	return &Stream{conn: c, request: request}
+}
+
+// Add data and file descriptors received on the stream, and return the
+// messages which are now complete.
+func (s *Stream) Feed(data []byte, fds []int) []Record {
+	if s.broken {
+		return nil
+	}
+	s.data = append(s.data, data...)
+	s.fds = append(s.fds, fds...)
+	now := time.Now()
+	var ret []Record
+	off := 0
+	for len(s.data)-off >= 8 {
+		sender := binary.NativeEndian.Uint32(s.data[off:])
+		word := binary.NativeEndian.Uint32(s.data[off+4:])
+		size := int(word >> 16)
+		rec := Record{
+			Time:    now,
+			Conn:    s.conn.id,
+			Request: s.request,
+			Sender:  sender,
+			Opcode:  uint16(word),
+		}
+		if size < 8 {
+			rec.Err = fmt.Errorf("message size %d is too small; giving up on decoding this stream", size)
+			ret = append(ret, rec)
+			s.broken = true
+			s.data = nil
+			s.fds = nil
+			return ret
+		}
+		if len(s.data)-off < size {
+			break
+		}
+		rec.Data = append([]byte(nil), s.data[off:off+size]...)
+		fds := s.fds
+		s.conn.decode(&rec, s.data[off+8:off+size], &s.fds)
+		rec.Fds = fds[:len(fds)-len(s.fds)]
+		ret = append(ret, rec)
+		off += size
+	}
+	s.data = append(s.data[:0], s.data[off:]...)
+	return ret
+}
+
+// Decode the body of the message whose header is already in rec, consuming
+// its file descriptors from *fds, and update the object table to match.
+func (c *Conn) decode(rec *Record, body []byte, fds *[]int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	obj, ok := c.objects[rec.Sender]
+	if !ok {
+		rec.Err = fmt.Errorf("unknown object %d", rec.Sender)
+		return
+	}
+	rec.Interface = obj.name
+	if obj.iface == nil {
+		rec.Err = fmt.Errorf("unknown interface %q", obj.name)
+		return
+	}
+	msgs := obj.iface.Events
+	if rec.Request {
+		msgs = obj.iface.Requests
+	}
+	if int(rec.Opcode) >= len(msgs) {
+		rec.Err = fmt.Errorf("opcode %d out of range", rec.Opcode)
+		return
+	}
+	msg := msgs[rec.Opcode]
+	rec.Message = msg
+
+	r := reader{data: body}
+	for _, arg := range msg.Args {
+		v := Value{Arg: arg}
+		switch arg.Type {
+		case "fd":
+			v.Value = -1
+			if len(*fds) > 0 {
+				v.Value = (*fds)[0]
+				*fds = (*fds)[1:]
+			}
+		case "int":
+			n, err := r.u32()
+			rec.Err = err
+			v.Value = int32(n)
+		case "uint":
+			v.Value, rec.Err = r.u32()
+		case "fixed":
+			n, err := r.u32()
+			rec.Err = err
+			v.Value = float64(int32(n)) / 256
+		case "string":
+			v.Value, rec.Err = r.string()
+		case "array":
+			v.Value, rec.Err = r.array()
+		case "object":
+			var id uint32
+			id, rec.Err = r.u32()
+			v.Value = id
+			v.Interface = arg.Interface
+			if o, ok := c.objects[id]; ok {
+				v.Interface = o.name
+			}
+		case "new_id":
+			v.Interface = arg.Interface
+			if v.Interface == "" {
+				name, err := r.string()
+				if err != nil {
+					rec.Err = err
+					break
+				}
+				v.Interface, _ = name.(string)
+				v.Version, rec.Err = r.u32()
+				if rec.Err != nil {
+					break
+				}
+			}
+			var id uint32
+			id, rec.Err = r.u32()
+			v.Value = id
+		default:
+			rec.Err = fmt.Errorf("unknown argument type %q", arg.Type)
+		}
+		if rec.Err != nil {
+			return
+		}
+		rec.Args = append(rec.Args, v)
+	}
+	if r.off < len(body) {
+		rec.Err = fmt.Errorf("%d bytes of unexpected data after arguments", len(body)-r.off)
+	}
+	c.update(rec, obj)
+}
+
+// Update the object table for a message from obj. c.lock must be held.
+func (c *Conn) update(rec *Record, obj object) {
+	for _, v := range rec.Args {
+		if v.Arg.Type != "new_id" {
+			continue
+		}
+		id := v.Value.(uint32)
+		if id == 0 {
+			continue
+		}
+		version := obj.version
+		if v.Version != 0 {
+			version = v.Version
+		}
+		c.objects[id] = object{
+			name:    v.Interface,
+			iface:   c.ifaces[v.Interface],
+			version: version,
+		}
+	}
+	if rec.Sender == 1 && !rec.Request && rec.Message.Name == "delete_id" && len(rec.Args) == 1 {
+		delete(c.objects, rec.Args[0].Value.(uint32))
+	}
+}
+
+// Reads arguments from a message body.
+type reader struct {
+	data []byte
+	off  int
+}
+
+func (r *reader) u32() (uint32, error) {
+	if len(r.data)-r.off < 4 {
+		return 0, ErrTruncated
+	}
+	ret := binary.NativeEndian.Uint32(r.data[r.off:])
+	r.off += 4
+	return ret, nil
+}
+
+// Read an array, including its length prefix and padding.
+func (r *reader) array() ([]byte, error) {
+	size, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	padded := (int(size) + 3) &^ 3
+	if len(r.data)-r.off < padded {
+		return nil, ErrTruncated
+	}
+	ret := append([]byte(nil), r.data[r.off:r.off+int(size)]...)
+	r.off += padded
+	return ret, nil
+}
+
+// Read a string, returning it as an interface{} which is nil for a null
+// string.
+func (r *reader) string() (interface{}, error) {
+	buf, err := r.array()
+	if err != nil || len(buf) == 0 {
+		return nil, err
+	}
+	if buf[len(buf)-1] != 0 {
+		return nil, ErrMissingNul
+	}
+	return string(buf[:len(buf)-1]), nil
+}
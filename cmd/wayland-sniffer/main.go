@@ -0,0 +1,311 @@
+// Command wayland-sniffer sits between wayland clients and the compositor,
+// and prints the messages they exchange.
+//
+// It listens on a new socket (by default the first free wayland-N in
+// $XDG_RUNTIME_DIR), and forwards each connection made to it, file
+// descriptors included, to the real compositor. Run clients with
+// WAYLAND_DISPLAY set to the socket it reports, e.g.:
+//
+//	$ wayland-sniffer &
+//	wayland-sniffer: listening on wayland-1
+//	$ WAYLAND_DISPLAY=wayland-1 weston-terminal
+//
+// Messages are decoded using the core protocol, plus any extension protocols
+// whose XML descriptions are passed with -protocol, and printed in the same
+// format as libwayland's WAYLAND_DEBUG (with each line marked with the
+// connection it belongs to), or as JSON lines with -json.
+//
+// With -record dir, each connection is also recorded to dir/conn-N.jsonl, in
+// the format defined by internal/capture, so that it can be replayed in tests
+// with wltest's Server.Replay. File descriptors are recorded as placeholders;
+// -snapshot n additionally records up to n bytes of the contents of shared
+// memory files and pipes.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/internal/capture"
+)
+
+// The most file descriptors which can arrive with a single read; this
+// matches libwayland's limit.
+const maxFds = 28
+
+func main() {
+	var (
+		ifaces    = Interfaces{}
+		socket    = flag.String("socket", "", "name or path of the socket to listen on (default: the first free wayland-N)")
+		upstream  = flag.String("upstream", "", "name or path of the compositor's socket (default: $WAYLAND_DISPLAY, or wayland-0)")
+		jsonLines = flag.Bool("json", false, "print messages as JSON lines")
+		output    = flag.String("o", "", "file to write messages to (default: stdout)")
+		recordDir = flag.String("record", "", "`dir`ectory to record each connection to, for replaying in tests")
+		snapshot  = flag.Int("snapshot", 0, "when recording, save up to `n` bytes of the contents of shm files and pipes")
+	)
+	flag.Func("protocol", "extra protocol XML `file` to decode messages with (may be repeated)", ifaces.LoadFile)
+	log.SetFlags(0)
+	log.SetPrefix("wayland-sniffer: ")
+	if err := ifaces.Load(wayland.ProtocolXML); err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
+
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		log.Fatal("XDG_RUNTIME_DIR is not set")
+	}
+	if *upstream == "" {
+		*upstream = os.Getenv("WAYLAND_DISPLAY")
+	}
+	if *upstream == "" {
+		*upstream = "wayland-0"
+	}
+	upstreamPath := socketPath(runtimeDir, *upstream)
+	if *recordDir != "" {
+		if err := os.MkdirAll(*recordDir, 0700); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	sn := &sniffer{
+		upstream:      upstreamPath,
+		ifaces:        ifaces,
+		printer:       NewPrinter(w, *jsonLines),
+		recordDir:     *recordDir,
+		snapshotLimit: *snapshot,
+	}
+
+	l, name, unlock, err := listen(runtimeDir, *socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer unlock()
+	log.Printf("listening on %s", name)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	for id := 1; ; id++ {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Print(err)
+			}
+			break
+		}
+		wg.Add(1)
+		go func(id int, conn *net.UnixConn) {
+			defer wg.Done()
+			sn.proxy(ctx, id, conn)
+		}(id, conn)
+	}
+	wg.Wait()
+}
+
+// Return the path of the socket called name, which is relative to runtimeDir
+// unless it's absolute.
+func socketPath(runtimeDir, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(runtimeDir, name)
+}
+
+// Listen on the socket called name, or, if name is "", on the first free
+// wayland-N. As libwayland does, we take a lock on a file alongside the
+// socket, so that we can safely remove stale sockets. Returns the listener,
+// the socket's name, and a function which releases the lock.
+func listen(runtimeDir, name string) (*net.UnixListener, string, func(), error) {
+	if name != "" {
+		l, unlock, err := listenLocked(socketPath(runtimeDir, name))
+		return l, name, unlock, err
+	}
+	for n := 1; n < 32; n++ {
+		name = fmt.Sprintf("wayland-%d", n)
+		l, unlock, err := listenLocked(socketPath(runtimeDir, name))
+		if err == nil {
+			return l, name, unlock, nil
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, "", nil, err
+		}
+	}
+	return nil, "", nil, errors.New("no free wayland-N socket names")
+}
+
+func listenLocked(path string) (*net.UnixListener, func(), error) {
+	lockPath := path + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, nil, fmt.Errorf("%s is in use: %w", path, err)
+	}
+	unlock := func() {
+		os.Remove(lockPath)
+		lock.Close()
+	}
+	// Nobody else holds the lock, so any socket left behind is stale.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		unlock()
+		return nil, nil, err
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: path})
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return l, unlock, nil
+}
+
+// Settings shared by all connections.
+type sniffer struct {
+	upstream string // The path of the compositor's socket.
+	ifaces   Interfaces
+	printer  *Printer
+
+	// Where to record connections to, if anywhere, and how much of the
+	// contents of fds to record.
+	recordDir     string
+	snapshotLimit int
+}
+
+// Forward the client connection conn to the compositor, printing (and
+// perhaps recording) the messages in both directions, until either side
+// hangs up or ctx is canceled.
+func (sn *sniffer) proxy(ctx context.Context, id int, conn *net.UnixConn) {
+	client := wayland.NewUnixTransport(conn)
+	defer client.Close()
+	uconn, err := net.DialUnix("unix", nil, &net.UnixAddr{Net: "unix", Name: sn.upstream})
+	if err != nil {
+		log.Printf("#%d: connecting to the compositor: %v", id, err)
+		return
+	}
+	server := wayland.NewUnixTransport(uconn)
+	defer server.Close()
+
+	var recorder *capture.Writer
+	if sn.recordDir != "" {
+		path := filepath.Join(sn.recordDir, fmt.Sprintf("conn-%d.jsonl", id))
+		f, err := os.Create(path)
+		if err != nil {
+			log.Printf("#%d: %v", id, err)
+			return
+		}
+		defer f.Close()
+		recorder = capture.NewWriter(f)
+		defer func() {
+			if err := recorder.Flush(); err != nil {
+				log.Printf("#%d: writing %s: %v", id, path, err)
+			}
+		}()
+	}
+
+	c := NewConn(id, sn.ifaces)
+	done := make(chan error, 2)
+	go func() {
+		done <- sn.forward(client, server, c.Stream(true), recorder)
+	}()
+	go func() {
+		done <- sn.forward(server, client, c.Stream(false), recorder)
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+		server.Close()
+	})
+	defer stop()
+	err = <-done
+	// Unblock the other direction:
+	client.Close()
+	server.Close()
+	<-done
+	if err != nil && !errors.Is(err, io.EOF) && !isClosed(err) {
+		log.Printf("#%d: %v", id, err)
+	}
+}
+
+// Copy data and file descriptors from one transport to the other, decoding,
+// printing and recording them as they go. Messages are handled, and the
+// object table updated, before they are forwarded, so that the other side
+// can't respond to a message before we've seen it. recorder may be nil.
+func (sn *sniffer) forward(from, to wayland.Transport, s *Stream, recorder *capture.Writer) error {
+	var (
+		data [4096]byte
+		fds  [maxFds]int
+	)
+	for {
+		n, fdn, err := from.Recv(data[:], fds[:])
+		for _, rec := range s.Feed(data[:n], fds[:fdn]) {
+			if err := sn.printer.Print(&rec); err != nil {
+				log.Print(err)
+			}
+			if recorder != nil {
+				if err := sn.record(recorder, &rec); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+		var sendErr error
+		if n > 0 {
+			sendErr = to.Send(data[:n], fds[:fdn])
+		}
+		closeAll(fds[:fdn])
+		if sendErr != nil {
+			return sendErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (sn *sniffer) record(recorder *capture.Writer, rec *Record) error {
+	dir := capture.Event
+	if rec.Request {
+		dir = capture.Request
+	}
+	var fds []capture.Fd
+	for _, fd := range rec.Fds {
+		fds = append(fds, capture.Describe(fd, sn.snapshotLimit))
+	}
+	return recorder.Write(rec.Time, dir, rec.Data, fds)
+}
+
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+// Report whether err is the result of using a connection which we've closed.
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, wayland.ErrTransportClosed)
+}
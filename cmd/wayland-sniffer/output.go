@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writes records to an output stream, either in libwayland's WAYLAND_DEBUG
+// format (prefixed with the connection number), or as JSON lines. Safe for
+// use by multiple goroutines.
+type Printer struct {
+	lock sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+func NewPrinter(w io.Writer, jsonLines bool) *Printer {
+	return &Printer{w: w, json: jsonLines}
+}
+
+func (p *Printer) Print(rec *Record) error {
+	var line []byte
+	if p.json {
+		buf, err := json.Marshal(jsonRecordOf(rec))
+		if err != nil {
+			return err
+		}
+		line = append(buf, '\n')
+	} else {
+		line = []byte(timestamp(rec.Time) + FormatRecord(rec) + "\n")
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, err := p.w.Write(line)
+	return err
+}
+
+// Format the record like libwayland does, e.g.
+//
+//	#1 -> wl_surface@7.attach(wl_buffer@12, 0, 0)
+//
+// where #1 is the connection. Problems decoding the message are shown after
+// the arguments.
+func FormatRecord(rec *Record) string {
+	var b strings.Builder
+	b.WriteByte('#')
+	b.WriteString(strconv.Itoa(rec.Conn))
+	b.WriteByte(' ')
+	if rec.Request {
+		b.WriteString("-> ")
+	}
+	iface := rec.Interface
+	if iface == "" {
+		iface = "[unknown]"
+	}
+	writeObject(&b, iface, rec.Sender)
+	b.WriteByte('.')
+	if rec.Message != nil {
+		b.WriteString(rec.Message.Name)
+	} else {
+		b.WriteString("[opcode ")
+		b.WriteString(strconv.Itoa(int(rec.Opcode)))
+		b.WriteByte(']')
+	}
+	b.WriteByte('(')
+	for i, v := range rec.Args {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		formatValue(&b, v)
+	}
+	b.WriteByte(')')
+	if rec.Err != nil {
+		b.WriteString(" !! ")
+		b.WriteString(rec.Err.Error())
+	}
+	return b.String()
+}
+
+func formatValue(b *strings.Builder, v Value) {
+	switch x := v.Value.(type) {
+	case nil:
+		b.WriteString("nil")
+	case int:
+		if x < 0 {
+			b.WriteString("fd <missing>")
+		} else {
+			b.WriteString("fd ")
+			b.WriteString(strconv.Itoa(x))
+		}
+	case int32:
+		b.WriteString(strconv.FormatInt(int64(x), 10))
+	case float64:
+		b.WriteString(strconv.FormatFloat(x, 'f', 6, 64))
+	case string:
+		b.WriteString(strconv.Quote(x))
+	case []byte:
+		b.WriteString("array[")
+		b.WriteString(strconv.Itoa(len(x)))
+		b.WriteByte(']')
+	case uint32:
+		switch {
+		case v.Arg.Type == "uint":
+			b.WriteString(strconv.FormatUint(uint64(x), 10))
+		case x == 0:
+			b.WriteString("nil")
+		case v.Arg.Type == "new_id":
+			if v.Arg.Interface == "" {
+				// libwayland shows the interface and version of
+				// generic new_ids as separate arguments.
+				b.WriteString(strconv.Quote(v.Interface))
+				b.WriteString(", ")
+				b.WriteString(strconv.FormatUint(uint64(v.Version), 10))
+				b.WriteString(", ")
+			}
+			b.WriteString("new id ")
+			writeObject(b, v.Interface, x)
+		default:
+			writeObject(b, v.Interface, x)
+		}
+	}
+}
+
+func writeObject(b *strings.Builder, iface string, id uint32) {
+	if iface == "" {
+		iface = "[unknown]"
+	}
+	b.WriteString(iface)
+	b.WriteByte('@')
+	b.WriteString(strconv.FormatUint(uint64(id), 10))
+}
+
+// Format t as libwayland does: milliseconds (wrapping around at 2^32) and
+// microseconds, since the epoch.
+func timestamp(t time.Time) string {
+	us := t.UnixNano() / 1000
+	ms := uint32(us / 1000)
+	frac := strconv.Itoa(int(us % 1000))
+	ret := strconv.FormatUint(uint64(ms), 10)
+	if len(ret) < 7 {
+		ret = strings.Repeat(" ", 7-len(ret)) + ret
+	}
+	return "[" + ret + "." + strings.Repeat("0", 3-len(frac)) + frac + "] "
+}
+
+// The JSON form of a record.
+type jsonRecord struct {
+	Time      time.Time   `json:"time"`
+	Conn      int         `json:"conn"`
+	Direction string      `json:"direction"` // "request" or "event"
+	Object    uint32      `json:"object"`
+	Interface string      `json:"interface,omitempty"`
+	Opcode    uint16      `json:"opcode"`
+	Message   string      `json:"message,omitempty"`
+	Args      []jsonValue `json:"args"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type jsonValue struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// Numbers for most types, strings (or null) for strings, and base64
+	// for arrays, as encoding/json does for []byte. Object ids are
+	// numbers, with null for a null object.
+	Value interface{} `json:"value"`
+
+	Interface string `json:"interface,omitempty"`
+	Version   uint32 `json:"version,omitempty"`
+}
+
+func jsonRecordOf(rec *Record) jsonRecord {
+	ret := jsonRecord{
+		Time:      rec.Time,
+		Conn:      rec.Conn,
+		Direction: "event",
+		Object:    rec.Sender,
+		Interface: rec.Interface,
+		Opcode:    rec.Opcode,
+		Args:      make([]jsonValue, len(rec.Args)),
+	}
+	if rec.Request {
+		ret.Direction = "request"
+	}
+	if rec.Message != nil {
+		ret.Message = rec.Message.Name
+	}
+	if rec.Err != nil {
+		ret.Error = rec.Err.Error()
+	}
+	for i, v := range rec.Args {
+		jv := jsonValue{
+			Name:      v.Arg.Name,
+			Type:      v.Arg.Type,
+			Value:     v.Value,
+			Interface: v.Interface,
+			Version:   v.Version,
+		}
+		if id, ok := v.Value.(uint32); ok && id == 0 && v.Arg.Type != "uint" {
+			jv.Value = nil
+		}
+		ret.Args[i] = jv
+	}
+	return ret
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+)
+
+// Types for unmarshalling protocol descriptions. Unlike the generator, we
+// only need enough to decode messages.
+
+type Protocol struct {
+	Name       string       `xml:"name,attr"`
+	Interfaces []*Interface `xml:"interface"`
+}
+
+type Interface struct {
+	Name     string     `xml:"name,attr"`
+	Version  uint32     `xml:"version,attr"`
+	Requests []*Message `xml:"request"`
+	Events   []*Message `xml:"event"`
+}
+
+type Message struct {
+	Name string `xml:"name,attr"`
+	Args []Arg  `xml:"arg"`
+}
+
+// Return the number of file descriptors which accompany the message.
+func (m *Message) FdCount() int {
+	count := 0
+	for _, arg := range m.Args {
+		if arg.Type == "fd" {
+			count++
+		}
+	}
+	return count
+}
+
+type Arg struct {
+	Name      string `xml:"name,attr"`
+	Type      string `xml:"type,attr"`
+	Interface string `xml:"interface,attr"`
+	AllowNull bool   `xml:"allow-null,attr"`
+}
+
+// The interfaces we know about, by name.
+type Interfaces map[string]*Interface
+
+// Add the interfaces described by the XML document data. Interfaces which are
+// already known are replaced.
+func (ifaces Interfaces) Load(data []byte) error {
+	var proto Protocol
+	if err := xml.Unmarshal(data, &proto); err != nil {
+		return err
+	}
+	if len(proto.Interfaces) == 0 {
+		return fmt.Errorf("Protocol %q defines no interfaces", proto.Name)
+	}
+	for _, iface := range proto.Interfaces {
+		ifaces[iface.Name] = iface
+	}
+	return nil
+}
+
+// Like Load, but reads the document from a file.
+func (ifaces Interfaces) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := ifaces.Load(data); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
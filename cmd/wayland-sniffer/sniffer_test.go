@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/internal/capture"
+)
+
+// Marshal a message. Arguments may be uint32s, int32s or strings.
+func message(sender uint32, opcode uint16, args ...interface{}) []byte {
+	var body []byte
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case uint32:
+			body = binary.NativeEndian.AppendUint32(body, arg)
+		case int32:
+			body = binary.NativeEndian.AppendUint32(body, uint32(arg))
+		case string:
+			body = binary.NativeEndian.AppendUint32(body, uint32(len(arg)+1))
+			body = append(body, arg...)
+			body = append(body, make([]byte, 4-len(arg)%4)...)
+		default:
+			panic(arg)
+		}
+	}
+	buf := binary.NativeEndian.AppendUint32(nil, sender)
+	buf = binary.NativeEndian.AppendUint32(buf, uint32(len(body)+8)<<16|uint32(opcode))
+	return append(buf, body...)
+}
+
+func coreInterfaces(t *testing.T) Interfaces {
+	ifaces := Interfaces{}
+	if err := ifaces.Load(wayland.ProtocolXML); err != nil {
+		t.Fatal(err)
+	}
+	return ifaces
+}
+
+func format(recs []Record) []string {
+	var ret []string
+	for i := range recs {
+		ret = append(ret, FormatRecord(&recs[i]))
+	}
+	return ret
+}
+
+func TestDecode(t *testing.T) {
+	c := NewConn(1, coreInterfaces(t))
+	requests, events := c.Stream(true), c.Stream(false)
+
+	var got []string
+	feed := func(s *Stream, data []byte, fds ...int) {
+		got = append(got, format(s.Feed(data, fds))...)
+	}
+	feed(requests, message(1, 1, uint32(2)))
+	feed(events, message(2, 0, uint32(5), "wl_shm", uint32(1)))
+	feed(requests, message(2, 0, uint32(5), "wl_shm", uint32(1), uint32(3)))
+
+	// A message split across reads, with its fd arriving first:
+	pool := message(3, 0, uint32(4), int32(4096))
+	feed(requests, pool[:5], 9)
+	feed(requests, pool[5:])
+
+	feed(requests, message(4, 0, uint32(5), int32(0), int32(8), int32(8), int32(32), uint32(1)))
+	feed(requests, append(message(5, 0), message(4, 1)...))
+	feed(events, message(1, 1, uint32(4)))
+	feed(requests, message(4, 0))
+	feed(events, message(1, 0, uint32(3), uint32(0), "invalid fd"))
+
+	want := []string{
+		`#1 -> wl_display@1.get_registry(new id wl_registry@2)`,
+		`#1 wl_registry@2.global(5, "wl_shm", 1)`,
+		`#1 -> wl_registry@2.bind(5, "wl_shm", 1, new id wl_shm@3)`,
+		`#1 -> wl_shm@3.create_pool(new id wl_shm_pool@4, fd 9, 4096)`,
+		`#1 -> wl_shm_pool@4.create_buffer(new id wl_buffer@5, 0, 8, 8, 32, 1)`,
+		`#1 -> wl_buffer@5.destroy()`,
+		`#1 -> wl_shm_pool@4.destroy()`,
+		`#1 wl_display@1.delete_id(4)`,
+		`#1 -> [unknown]@4.[opcode 0]() !! unknown object 4`,
+		`#1 wl_display@1.error(wl_shm@3, 0, "invalid fd")`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestExtensionProtocol(t *testing.T) {
+	ifaces := coreInterfaces(t)
+	err := ifaces.Load([]byte(`<protocol name="test">
+  <interface name="test_manager" version="1">
+    <request name="get_thing">
+      <arg name="id" type="new_id" interface="test_thing"/>
+      <arg name="surface" type="object" interface="wl_surface" allow-null="true"/>
+    </request>
+  </interface>
+  <interface name="test_thing" version="1">
+    <event name="moved">
+      <arg name="x" type="fixed"/>
+      <arg name="data" type="array"/>
+    </event>
+  </interface>
+</protocol>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewConn(2, ifaces)
+	requests, events := c.Stream(true), c.Stream(false)
+	requests.Feed(message(1, 1, uint32(2)), nil)
+	requests.Feed(message(2, 0, uint32(7), "test_manager", uint32(1), uint32(3)), nil)
+	recs := requests.Feed(message(3, 0, uint32(4), uint32(0)), nil)
+	recs = append(recs, events.Feed(message(4, 0, int32(-384), "ab"), nil)...)
+	want := []string{
+		`#2 -> test_manager@3.get_thing(new id test_thing@4, nil)`,
+		`#2 test_thing@4.moved(-1.500000, array[3])`,
+	}
+	if got := format(recs); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %q, expected %q", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := NewPrinter(&buf, true).Print(&recs[0]); err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	args := decoded["args"].([]interface{})
+	if decoded["direction"] != "request" || decoded["interface"] != "test_manager" ||
+		decoded["message"] != "get_thing" || len(args) != 2 ||
+		args[0].(map[string]interface{})["interface"] != "test_thing" ||
+		args[1].(map[string]interface{})["value"] != nil {
+		t.Errorf("Bad JSON: %s", buf.String())
+	}
+}
+
+// Connections should be forwarded in both directions, along with their fds.
+func TestProxy(t *testing.T) {
+	dir := t.TempDir()
+	upstream, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: filepath.Join(dir, "upstream")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	l, name, unlock, err := listen(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	defer l.Close()
+	if name != "wayland-1" {
+		t.Errorf("Listening on %q", name)
+	}
+	if _, _, _, err := listen(dir, name); err == nil {
+		t.Error("Listened on a socket which was in use")
+	}
+
+	var out bytes.Buffer
+	printer := NewPrinter(&out, false)
+	sn := &sniffer{
+		upstream:      filepath.Join(dir, "upstream"),
+		ifaces:        coreInterfaces(t),
+		printer:       printer,
+		recordDir:     dir,
+		snapshotLimit: 4096,
+	}
+	proxied := make(chan struct{})
+	go func() {
+		defer close(proxied)
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		sn.proxy(context.Background(), 1, conn)
+	}()
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Net: "unix", Name: filepath.Join(dir, name)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := wayland.NewUnixTransport(conn)
+	serverConn, err := upstream.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := wayland.NewUnixTransport(serverConn)
+	defer server.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	msgs := [][]byte{
+		message(1, 1, uint32(2)),
+		message(2, 0, uint32(1), "wl_shm", uint32(1), uint32(3)),
+		message(3, 0, uint32(4), int32(4096)),
+	}
+	for i, msg := range msgs {
+		var fds []int
+		if i == 2 {
+			fds = []int{int(w.Fd())}
+		}
+		if err := client.Send(msg, fds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := bytes.Join(msgs, nil)
+	var (
+		got    []byte
+		gotFds []int
+		buf    [4096]byte
+		fds    [maxFds]int
+	)
+	for len(got) < len(want) {
+		n, fdn, err := server.Recv(buf[:], fds[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+		gotFds = append(gotFds, fds[:fdn]...)
+	}
+	if !bytes.Equal(got, want) || len(gotFds) != 1 {
+		t.Fatalf("Forwarded %x with %d fds", got, len(gotFds))
+	}
+	// Make sure the fd is the pipe we sent:
+	if _, err := unix.Write(gotFds[0], []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(gotFds[0])
+	if n, err := r.Read(buf[:]); err != nil || n != 1 {
+		t.Fatalf("Read %d bytes from the pipe: %v", n, err)
+	}
+
+	if err := server.Send(message(1, 1, uint32(3)), nil); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := client.Recv(buf[:], fds[:])
+	if err != nil || !bytes.Equal(buf[:n], message(1, 1, uint32(3))) {
+		t.Fatalf("Got %x, %v from the server", buf[:n], err)
+	}
+	client.Close()
+	// Wait for the proxy to notice:
+	if _, _, err := server.Recv(buf[:], fds[:]); err == nil {
+		t.Fatal("Expected an error once the client hung up")
+	}
+
+	<-proxied
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 ||
+		!strings.Contains(lines[2], "] #1 -> wl_shm@3.create_pool(new id wl_shm_pool@4, fd ") ||
+		!strings.HasSuffix(lines[2], ", 4096)") ||
+		!strings.HasSuffix(lines[3], "] #1 wl_display@1.delete_id(3)") {
+		t.Errorf("Bad output:\n%s", out.String())
+	}
+
+	messages, err := capture.Load(filepath.Join(dir, "conn-1.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 4 || messages[3].Direction != capture.Event ||
+		!bytes.Equal(messages[2].Data, msgs[2]) ||
+		!reflect.DeepEqual(messages[2].Fds, []capture.Fd{{Kind: capture.PipeWriter}}) {
+		t.Errorf("Bad recording: %+v", messages)
+	}
+}
@@ -0,0 +1,130 @@
+package wayland
+
+import (
+	"sync"
+	"testing"
+)
+
+// Send many requests from many goroutines at once, each dispatching its own
+// queue, while the reader concurrently handles delete_id events.
+func TestConcurrentRequests(t *testing.T) {
+	const (
+		workers = 8
+		rounds  = 200
+	)
+	client, server := newTestClient(t)
+	serverDone := server.serveSync()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := client.NewQueue()
+			display := client.displayOnQueue(q)
+			for j := 0; j < rounds; j++ {
+				cb, err := display.Sync()
+				if err != nil {
+					errs <- err
+					return
+				}
+				done := false
+				cb.OnDone(func(uint32) { done = true })
+				for !done {
+					if err := q.Dispatch(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	client.lock.Lock()
+	n := len(client.objects)
+	client.lock.Unlock()
+	if n != 2 {
+		t.Errorf("Expected only the display and registry to remain, but "+
+			"there are %d objects", n)
+	}
+	client.Close()
+	<-serverDone
+}
+
+// Dispatch the same queue from several goroutines at once. Every event should
+// be dispatched exactly once.
+func TestConcurrentDispatch(t *testing.T) {
+	const (
+		dispatchers = 4
+		requests    = 500
+	)
+	client, server := newTestClient(t)
+	server.serveSync()
+
+	var (
+		lock  sync.Mutex
+		count int
+		wg    sync.WaitGroup
+	)
+	allDone := make(chan struct{})
+	q := client.NewQueue()
+	display := client.displayOnQueue(q)
+	for i := 0; i < requests; i++ {
+		cb, err := display.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb.OnDone(func(uint32) {
+			lock.Lock()
+			defer lock.Unlock()
+			count++
+			if count == requests {
+				close(allDone)
+			}
+		})
+	}
+	for i := 0; i < dispatchers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-allDone:
+					return
+				default:
+				}
+				q.DispatchPending()
+			}
+		}()
+	}
+	// Nothing dispatches the queue until we start the reader; do so by
+	// dispatching the default queue, which has no events of its own.
+	go client.MainLoop()
+	wg.Wait()
+	if count != requests {
+		t.Fatalf("Expected %d events to be dispatched, but got %d", requests, count)
+	}
+}
+
+// Closing the client should cause blocked calls to Dispatch to return an error.
+func TestCloseUnblocksDispatch(t *testing.T) {
+	client, _ := newTestClient(t)
+	errs := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			errs <- client.NewQueue().Dispatch()
+		}()
+	}
+	client.Close()
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err == nil {
+			t.Error("Dispatch returned nil after Close")
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package cursor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"zenhack.net/go/wayland"
+)
+
+// A Cursor shows cursors from a theme on a surface of its own, which it sets
+// as pointers' cursor. Cursor images are uploaded to the compositor the first
+// time they are used, and reused after that. Animated cursors are animated
+// from a goroutine of the Cursor's own.
+//
+// A single Cursor may be used for several pointers, but since they share a
+// surface, they show the same image.
+type Cursor struct {
+	theme   *Theme
+	shm     *wayland.Shm
+	surface *wayland.Surface
+
+	lock      sync.Mutex
+	destroyed bool
+	cache     map[cacheKey]*loadedCursor
+
+	// The cursor being shown, if any, and which frame of it. gen is
+	// incremented whenever the cursor changes, so that animation timers
+	// which fire late can tell they're stale.
+	shown *loadedCursor
+	frame int
+	timer *time.Timer
+	gen   uint64
+}
+
+type cacheKey struct {
+	name  string
+	scale int32
+}
+
+// A cursor whose images have been uploaded to the compositor.
+type loadedCursor struct {
+	scale  int32 // The buffer scale.
+	frames []loadedFrame
+}
+
+// Destroy the cursor's buffers, returning the first error.
+func (lc *loadedCursor) destroy() error {
+	var err error
+	for _, f := range lc.frames {
+		if e := f.buffer.Destroy(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+type loadedFrame struct {
+	buffer        *wayland.Buffer
+	width, height int32
+	xHot, yHot    int32 // In surface coordinates, i.e. divided by scale.
+	delay         time.Duration
+}
+
+// Create a Cursor, which will show cursors from theme (see DefaultTheme).
+func New(compositor *wayland.Compositor, shm *wayland.Shm, theme *Theme) (*Cursor, error) {
+	surface, err := compositor.CreateSurface()
+	if err != nil {
+		return nil, err
+	}
+	return &Cursor{
+		theme:   theme,
+		shm:     shm,
+		surface: surface,
+		cache:   make(map[cacheKey]*loadedCursor),
+	}, nil
+}
+
+// Return the surface on which the cursor is shown.
+func (c *Cursor) Surface() *wayland.Surface {
+	return c.surface
+}
+
+// Show the named cursor (e.g. "default" or "text") as the pointer's cursor.
+// serial must be the serial of the pointer's most recent enter event; the
+// compositor ignores the request otherwise.
+//
+// scale is the scale of the output the pointer is on. The cursor is loaded at
+// the theme's size times scale, so that it looks the same size on all
+// outputs, but is sharp on high density ones.
+func (c *Cursor) Set(pointer *wayland.Pointer, serial uint32, name string, scale int32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.destroyed {
+		return fmt.Errorf("cursor: Set called after Destroy")
+	}
+	if scale < 1 || c.surface.Version() < 3 {
+		// set_buffer_scale was added in version 3.
+		scale = 1
+	}
+	key := cacheKey{name: name, scale: scale}
+	lc, ok := c.cache[key]
+	if !ok {
+		images, err := c.theme.Load(name, c.theme.Size*int(scale))
+		if err != nil {
+			return err
+		}
+		lc, err = c.upload(images, c.bufferScale(images, scale))
+		if err != nil {
+			return err
+		}
+		c.cache[key] = lc
+	}
+
+	c.stopAnimation()
+	c.shown = lc
+	c.frame = 0
+	f := &lc.frames[0]
+	if c.surface.Version() >= 3 {
+		if err := c.surface.SetBufferScale(lc.scale); err != nil {
+			return err
+		}
+	}
+	if err := c.surface.Attach(f.buffer, 0, 0); err != nil {
+		return err
+	}
+	if err := c.damageAndCommit(f); err != nil {
+		return err
+	}
+	if err := pointer.SetCursor(serial, c.surface, f.xHot, f.yHot); err != nil {
+		return err
+	}
+	c.scheduleFrame()
+	return nil
+}
+
+// Hide the pointer's cursor. serial is as for Set.
+func (c *Cursor) Hide(pointer *wayland.Pointer, serial uint32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopAnimation()
+	c.shown = nil
+	return pointer.SetCursor(serial, nil, 0, 0)
+}
+
+// Destroy the cursor's surface and buffers. Pointers using the cursor should
+// have their cursor set to something else first.
+func (c *Cursor) Destroy() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.destroyed {
+		return nil
+	}
+	c.destroyed = true
+	c.stopAnimation()
+	c.shown = nil
+	err := c.surface.Destroy()
+	for _, lc := range c.cache {
+		if e := lc.destroy(); err == nil {
+			err = e
+		}
+	}
+	c.cache = nil
+	return err
+}
+
+// Choose the buffer scale for the images. Ideally this is the output's
+// scale, but if the theme doesn't have images that large we have to make do
+// with a smaller scale, rather than show a tiny cursor. The images'
+// dimensions must also be multiples of the scale.
+func (c *Cursor) bufferScale(images []*Image, scale int32) int32 {
+	if c.theme.Size > 0 {
+		fit := int32(math.Round(float64(images[0].Size) / float64(c.theme.Size)))
+		if fit < scale {
+			scale = fit
+		}
+	}
+	for ; scale > 1; scale-- {
+		ok := true
+		for _, img := range images {
+			ok = ok && img.Width%int(scale) == 0 && img.Height%int(scale) == 0
+		}
+		if ok {
+			break
+		}
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	return scale
+}
+
+// Copy the images into a shm pool, and create buffers for them.
+func (c *Cursor) upload(images []*Image, scale int32) (*loadedCursor, error) {
+	size := 0
+	for _, img := range images {
+		size += img.Width * img.Height * 4
+	}
+	if size == 0 || size > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: bad image size", ErrFormat)
+	}
+
+	fd, err := unix.MemfdCreate("wayland-cursor", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	// The compositor maps the fd itself, so we're done with it (and the
+	// mapping) once we've created the pool.
+	defer unix.Close(fd)
+	if err := unix.Ftruncate(fd, int64(size)); err != nil {
+		return nil, err
+	}
+	data, err := unix.Mmap(fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Munmap(data)
+	pool, err := c.shm.CreatePool(fd, int32(size))
+	if err != nil {
+		return nil, err
+	}
+	// Likewise, the buffers keep the memory alive.
+	defer pool.Destroy()
+
+	lc := &loadedCursor{scale: scale}
+	offset := 0
+	for _, img := range images {
+		for i, p := range img.Pixels {
+			binary.LittleEndian.PutUint32(data[offset+4*i:], p)
+		}
+		buf, err := pool.CreateBuffer(
+			int32(offset),
+			int32(img.Width),
+			int32(img.Height),
+			int32(img.Width*4),
+			wayland.ShmFormatArgb8888,
+		)
+		if err != nil {
+			lc.destroy()
+			return nil, err
+		}
+		lc.frames = append(lc.frames, loadedFrame{
+			buffer: buf,
+			width:  int32(img.Width),
+			height: int32(img.Height),
+			xHot:   int32(img.XHot) / scale,
+			yHot:   int32(img.YHot) / scale,
+			delay:  img.Delay,
+		})
+		offset += img.Width * img.Height * 4
+	}
+	return lc, nil
+}
+
+func (c *Cursor) damageAndCommit(f *loadedFrame) error {
+	if err := c.surface.Damage(0, 0, f.width, f.height); err != nil {
+		return err
+	}
+	return c.surface.Commit()
+}
+
+// If the shown cursor is animated, schedule showing its next frame. Must be
+// called with the lock held.
+func (c *Cursor) scheduleFrame() {
+	lc := c.shown
+	delay := lc.frames[c.frame].delay
+	if len(lc.frames) < 2 || delay <= 0 {
+		return
+	}
+	gen := c.gen
+	c.timer = time.AfterFunc(delay, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if gen != c.gen {
+			return
+		}
+		prev := &lc.frames[c.frame]
+		c.frame = (c.frame + 1) % len(lc.frames)
+		f := &lc.frames[c.frame]
+		// Offsetting the attach moves the hotspot, in case it differs
+		// between frames.
+		if c.surface.Attach(f.buffer, prev.xHot-f.xHot, prev.yHot-f.yHot) != nil ||
+			c.damageAndCommit(f) != nil {
+			// The connection is gone; nothing more to do.
+			return
+		}
+		c.scheduleFrame()
+	})
+}
+
+// Stop animating the shown cursor, if it is animated. Must be called with the
+// lock held.
+func (c *Cursor) stopAnimation() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.gen++
+}
@@ -0,0 +1,220 @@
+package cursor
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/internal/wltest"
+)
+
+// A server which records the requests it receives.
+type recorder struct {
+	lock     sync.Mutex
+	requests []wltest.Request
+}
+
+func (r *recorder) handle(req wltest.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests = append(r.requests, req)
+}
+
+// Return the recorded requests with the given sender and opcode.
+func (r *recorder) find(sender wayland.ObjectId, opcode uint16) []wltest.Request {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ret []wltest.Request
+	for _, req := range r.requests {
+		if req.Sender == sender && req.Opcode == opcode {
+			ret = append(ret, req)
+		}
+	}
+	return ret
+}
+
+// Return all of the fds received. The server doesn't know which requests
+// take fds, so they may be recorded with an earlier request than the one
+// they belong to.
+func (r *recorder) fds() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ret []int
+	for _, req := range r.requests {
+		ret = append(ret, req.Fds...)
+	}
+	return ret
+}
+
+func (r *recorder) findOne(t *testing.T, sender wayland.ObjectId, opcode uint16) wltest.Request {
+	t.Helper()
+	reqs := r.find(sender, opcode)
+	if len(reqs) != 1 {
+		t.Fatalf("Expected one request with opcode %d on object %d, but got %d",
+			opcode, sender, len(reqs))
+	}
+	return reqs[0]
+}
+
+// Request opcodes.
+const (
+	shmCreatePool         = 0
+	poolCreateBuffer      = 0
+	poolDestroy           = 1
+	surfaceAttach         = 1
+	surfaceCommit         = 6
+	surfaceSetBufferScale = 8
+	pointerSetCursor      = 0
+)
+
+func TestCursor(t *testing.T) {
+	client, server := wltest.NewClient(t)
+	rec := &recorder{}
+	server.Serve(rec.handle)
+	server.Advertise(1, "wl_compositor", 4)
+	server.Advertise(2, "wl_shm", 1)
+	server.Advertise(3, "wl_seat", 5)
+	roundtrip := func() {
+		t.Helper()
+		if err := client.Roundtrip(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roundtrip()
+	globals := client.Globals()
+	bind := func(name uint32) wayland.Object {
+		obj, err := globals.BindGlobal(name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+	compositor := bind(1).(*wayland.Compositor)
+	shm := bind(2).(*wayland.Shm)
+	pointer, err := bind(3).(*wayland.Seat).GetPointer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A theme with a static cursor at sizes 24 and 48, and an animated
+	// one only at 24.
+	dir := t.TempDir()
+	cursorDir := filepath.Join(dir, "test", "cursors")
+	if err := os.MkdirAll(cursorDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	big := square(8, 48, 0xff112233)
+	staticImages := []*Image{square(4, 24, 0xff000000), big}
+	frame1, frame2 := square(4, 24, 0xffff0000), square(4, 24, 0xff00ff00)
+	frame1.Delay, frame2.Delay = time.Millisecond, time.Millisecond
+	frame2.XHot = 3
+	for name, images := range map[string][]*Image{
+		"static":   staticImages,
+		"animated": {frame1, frame2},
+	} {
+		if err := os.WriteFile(filepath.Join(cursorDir, name), encode(images), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	theme := &Theme{Name: "test", Size: 24, Path: []string{dir}}
+
+	c, err := New(compositor, shm, theme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	surfaceId := c.Surface().Id()
+
+	// At scale 2, we should get the big image, with the hotspot scaled
+	// down:
+	if err := c.Set(pointer, 7, "static", 2); err != nil {
+		t.Fatal(err)
+	}
+	roundtrip()
+	req := rec.findOne(t, shm.Id(), shmCreatePool)
+	fds := rec.fds()
+	if len(fds) != 1 || req.Arg(1) != 8*8*4 {
+		t.Fatalf("Bad create_pool: %+v", req)
+	}
+	poolId := wayland.ObjectId(req.Arg(0))
+	data, err := unix.Mmap(fds[0], 0, 8*8*4, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Munmap(data)
+	unix.Close(fds[0])
+	if binary.LittleEndian.Uint32(data[4*10:]) != big.Pixels[10] {
+		t.Errorf("Bad pixel data")
+	}
+	req = rec.findOne(t, poolId, poolCreateBuffer)
+	// id, offset, width, height, stride, format
+	if req.Arg(1) != 0 || req.Arg(2) != 8 || req.Arg(3) != 8 || req.Arg(4) != 32 ||
+		req.Arg(5) != wayland.ShmFormatArgb8888 {
+		t.Errorf("Bad create_buffer: %v", req.Body)
+	}
+	bufferId := req.Arg(0)
+	rec.findOne(t, poolId, poolDestroy)
+	if req := rec.findOne(t, surfaceId, surfaceSetBufferScale); req.Arg(0) != 2 {
+		t.Errorf("Bad buffer scale: %d", req.Arg(0))
+	}
+	if req := rec.findOne(t, surfaceId, surfaceAttach); req.Arg(0) != bufferId {
+		t.Errorf("Attached the wrong buffer")
+	}
+	rec.findOne(t, surfaceId, surfaceCommit)
+	req = rec.findOne(t, pointer.Id(), pointerSetCursor)
+	// serial, surface, hotspot x & y
+	if req.Arg(0) != 7 || req.Arg(1) != uint32(surfaceId) || req.Arg(2) != 1 || req.Arg(3) != 2 {
+		t.Errorf("Bad set_cursor: %v", req.Body)
+	}
+
+	// Setting it again should reuse the buffer:
+	if err := c.Set(pointer, 8, "static", 2); err != nil {
+		t.Fatal(err)
+	}
+	roundtrip()
+	if len(rec.find(shm.Id(), shmCreatePool)) != 1 {
+		t.Error("Images uploaded again")
+	}
+
+	// An animated cursor should cycle through its frames, moving the
+	// hotspot with attach offsets:
+	if err := c.Set(pointer, 9, "animated", 1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rec.find(surfaceId, surfaceAttach)) < 5 {
+		if time.Now().After(deadline) {
+			t.Fatal("Cursor not animated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	attaches := rec.find(surfaceId, surfaceAttach)
+	if x := int32(attaches[3].Arg(1)); x != -2 {
+		t.Errorf("Bad attach offset for second frame: %d", x)
+	}
+	if x := int32(attaches[4].Arg(1)); x != 2 {
+		t.Errorf("Bad attach offset for first frame: %d", x)
+	}
+
+	// Hiding it should stop the animation:
+	if err := c.Hide(pointer, 10); err != nil {
+		t.Fatal(err)
+	}
+	roundtrip()
+	n := len(rec.find(surfaceId, surfaceAttach))
+	time.Sleep(20 * time.Millisecond)
+	roundtrip()
+	if len(rec.find(surfaceId, surfaceAttach)) != n {
+		t.Error("Animation continued after Hide")
+	}
+	if req := rec.find(pointer.Id(), pointerSetCursor); req[len(req)-1].Arg(1) != 0 {
+		t.Error("Cursor not hidden")
+	}
+}
@@ -0,0 +1,153 @@
+package cursor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The defaults used by DefaultTheme, absent environment variables saying
+// otherwise. The path is the same as libXcursor's.
+const (
+	DefaultThemeName = "default"
+	DefaultSize      = 24
+	DefaultPath      = "~/.local/share/icons:~/.icons:/usr/share/icons:/usr/share/pixmaps"
+)
+
+// A Theme is an XCursor theme, i.e. a directory named after the theme,
+// containing a "cursors" directory of XCursor files, and optionally an
+// index.theme file naming the themes it inherits from. Cursors missing from
+// a theme are looked up in the themes it inherits from, and finally in the
+// theme named "default".
+type Theme struct {
+	// The name of the theme, e.g. "Adwaita".
+	Name string
+
+	// The nominal size of cursors, at a scale of 1.
+	Size int
+
+	// The directories in which to look for themes, in order of
+	// preference.
+	Path []string
+}
+
+// Return the theme configured by the environment variables XCURSOR_THEME,
+// XCURSOR_SIZE and XCURSOR_PATH, with defaults for any which are unset.
+func DefaultTheme() *Theme {
+	t := &Theme{
+		Name: os.Getenv("XCURSOR_THEME"),
+		Size: DefaultSize,
+	}
+	if t.Name == "" {
+		t.Name = DefaultThemeName
+	}
+	if size, err := strconv.Atoi(os.Getenv("XCURSOR_SIZE")); err == nil && size > 0 {
+		t.Size = size
+	}
+	path := os.Getenv("XCURSOR_PATH")
+	if path == "" {
+		path = DefaultPath
+	}
+	home, _ := os.UserHomeDir()
+	for _, dir := range filepath.SplitList(path) {
+		if strings.HasPrefix(dir, "~/") {
+			if home == "" {
+				continue
+			}
+			dir = filepath.Join(home, dir[2:])
+		}
+		if dir != "" {
+			t.Path = append(t.Path, dir)
+		}
+	}
+	return t
+}
+
+// Return the path of the XCursor file for the named cursor.
+func (t *Theme) Find(name string) (string, error) {
+	seen := make(map[string]bool)
+	path := t.find(t.Name, name, seen)
+	if path == "" {
+		path = t.find(DefaultThemeName, name, seen)
+	}
+	if path == "" {
+		return "", fmt.Errorf("%w: %q in theme %q", ErrNotFound, name, t.Name)
+	}
+	return path, nil
+}
+
+// Look up the cursor in theme, or the themes it inherits from. seen tracks
+// the themes which have already been searched, in case of cycles.
+func (t *Theme) find(theme, name string, seen map[string]bool) string {
+	if seen[theme] {
+		return ""
+	}
+	seen[theme] = true
+	for _, dir := range t.Path {
+		path := filepath.Join(dir, theme, "cursors", name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	for _, parent := range t.inherits(theme) {
+		if path := t.find(parent, name, seen); path != "" {
+			return path
+		}
+	}
+	return ""
+}
+
+// Return the themes which theme inherits from, according to the first
+// index.theme found for it.
+func (t *Theme) inherits(theme string) []string {
+	for _, dir := range t.Path {
+		f, err := os.Open(filepath.Join(dir, theme, "index.theme"))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		var parents []string
+		section := ""
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				section = line[1 : len(line)-1]
+				continue
+			}
+			eq := strings.IndexByte(line, '=')
+			if eq < 0 || section != "Icon Theme" || strings.TrimSpace(line[:eq]) != "Inherits" {
+				continue
+			}
+			for _, parent := range strings.FieldsFunc(line[eq+1:], func(r rune) bool {
+				return r == ',' || r == ';' || r == ' ' || r == '\t'
+			}) {
+				parents = append(parents, parent)
+			}
+		}
+		return parents
+	}
+	return nil
+}
+
+// Load the images for the named cursor, at the given size (e.g. t.Size
+// times the output's scale). If the cursor is animated, there is more than
+// one.
+func (t *Theme) Load(name string, size int) ([]*Image, error) {
+	path, err := t.Find(name)
+	if err != nil {
+		return nil, err
+	}
+	images, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	images = BestSize(images, size)
+	if len(images) == 0 {
+		return nil, fmt.Errorf("%s: %w: no images", path, ErrFormat)
+	}
+	return images, nil
+}
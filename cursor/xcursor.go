@@ -0,0 +1,161 @@
+// Package cursor loads cursor images from XCursor themes, and displays them
+// as a wl_pointer's cursor.
+//
+// Wayland leaves drawing the cursor to clients: when the pointer enters one
+// of its surfaces, the client is expected to call wl_pointer.set_cursor with
+// a surface showing the cursor image. By convention, the images come from the
+// same XCursor themes used by X11, which is what this package reads.
+package cursor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	// The data was not a valid XCursor file.
+	ErrFormat = errors.New("cursor: invalid XCursor file")
+
+	// The cursor was not found in the theme.
+	ErrNotFound = errors.New("cursor: not found")
+)
+
+// A single cursor image, from an XCursor file.
+type Image struct {
+	// The nominal size of the image, which the theme uses to pick images
+	// for a requested size. The image's actual size may differ.
+	Size int
+
+	Width, Height int
+
+	// The hotspot, i.e. the point in the image which is at the pointer's
+	// position.
+	XHot, YHot int
+
+	// How long to show this image for, if it is part of an animation.
+	Delay time.Duration
+
+	// The pixels, in rows from the top. Each pixel is an ARGB value, with
+	// premultiplied alpha; this is the same as wl_shm's argb8888 format.
+	Pixels []uint32
+}
+
+const (
+	fileMagic       = 0x72756358 // "Xcur"
+	fileHeaderSize  = 16
+	tocEntrySize    = 12
+	imageType       = 0xfffd0002
+	imageHeaderSize = 36
+	imageVersion    = 1
+	maxImageSize    = 0x7fff
+)
+
+// Read an XCursor file, returning all of the images in it, in order. Files
+// generally contain images in several sizes; several images with the same
+// size are the frames of an animation. See BestSize to pick out the ones to
+// use.
+func Decode(r io.Reader) ([]*Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// Read the XCursor file at path. See Decode.
+func Load(path string) ([]*Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	images, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return images, nil
+}
+
+func decode(data []byte) ([]*Image, error) {
+	le := binary.LittleEndian
+	if len(data) < fileHeaderSize || le.Uint32(data) != fileMagic {
+		return nil, ErrFormat
+	}
+	headerSize := le.Uint32(data[4:])
+	ntoc := le.Uint32(data[12:])
+	if headerSize < fileHeaderSize || uint64(headerSize)+uint64(ntoc)*tocEntrySize > uint64(len(data)) {
+		return nil, ErrFormat
+	}
+	var images []*Image
+	toc := data[headerSize:]
+	for i := uint32(0); i < ntoc; i++ {
+		entry := toc[i*tocEntrySize:]
+		if le.Uint32(entry) != imageType {
+			// Comments, which we don't need.
+			continue
+		}
+		pos := le.Uint32(entry[8:])
+		if uint64(pos)+imageHeaderSize > uint64(len(data)) {
+			return nil, ErrFormat
+		}
+		chunk := data[pos:]
+		chunkHeaderSize := le.Uint32(chunk)
+		if chunkHeaderSize < imageHeaderSize || uint64(chunkHeaderSize) > uint64(len(chunk)) ||
+			le.Uint32(chunk[4:]) != imageType ||
+			le.Uint32(chunk[12:]) != imageVersion {
+			return nil, ErrFormat
+		}
+		img := &Image{
+			Size:   int(le.Uint32(chunk[8:])),
+			Width:  int(le.Uint32(chunk[16:])),
+			Height: int(le.Uint32(chunk[20:])),
+			XHot:   int(le.Uint32(chunk[24:])),
+			YHot:   int(le.Uint32(chunk[28:])),
+			Delay:  time.Duration(le.Uint32(chunk[32:])) * time.Millisecond,
+		}
+		if img.Width > maxImageSize || img.Height > maxImageSize ||
+			img.XHot > img.Width || img.YHot > img.Height {
+			return nil, ErrFormat
+		}
+		pixels := chunk[chunkHeaderSize:]
+		n := img.Width * img.Height
+		if len(pixels) < n*4 {
+			return nil, ErrFormat
+		}
+		img.Pixels = make([]uint32, n)
+		for j := range img.Pixels {
+			img.Pixels[j] = le.Uint32(pixels[j*4:])
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// Pick out the images whose nominal size is closest to size, in the order
+// they appear in images. If there are several, they are the frames of an
+// animation.
+func BestSize(images []*Image, size int) []*Image {
+	best := -1
+	for _, img := range images {
+		if best < 0 || abs(img.Size-size) < abs(best-size) {
+			best = img.Size
+		}
+	}
+	var ret []*Image
+	for _, img := range images {
+		if img.Size == best {
+			ret = append(ret, img)
+		}
+	}
+	return ret
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,171 @@
+package cursor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Encode images in the XCursor format, with a comment thrown in to make sure
+// it's skipped.
+func encode(images []*Image) []byte {
+	le := binary.LittleEndian
+	buf := &bytes.Buffer{}
+	u32 := func(vs ...uint32) {
+		for _, v := range vs {
+			binary.Write(buf, le, v)
+		}
+	}
+	ntoc := uint32(len(images) + 1)
+	u32(fileMagic, fileHeaderSize, 0x10000, ntoc)
+	pos := fileHeaderSize + ntoc*tocEntrySize
+	u32(0xfffe0001, 1, pos)
+	pos += 20 + 4
+	for _, img := range images {
+		u32(imageType, uint32(img.Size), pos)
+		pos += imageHeaderSize + uint32(len(img.Pixels))*4
+	}
+	u32(20, 0xfffe0001, 1, 1, 4)
+	buf.WriteString("test")
+	for _, img := range images {
+		u32(imageHeaderSize, imageType, uint32(img.Size), imageVersion,
+			uint32(img.Width), uint32(img.Height), uint32(img.XHot), uint32(img.YHot),
+			uint32(img.Delay/time.Millisecond))
+		u32(img.Pixels...)
+	}
+	return buf.Bytes()
+}
+
+// Return a solid square image.
+func square(size, nominal int, color uint32) *Image {
+	img := &Image{
+		Size:   nominal,
+		Width:  size,
+		Height: size,
+		XHot:   size / 4,
+		YHot:   size / 2,
+		Pixels: make([]uint32, size*size),
+	}
+	for i := range img.Pixels {
+		img.Pixels[i] = color
+	}
+	return img
+}
+
+func TestDecode(t *testing.T) {
+	a := square(4, 24, 0xff0000ff)
+	b1 := square(8, 48, 0xff00ff00)
+	b1.Delay = 50 * time.Millisecond
+	b2 := square(8, 48, 0x80000080)
+	b2.Delay = 100 * time.Millisecond
+	images := []*Image{a, b1, b2}
+	got, err := Decode(bytes.NewReader(encode(images)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, images) {
+		t.Fatalf("Got %+v, expected %+v", got, images)
+	}
+
+	for size, want := range map[int][]*Image{
+		1:  {a},
+		35: {a},
+		36: {a}, // Ties go to the first.
+		40: {b1, b2},
+		96: {b1, b2},
+	} {
+		if got := BestSize(images, size); !reflect.DeepEqual(got, want) {
+			t.Errorf("BestSize(%d) = %v, expected %v", size, got, want)
+		}
+	}
+
+	bad := encode(images)
+	for _, data := range [][]byte{
+		nil,
+		[]byte("not a cursor"),
+		bad[:len(bad)-1],
+	} {
+		if _, err := Decode(bytes.NewReader(data)); !errors.Is(err, ErrFormat) {
+			t.Errorf("Expected ErrFormat, but got %v", err)
+		}
+	}
+}
+
+// Create a theme in dir, with the given cursors, and inheriting from the
+// given themes.
+func writeTheme(t *testing.T, dir, name string, inherits string, cursors ...string) {
+	t.Helper()
+	cursorDir := filepath.Join(dir, name, "cursors")
+	if err := os.MkdirAll(cursorDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if inherits != "" {
+		index := "[Icon Theme]\nName=" + name + "\nComment=Test\nInherits=" + inherits + "\n"
+		if err := os.WriteFile(filepath.Join(dir, name, "index.theme"), []byte(index), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range cursors {
+		data := encode([]*Image{square(4, 24, 0xffffffff)})
+		if err := os.WriteFile(filepath.Join(cursorDir, c), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestThemeLookup(t *testing.T) {
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	writeTheme(t, dir1, "mine", "cycle, parent", "text")
+	writeTheme(t, dir2, "mine", "", "text", "wait")
+	writeTheme(t, dir2, "cycle", "mine")
+	writeTheme(t, dir2, "parent", "", "pointer")
+	writeTheme(t, dir2, "default", "", "crosshair")
+
+	theme := &Theme{Name: "mine", Size: 24, Path: []string{dir1, dir2}}
+	for name, want := range map[string]string{
+		"text":      filepath.Join(dir1, "mine", "cursors", "text"),
+		"wait":      filepath.Join(dir2, "mine", "cursors", "wait"),
+		"pointer":   filepath.Join(dir2, "parent", "cursors", "pointer"),
+		"crosshair": filepath.Join(dir2, "default", "cursors", "crosshair"),
+	} {
+		got, err := theme.Find(name)
+		if err != nil || got != want {
+			t.Errorf("Find(%q) = %q, %v; expected %q", name, got, err, want)
+		}
+	}
+	if _, err := theme.Find("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, but got %v", err)
+	}
+	images, err := theme.Load("pointer", 48)
+	if err != nil || len(images) != 1 || images[0].Width != 4 {
+		t.Errorf("Load: got %v, %v", images, err)
+	}
+}
+
+func TestDefaultTheme(t *testing.T) {
+	t.Setenv("XCURSOR_THEME", "")
+	t.Setenv("XCURSOR_SIZE", "")
+	t.Setenv("XCURSOR_PATH", "")
+	t.Setenv("HOME", "/home/test")
+	want := &Theme{
+		Name: "default",
+		Size: 24,
+		Path: []string{"/home/test/.local/share/icons", "/home/test/.icons", "/usr/share/icons", "/usr/share/pixmaps"},
+	}
+	if got := DefaultTheme(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, expected %+v", got, want)
+	}
+
+	t.Setenv("XCURSOR_THEME", "Adwaita")
+	t.Setenv("XCURSOR_SIZE", "32")
+	t.Setenv("XCURSOR_PATH", "/a:~/b")
+	want = &Theme{Name: "Adwaita", Size: 32, Path: []string{"/a", "/home/test/b"}}
+	if got := DefaultTheme(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, expected %+v", got, want)
+	}
+}
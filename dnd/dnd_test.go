@@ -0,0 +1,353 @@
+package dnd
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/internal/wltest"
+)
+
+// A server which records the requests it receives.
+type recorder struct {
+	lock     sync.Mutex
+	requests []wltest.Request
+}
+
+func (r *recorder) handle(req wltest.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests = append(r.requests, req)
+}
+
+// Return the opcodes of the recorded requests from sender, and forget them.
+func (r *recorder) take(sender wayland.ObjectId) []uint16 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ret []uint16
+	var rest []wltest.Request
+	for _, req := range r.requests {
+		if req.Sender == sender {
+			ret = append(ret, req.Opcode)
+		} else {
+			rest = append(rest, req)
+		}
+	}
+	r.requests = rest
+	return ret
+}
+
+// Return the most recent request from sender.
+func (r *recorder) last(sender wayland.ObjectId) wltest.Request {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := len(r.requests) - 1; i >= 0; i-- {
+		if r.requests[i].Sender == sender {
+			return r.requests[i]
+		}
+	}
+	return wltest.Request{}
+}
+
+// Request opcodes.
+const (
+	managerCreateDataSource = 0
+	deviceStartDrag         = 0
+	sourceOffer             = 0
+	sourceDestroy           = 1
+	sourceSetActions        = 2
+	offerAccept             = 0
+	offerReceive            = 1
+	offerDestroy            = 2
+	offerFinish             = 3
+	offerSetActions         = 4
+)
+
+// Event opcodes.
+const (
+	deviceDataOffer        = 0
+	deviceEnter            = 1
+	deviceLeave            = 2
+	deviceMotion           = 3
+	deviceDrop             = 4
+	offerOffer             = 0
+	offerSourceActions     = 1
+	offerAction            = 2
+	sourceTarget           = 0
+	sourceDndDropPerformed = 3
+	sourceDndFinished      = 4
+	sourceAction           = 5
+)
+
+type fixture struct {
+	t       *testing.T
+	client  *wayland.Client
+	server  *wltest.Server
+	rec     *recorder
+	manager *wayland.DataDeviceManager
+	device  *wayland.DataDevice
+	surface *wayland.Surface
+}
+
+func newFixture(t *testing.T) *fixture {
+	client, server := wltest.NewClient(t)
+	f := &fixture{t: t, client: client, server: server, rec: &recorder{}}
+	server.Serve(f.rec.handle)
+	server.Advertise(1, "wl_data_device_manager", 3)
+	server.Advertise(2, "wl_seat", 5)
+	server.Advertise(3, "wl_compositor", 4)
+	f.roundtrip()
+	bind := func(name uint32) wayland.Object {
+		obj, err := client.Globals().BindGlobal(name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+	f.manager = bind(1).(*wayland.DataDeviceManager)
+	var err error
+	f.device, err = f.manager.GetDataDevice(bind(2).(*wayland.Seat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.surface, err = bind(3).(*wayland.Compositor).CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (f *fixture) roundtrip() {
+	f.t.Helper()
+	if err := f.client.Roundtrip(context.Background()); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// Introduce a new offer, and enter the surface with it.
+func (f *fixture) enter(id wayland.ObjectId, action uint32) {
+	f.server.SendEvent(f.device.Id(), deviceDataOffer, id)
+	f.server.SendEvent(id, offerOffer, "text/plain")
+	f.server.SendEvent(id, offerOffer, "text/uri-list")
+	f.server.SendEvent(f.device.Id(), deviceEnter, uint32(3), f.surface.Id(), 1.5, 2.0, id)
+	f.server.SendEvent(id, offerSourceActions, uint32(Copy|Move))
+	f.server.SendEvent(id, offerAction, action)
+	f.roundtrip()
+}
+
+func (f *fixture) expectRequests(sender wayland.ObjectId, want ...uint16) {
+	f.t.Helper()
+	f.roundtrip()
+	if got := f.rec.take(sender); !reflect.DeepEqual(got, want) {
+		f.t.Errorf("Got requests %v from object %d, expected %v", got, sender, want)
+	}
+}
+
+func TestTarget(t *testing.T) {
+	f := newFixture(t)
+	target := NewTarget(f.device)
+	defer target.Close()
+	var events []Event
+	target.Register(f.surface, func(ev Event) {
+		events = append(events, ev)
+	})
+
+	id := wayland.ObjectId(0xff000000)
+	f.enter(id, Move)
+	if len(events) != 2 {
+		t.Fatalf("Expected enter and action events, but got %v", events)
+	}
+	enter, ok := events[0].(Enter)
+	if !ok || enter.X != 1.5 || enter.Y != 2 || enter.Surface != f.surface {
+		t.Fatalf("Bad enter event: %+v", events[0])
+	}
+	o := enter.Offer
+	if ev, ok := events[1].(ActionChanged); !ok || ev.Action != Move || o.Action() != Move {
+		t.Errorf("Bad action event: %+v", events[1])
+	}
+	if got := o.MimeTypes(); !reflect.DeepEqual(got, []string{"text/plain", "text/uri-list"}) {
+		t.Errorf("Bad mime types: %v", got)
+	}
+	if o.SourceActions() != Copy|Move {
+		t.Errorf("Bad source actions: %d", o.SourceActions())
+	}
+
+	// Check that requests which would be protocol errors are refused:
+	if err := o.Finish(); err != ErrState {
+		t.Errorf("Finish before drop: expected ErrState, but got %v", err)
+	}
+	if err := o.SetActions(Copy, Ask); err != ErrInvalidAction {
+		t.Errorf("Preferred action not in set: expected ErrInvalidAction, but got %v", err)
+	}
+	if err := o.SetActions(Copy|Move, Copy|Move); err != ErrInvalidAction {
+		t.Errorf("Multiple preferred actions: expected ErrInvalidAction, but got %v", err)
+	}
+	if err := o.Accept("image/png"); err != ErrUnavailable {
+		t.Errorf("Accepting an unoffered type: expected ErrUnavailable, but got %v", err)
+	}
+	f.expectRequests(id)
+
+	if err := o.SetActions(Copy|Move|Ask, Move); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Accept(""); err != nil {
+		t.Fatal(err)
+	}
+	f.roundtrip()
+	if req := f.rec.last(id); req.Arg(0) != 3 || req.Arg(1) != 0 {
+		t.Errorf("Rejecting should send serial 3 and a null mime type, but sent %v", req.Body)
+	}
+	if err := o.Accept("text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	f.expectRequests(id, offerSetActions, offerAccept, offerAccept)
+
+	f.server.SendEvent(f.device.Id(), deviceMotion, uint32(10), 5.0, 6.0)
+	f.server.SendEvent(f.device.Id(), deviceDrop)
+	f.server.SendEvent(f.device.Id(), deviceLeave)
+	f.roundtrip()
+	if len(events) != 4 {
+		t.Fatalf("Expected motion and drop events (but not leave), but got %v", events[2:])
+	}
+	if ev, ok := events[2].(Motion); !ok || ev.X != 5 || ev.Y != 6 {
+		t.Errorf("Bad motion event: %+v", events[2])
+	}
+	if _, ok := events[3].(Drop); !ok || !o.Dropped() {
+		t.Errorf("Bad drop event: %+v", events[3])
+	}
+	// The offer should survive the leave event:
+	if r, err := o.Receive(context.Background(), "text/plain"); err != nil {
+		t.Error(err)
+	} else {
+		r.Close()
+	}
+	if err := o.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Finish(); err != ErrState {
+		t.Errorf("Finishing twice: expected ErrState, but got %v", err)
+	}
+	if err := o.Accept("text/plain"); err != ErrState {
+		t.Errorf("Accepting after finish: expected ErrState, but got %v", err)
+	}
+	f.expectRequests(id, offerReceive, offerFinish, offerDestroy)
+
+	// A drag which leaves without a drop should be destroyed:
+	events = nil
+	id = 0xff000001
+	f.enter(id, Copy)
+	f.server.SendEvent(f.device.Id(), deviceLeave)
+	f.roundtrip()
+	if len(events) != 3 {
+		t.Fatalf("Expected enter, action and leave events, but got %v", events)
+	}
+	if _, ok := events[2].(Leave); !ok {
+		t.Errorf("Expected a leave event, but got %+v", events[2])
+	}
+	f.expectRequests(id, offerDestroy)
+
+	// With the ask action, we have to pick an action after the drop:
+	events = nil
+	id = 0xff000002
+	f.enter(id, Ask)
+	o = events[0].Info().Offer
+	if err := o.Accept("text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	f.server.SendEvent(f.device.Id(), deviceDrop)
+	f.roundtrip()
+	if err := o.Finish(); err != ErrNotAccepted {
+		t.Errorf("Finishing an unresolved ask: expected ErrNotAccepted, but got %v", err)
+	}
+	if err := o.SetActions(Copy|Move|Ask, Ask); err != ErrInvalidAction {
+		t.Errorf("Choosing ask after drop: expected ErrInvalidAction, but got %v", err)
+	}
+	if err := o.SetActions(Copy, Copy); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	f.expectRequests(id, offerAccept, offerSetActions, offerFinish, offerDestroy)
+}
+
+// Offers which arrive while the target is being closed should be destroyed.
+func TestTargetClosedOffer(t *testing.T) {
+	f := newFixture(t)
+	target := NewTarget(f.device)
+	target.Close()
+
+	// Close removes the target's listeners, so deliver the offer the
+	// way a data_offer event racing with Close would:
+	var offer *wayland.DataOffer
+	f.device.AddDataOfferListener(func(o *wayland.DataOffer) {
+		offer = o
+	})
+	id := wayland.ObjectId(0xff000000)
+	f.server.SendEvent(f.device.Id(), deviceDataOffer, id)
+	f.roundtrip()
+	if offer == nil {
+		t.Fatal("Offer not received")
+	}
+	target.dataOffer(offer)
+	f.expectRequests(id, offerDestroy)
+}
+
+func TestDrag(t *testing.T) {
+	f := newFixture(t)
+	data := map[string]func(io.Writer){
+		"text/plain": func(w io.Writer) { io.WriteString(w, "dragged") },
+	}
+	var (
+		targets []string
+		actions []uint32
+		done    []bool
+	)
+	callbacks := DragCallbacks{
+		Target: func(mimeType string) { targets = append(targets, mimeType) },
+		Action: func(action uint32) { actions = append(actions, action) },
+		Done: func(action uint32, ok bool) {
+			actions = append(actions, action)
+			done = append(done, ok)
+		},
+	}
+	if _, err := StartDrag(f.manager, f.device, f.surface, nil, 9, Copy|8, data, callbacks); err != ErrInvalidAction {
+		t.Errorf("Expected ErrInvalidAction, but got %v", err)
+	}
+	d, err := StartDrag(f.manager, f.device, f.surface, nil, 9, Copy|Move, data, callbacks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.roundtrip()
+	create := f.rec.last(f.manager.Id())
+	sourceId := wayland.ObjectId(create.Arg(0))
+	if req := f.rec.last(sourceId); req.Opcode != sourceSetActions || req.Arg(0) != Copy|Move {
+		t.Errorf("Bad set_actions: %+v", req)
+	}
+	// source, origin, icon, serial
+	if req := f.rec.last(f.device.Id()); req.Opcode != deviceStartDrag ||
+		wayland.ObjectId(req.Arg(0)) != sourceId || wayland.ObjectId(req.Arg(1)) != f.surface.Id() ||
+		req.Arg(2) != 0 || req.Arg(3) != 9 {
+		t.Errorf("Bad start_drag: %+v", req)
+	}
+	f.expectRequests(sourceId, sourceOffer, sourceSetActions)
+
+	f.server.SendEvent(sourceId, sourceTarget, "text/plain")
+	f.server.SendEvent(sourceId, sourceAction, uint32(Move))
+	f.server.SendEvent(sourceId, sourceDndDropPerformed)
+	f.roundtrip()
+	if !d.Dropped() || d.Target() != "text/plain" || d.Action() != Move {
+		t.Errorf("Bad state after drop: %v, %q, %d", d.Dropped(), d.Target(), d.Action())
+	}
+	f.server.SendEvent(sourceId, sourceDndFinished)
+	f.roundtrip()
+	if !reflect.DeepEqual(targets, []string{"text/plain"}) ||
+		!reflect.DeepEqual(actions, []uint32{Move, Move}) ||
+		!reflect.DeepEqual(done, []bool{true}) {
+		t.Errorf("Bad callbacks: %v, %v, %v", targets, actions, done)
+	}
+	f.expectRequests(sourceId, sourceDestroy)
+}
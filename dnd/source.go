@@ -0,0 +1,214 @@
+// Package dnd implements both sides of drag and drop, on top of
+// wl_data_device.
+//
+// On the source side, StartDrag offers some data, and reports how the drag
+// ended. On the destination side, a Target tracks drags entering, moving
+// over and leaving surfaces, and delivers them as events to per-surface
+// handlers, which negotiate a mime type and action with the Offer they
+// carry.
+//
+// The protocol has a number of rules about which requests may be made when,
+// most of which result in protocol errors (and thus a dead connection) if
+// broken. The types in this package check them, returning errors instead.
+package dnd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"zenhack.net/go/wayland"
+)
+
+// Drag and drop actions, which may be or-ed together to form sets.
+const (
+	None = wayland.DataDeviceManagerDndActionNone
+	Copy = wayland.DataDeviceManagerDndActionCopy
+	Move = wayland.DataDeviceManagerDndActionMove
+	Ask  = wayland.DataDeviceManagerDndActionAsk
+
+	allActions = Copy | Move | Ask
+)
+
+var (
+	// An action set contains unknown actions, or a preferred action isn't
+	// a single action from the set.
+	ErrInvalidAction = errors.New("dnd: invalid action")
+
+	// A request was made at the wrong point in the drag: e.g. Finish
+	// before the drop, or anything after Finish.
+	ErrState = errors.New("dnd: request not allowed in this state")
+
+	// Finish was called without a mime type having been accepted, or an
+	// action selected.
+	ErrNotAccepted = errors.New("dnd: no mime type or action accepted")
+
+	// Receive was asked for a mime type which the offer doesn't offer.
+	ErrUnavailable = errors.New("dnd: no data of that type")
+)
+
+// Callbacks for the source side of a drag. Any of them may be nil. They are
+// invoked from whichever goroutine dispatches the data device's queue.
+type DragCallbacks struct {
+	// The destination accepted mimeType, or none, in which case it's "".
+	// For feedback only; the destination may change its mind.
+	Target func(mimeType string)
+
+	// The compositor selected an action, e.g. because the user pressed a
+	// modifier key. Useful for changing the cursor to match.
+	Action func(action uint32)
+
+	// The drag ended. If ok, the destination finished with the data, and
+	// action is the final action; if it's Move, the source should now
+	// delete the data. Otherwise the drag was cancelled.
+	Done func(action uint32, ok bool)
+}
+
+// A drag in progress, started by this client.
+type Drag struct {
+	source    *wayland.DataSource
+	callbacks DragCallbacks
+
+	lock     sync.Mutex
+	target   string
+	action   uint32
+	dropped  bool
+	finished bool
+}
+
+// Start dragging data from origin, which must have an implicit pointer grab
+// with the given serial (i.e. a button is being held down). icon, if not
+// nil, is given the role of drag icon, and moved along with the pointer.
+// actions is the set of actions the source supports; it must not be None.
+//
+// data is as for clipboard.Offer: when the destination asks for data, the
+// function for the mime type it wants is called on a new goroutine to write
+// it.
+//
+// With compositors older than version 3 of wl_data_device_manager, there
+// are no actions, and Done is never called.
+func StartDrag(manager *wayland.DataDeviceManager, device *wayland.DataDevice,
+	origin, icon *wayland.Surface, serial uint32, actions uint32,
+	data map[string]func(io.Writer), callbacks DragCallbacks) (*Drag, error) {
+	if actions == None || actions&^allActions != 0 {
+		return nil, ErrInvalidAction
+	}
+	source, err := manager.CreateDataSource()
+	if err != nil {
+		return nil, err
+	}
+	d := &Drag{source: source, callbacks: callbacks}
+	source.OnSend(func(mimeType string, fd int) {
+		f := os.NewFile(uintptr(fd), "dnd")
+		write, ok := data[mimeType]
+		if !ok {
+			f.Close()
+			return
+		}
+		go func() {
+			defer f.Close()
+			write(f)
+		}()
+	})
+	source.OnTarget(d.onTarget)
+	source.OnAction(d.onAction)
+	source.OnDndDropPerformed(d.onDropPerformed)
+	source.OnDndFinished(func() { d.end(true) })
+	source.OnCancelled(func() { d.end(false) })
+	for mimeType := range data {
+		if err := source.Offer(mimeType); err != nil {
+			source.Destroy()
+			return nil, err
+		}
+	}
+	// set_actions must be sent exactly once, before start_drag:
+	if source.Version() >= 3 {
+		if err := source.SetActions(actions); err != nil {
+			source.Destroy()
+			return nil, err
+		}
+	}
+	if err := device.StartDrag(source, origin, icon, serial); err != nil {
+		source.Destroy()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Return the mime type most recently accepted by the destination, or "" if
+// none.
+func (d *Drag) Target() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.target
+}
+
+// Return the action most recently selected by the compositor.
+func (d *Drag) Action() uint32 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.action
+}
+
+// Report whether the user has dropped the data. The drag isn't over until
+// the destination finishes with it, though.
+func (d *Drag) Dropped() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.dropped
+}
+
+// Cancel the drag, if it hasn't ended already. Done is not called.
+func (d *Drag) Cancel() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.finished {
+		return nil
+	}
+	d.finished = true
+	return d.source.Destroy()
+}
+
+func (d *Drag) onTarget(mimeType string) {
+	d.lock.Lock()
+	d.target = mimeType
+	cb := d.callbacks.Target
+	d.lock.Unlock()
+	if cb != nil {
+		cb(mimeType)
+	}
+}
+
+func (d *Drag) onAction(action uint32) {
+	d.lock.Lock()
+	d.action = action
+	cb := d.callbacks.Action
+	d.lock.Unlock()
+	if cb != nil {
+		cb(action)
+	}
+}
+
+func (d *Drag) onDropPerformed() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.dropped = true
+}
+
+// Handle dnd_finished or cancelled. Either way the source is done with.
+func (d *Drag) end(ok bool) {
+	d.lock.Lock()
+	if d.finished {
+		d.lock.Unlock()
+		return
+	}
+	d.finished = true
+	action := d.action
+	cb := d.callbacks.Done
+	d.lock.Unlock()
+	d.source.Destroy()
+	if cb != nil {
+		cb(action, ok)
+	}
+}
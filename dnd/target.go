@@ -0,0 +1,435 @@
+package dnd
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/clipboard"
+)
+
+// A drag and drop event, delivered to the handler for the surface the drag
+// is over. The concrete type is one of Enter, Motion, ActionChanged, Leave
+// or Drop.
+type Event interface {
+	Info() EventInfo
+}
+
+// Information common to all events.
+type EventInfo struct {
+	// The data being dragged.
+	Offer *Offer
+
+	// The surface the drag is over.
+	Surface *wayland.Surface
+}
+
+func (e EventInfo) Info() EventInfo {
+	return e
+}
+
+// A drag entered the surface, at the given surface-local coordinates. The
+// handler should typically call Offer.Accept and Offer.SetActions in
+// response, and again after Motion events if what it accepts depends on the
+// position.
+type Enter struct {
+	EventInfo
+	X, Y float64
+}
+
+// The drag moved.
+type Motion struct {
+	EventInfo
+	Time time.Duration
+	X, Y float64
+}
+
+// The compositor selected a different action; see Offer.Action.
+type ActionChanged struct {
+	EventInfo
+	Action uint32
+}
+
+// The drag left the surface, without being dropped. The offer is no longer
+// usable.
+type Leave struct {
+	EventInfo
+}
+
+// The data was dropped on the surface. The handler should Receive the data
+// and then call Finish, or Destroy if it doesn't want the data after all.
+// If the offer's action is Ask, the handler should first let the user
+// choose an action, and pass it to SetActions.
+//
+// If no mime type was accepted, or the action is None, the drag was
+// cancelled, and the handler need only Destroy the offer.
+type Drop struct {
+	EventInfo
+}
+
+// A Target receives drags over a data device's surfaces.
+type Target struct {
+	device          *wayland.DataDevice
+	removeListeners []func()
+
+	lock     sync.Mutex
+	handlers map[*wayland.Surface]func(Event)
+
+	// Offers introduced by data_offer, which haven't been used yet by an
+	// enter event. Selection offers also end up here, and are left to
+	// others (e.g. the clipboard package).
+	pending map[*wayland.DataOffer]*Offer
+
+	current *Offer // The offer of the drag over one of our surfaces.
+	closed  bool
+}
+
+// An Offer is the data being dragged, as seen by the destination.
+//
+// Its methods return ErrState for requests which are not allowed at that
+// point of the drag, rather than breaking the protocol: after a drop, only
+// Receive, SetActions (with a single action), Accept, Finish and Destroy
+// are allowed, and after Finish or Destroy, nothing is. Before the drop,
+// Finish is not allowed.
+type Offer struct {
+	offer  *wayland.DataOffer
+	target *Target
+
+	// Guarded by target.lock:
+	serial        uint32
+	surface       *wayland.Surface
+	mimeTypes     []string
+	sourceActions uint32
+	action        uint32
+	preferred     uint32 // From the last SetActions.
+	accepted      string
+	dropped       bool
+	done          bool // Finished or destroyed.
+}
+
+// Start receiving drags on device. Drags over surfaces without a handler
+// are ignored.
+func NewTarget(device *wayland.DataDevice) *Target {
+	t := &Target{
+		device:   device,
+		handlers: make(map[*wayland.Surface]func(Event)),
+		pending:  make(map[*wayland.DataOffer]*Offer),
+	}
+	t.removeListeners = []func(){
+		device.AddDataOfferListener(t.dataOffer),
+		device.AddEnterListener(t.enter),
+		device.AddMotionListener(t.motion),
+		device.AddLeaveListener(t.leave),
+		device.AddDropListener(t.drop),
+		device.AddSelectionListener(t.selection),
+	}
+	return t
+}
+
+// Deliver events for drags over surface to handler, on whichever goroutine
+// dispatches the data device's queue. Returns a function which removes the
+// handler.
+func (t *Target) Register(surface *wayland.Surface, handler func(Event)) (remove func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.handlers[surface] = handler
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.handlers, surface)
+	}
+}
+
+// Stop receiving drags. Offers which have been dropped but not finished
+// remain usable.
+func (t *Target) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	for _, remove := range t.removeListeners {
+		remove()
+	}
+	if o := t.current; o != nil && !o.dropped && !o.done {
+		o.done = true
+		o.offer.Destroy()
+	}
+	t.current = nil
+	t.pending = nil
+}
+
+func (t *Target) dataOffer(offer *wayland.DataOffer) {
+	if offer == nil {
+		return
+	}
+	o := &Offer{offer: offer, target: t}
+	t.lock.Lock()
+	if t.closed {
+		// The event raced with Close, so nobody will ever use the offer.
+		t.lock.Unlock()
+		offer.Destroy()
+		return
+	}
+	t.pending[offer] = o
+	t.lock.Unlock()
+	offer.AddOfferListener(func(mimeType string) {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		o.mimeTypes = append(o.mimeTypes, mimeType)
+	})
+	offer.AddSourceActionsListener(func(actions uint32) {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		o.sourceActions = actions
+	})
+	offer.AddActionListener(func(action uint32) {
+		t.lock.Lock()
+		o.action = action
+		handler := t.handlerFor(o)
+		t.lock.Unlock()
+		if handler != nil {
+			handler(ActionChanged{EventInfo{o, o.surface}, action})
+		}
+	})
+}
+
+// Return the handler to deliver o's events to, if it's the current offer.
+// Must be called with the lock held.
+func (t *Target) handlerFor(o *Offer) func(Event) {
+	if o == nil || o != t.current {
+		return nil
+	}
+	return t.handlers[o.surface]
+}
+
+func (t *Target) selection(offer *wayland.DataOffer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.closed {
+		delete(t.pending, offer)
+	}
+}
+
+func (t *Target) enter(serial uint32, surface *wayland.Surface, x, y wayland.Fixed, offer *wayland.DataOffer) {
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+	o, ok := t.pending[offer]
+	if !ok {
+		// A drag with no source, which is the origin's business.
+		t.lock.Unlock()
+		return
+	}
+	delete(t.pending, offer)
+	o.serial = serial
+	o.surface = surface
+	t.current = o
+	handler := t.handlerFor(o)
+	t.lock.Unlock()
+	if handler != nil {
+		handler(Enter{EventInfo{o, surface}, x.Float64(), y.Float64()})
+	}
+}
+
+func (t *Target) motion(time_ uint32, x, y wayland.Fixed) {
+	t.lock.Lock()
+	o := t.current
+	handler := t.handlerFor(o)
+	t.lock.Unlock()
+	if handler != nil {
+		handler(Motion{EventInfo{o, o.surface}, time.Duration(time_) * time.Millisecond, x.Float64(), y.Float64()})
+	}
+}
+
+func (t *Target) leave() {
+	t.lock.Lock()
+	o := t.current
+	t.current = nil
+	if o == nil {
+		t.lock.Unlock()
+		return
+	}
+	handler := t.handlers[o.surface]
+	// The compositor also sends leave after a drop; the offer must stay
+	// alive until it's finished. Otherwise, it's dead.
+	dropped := o.dropped
+	if !dropped && !o.done {
+		o.done = true
+		o.offer.Destroy()
+	}
+	t.lock.Unlock()
+	if handler != nil && !dropped {
+		handler(Leave{EventInfo{o, o.surface}})
+	}
+}
+
+func (t *Target) drop() {
+	t.lock.Lock()
+	o := t.current
+	if o == nil {
+		t.lock.Unlock()
+		return
+	}
+	o.dropped = true
+	handler := t.handlerFor(o)
+	if handler == nil && !o.done {
+		// Nobody wants it.
+		o.done = true
+		o.offer.Destroy()
+	}
+	t.lock.Unlock()
+	if handler != nil {
+		handler(Drop{EventInfo{o, o.surface}})
+	}
+}
+
+// Return the mime types offered.
+func (o *Offer) MimeTypes() []string {
+	o.target.lock.Lock()
+	defer o.target.lock.Unlock()
+	return append([]string(nil), o.mimeTypes...)
+}
+
+// Return the set of actions the source supports.
+func (o *Offer) SourceActions() uint32 {
+	o.target.lock.Lock()
+	defer o.target.lock.Unlock()
+	return o.sourceActions
+}
+
+// Return the action most recently selected by the compositor, from the
+// actions supported by both sides. Once dropped, this is the action to
+// perform, unless it's Ask.
+func (o *Offer) Action() uint32 {
+	o.target.lock.Lock()
+	defer o.target.lock.Unlock()
+	return o.action
+}
+
+// Report whether the data has been dropped.
+func (o *Offer) Dropped() bool {
+	o.target.lock.Lock()
+	defer o.target.lock.Unlock()
+	return o.dropped
+}
+
+// Tell the source that we would accept the data as mimeType, or, if it's
+// "", that we wouldn't accept it at all. Unless a mime type is accepted when
+// the data is dropped, the drag is cancelled.
+func (o *Offer) Accept(mimeType string) error {
+	o.target.lock.Lock()
+	defer o.target.lock.Unlock()
+	if o.done {
+		return ErrState
+	}
+	if mimeType != "" && !o.has(mimeType) {
+		return ErrUnavailable
+	}
+	o.accepted = mimeType
+	// The generated code sends "" as null:
+	return o.offer.Accept(o.serial, mimeType)
+}
+
+// Set the actions we support, and the one we prefer, which must be one of
+// them; the compositor then selects the final action (see Action). Before
+// the drop, preferred may be None, and actions may include Ask, meaning the
+// user will be asked what to do. After a drop with the Ask action, this
+// should be called once more with the action chosen, which must be one of the
+// source's actions, before calling Finish.
+//
+// With compositors older than version 3, there are no actions, and this does
+// nothing.
+func (o *Offer) SetActions(actions, preferred uint32) error {
+	o.target.lock.Lock()
+	defer o.target.lock.Unlock()
+	if o.done {
+		return ErrState
+	}
+	if actions&^allActions != 0 || preferred&^actions != 0 ||
+		preferred&(preferred-1) != 0 {
+		// Unknown actions, preferred not in actions, or not a
+		// single action.
+		return ErrInvalidAction
+	}
+	if o.dropped && (preferred == None || preferred == Ask || preferred&o.sourceActions == 0) {
+		return ErrInvalidAction
+	}
+	if o.offer.Version() < 3 {
+		return nil
+	}
+	o.preferred = preferred
+	return o.offer.SetActions(actions, preferred)
+}
+
+// Ask the source for the data as mimeType, and return a reader for it, as
+// with clipboard.Receive. This is allowed both before and after the drop.
+func (o *Offer) Receive(ctx context.Context, mimeType string) (io.ReadCloser, error) {
+	o.target.lock.Lock()
+	defer o.target.lock.Unlock()
+	if o.done {
+		return nil, ErrState
+	}
+	if !o.has(mimeType) {
+		return nil, ErrUnavailable
+	}
+	return clipboard.Receive(ctx, o.offer, mimeType)
+}
+
+// Must be called with the lock held.
+func (o *Offer) has(mimeType string) bool {
+	for _, m := range o.mimeTypes {
+		if m == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell the source that we're done with the data, after a drop, and destroy
+// the offer. If the action was Move, the source then deletes the data.
+//
+// Returns ErrState if the data hasn't been dropped, and ErrNotAccepted if no
+// mime type is accepted, or the action is None or an unresolved Ask. In the
+// latter case, the offer should be destroyed instead.
+func (o *Offer) Finish() error {
+	o.target.lock.Lock()
+	defer o.target.lock.Unlock()
+	if o.done || !o.dropped {
+		return ErrState
+	}
+	if o.offer.Version() < 3 {
+		o.done = true
+		return o.offer.Destroy()
+	}
+	action := o.action
+	if action == Ask {
+		// We're allowed to finish once we've picked an action, even
+		// if the compositor's confirmation hasn't arrived yet.
+		action = o.preferred
+	}
+	if o.accepted == "" || action == None || action == Ask {
+		return ErrNotAccepted
+	}
+	o.done = true
+	err := o.offer.Finish()
+	o.offer.Destroy()
+	return err
+}
+
+// Destroy the offer, e.g. if the user dismisses an Ask, or we don't want the
+// data after all. Does nothing if it's already been finished or destroyed.
+func (o *Offer) Destroy() error {
+	o.target.lock.Lock()
+	defer o.target.lock.Unlock()
+	if o.done {
+		return nil
+	}
+	o.done = true
+	return o.offer.Destroy()
+}
@@ -2,6 +2,16 @@ package wayland
 
 import (
 	"errors"
+	"fmt"
 )
 
-var ErrMissingNul = errors.New("String in message body was missing NUL terminator.")
+var (
+	ErrMissingNul = errors.New("String in message body was missing NUL terminator.")
+
+	ErrUnsupportedInterface = errors.New("Interface is not supported by this library")
+	ErrUnknownGlobal        = errors.New("No global with that name")
+)
+
+func unsupportedInterface(name string) error {
+	return fmt.Errorf("%w: %q", ErrUnsupportedInterface, name)
+}
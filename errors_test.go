@@ -0,0 +1,73 @@
+package wayland
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// Protocol errors should be reported with the failing object's interface, and
+// should unwrap to that interface's error type.
+func TestTypedServerError(t *testing.T) {
+	client, server := newTestClient(t)
+	shm := addTestObject(client, &Shm{}).(*Shm)
+
+	go func() {
+		server.readRequest()
+		server.sendEvent(1, 0, shm.Id(), uint32(ShmErrorInvalidFd), "bad fd")
+	}()
+	err := client.Roundtrip(context.Background())
+
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("Expected a *ServerError, but got %v", err)
+	}
+	if serverErr.Interface != "wl_shm" || serverErr.Version != shm.Version() {
+		t.Fatalf("Wrong interface or version: %v", serverErr)
+	}
+	if !errors.Is(err, ShmErrorInvalidFd) {
+		t.Fatalf("Error %v does not match ShmErrorInvalidFd", err)
+	}
+	var shmErr ShmError
+	if !errors.As(err, &shmErr) || shmErr != ShmErrorInvalidFd {
+		t.Fatalf("Could not extract ShmError from %v", err)
+	}
+}
+
+// MainLoop should stop when the server reports an error, even if the server
+// doesn't hang up.
+func TestMainLoopServerError(t *testing.T) {
+	client, server := newTestClient(t)
+	cb, err := client.GetDisplay().Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb.OnDone(func(uint32) {})
+	server.sendEvent(1, 0, ObjectId(1), uint32(DisplayErrorNoMemory), "out of memory")
+	server.sendEvent(cb.Id(), 0, uint32(0))
+
+	err = client.MainLoop()
+	if !errors.Is(err, DisplayErrorNoMemory) {
+		t.Fatalf("Expected DisplayErrorNoMemory, but got %v", err)
+	}
+}
+
+// Setting the display's error handler shouldn't stop the client from
+// failing when the server reports an error.
+func TestOnErrorKeepsClientError(t *testing.T) {
+	client, server := newTestClient(t)
+	var handled bool
+	client.GetDisplay().OnError(func(ObjectId, uint32, string) { handled = true })
+
+	go func() {
+		server.readRequest()
+		server.sendEvent(1, 0, ObjectId(1), uint32(DisplayErrorNoMemory), "out of memory")
+	}()
+	err := client.Roundtrip(context.Background())
+	if !errors.Is(err, DisplayErrorNoMemory) {
+		t.Fatalf("Expected DisplayErrorNoMemory, but got %v", err)
+	}
+	if !handled {
+		t.Fatal("Error handler was not called")
+	}
+}
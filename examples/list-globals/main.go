@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
 
 	"zenhack.net/go/wayland"
 )
@@ -16,11 +16,8 @@ func chkfatal(err error) {
 func main() {
 	client, err := wayland.Dial("")
 	chkfatal(err)
-	client.OnGlobal(func(obj wayland.Object) {
-		fmt.Printf("new global: (%d, %s, %d)\n", obj.Id(), obj.Interface(), obj.Version())
-	})
-	chkfatal(client.Sync(func() {
-		os.Exit(0)
-	}))
-	chkfatal(client.MainLoop())
+	chkfatal(client.Roundtrip(context.Background()))
+	for _, g := range client.Globals().List() {
+		fmt.Printf("global: (%d, %s, %d)\n", g.Name, g.Interface, g.Version)
+	}
 }
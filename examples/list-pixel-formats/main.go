@@ -1,8 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"time"
 
 	"zenhack.net/go/wayland"
 )
@@ -14,25 +15,21 @@ func chkfatal(err error) {
 }
 
 func main() {
+	ctx := context.Background()
 	client, err := wayland.Dial("")
 	chkfatal(err)
-	client.OnGlobal(func(obj wayland.Object) {
-		shm, ok := obj.(*wayland.Shm)
-		if !ok {
-			return
-		}
-		fmt.Println("Got the shm object; querying formats.")
-		shm.OnFormat(func(format uint32) {
-			fmt.Println(format)
-		})
 
-		// We don't care about the rest of the globals; unsubscribe:
-		client.OnGlobal(nil)
-
-		// exit when the format events are done:
-		client.Sync(func() {
-			os.Exit(0)
-		})
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	global, err := client.Globals().WaitFor(waitCtx, "wl_shm")
+	chkfatal(err)
+	obj, err := client.Globals().BindGlobal(global.Name, 0)
+	chkfatal(err)
+	obj.(*wayland.Shm).OnFormat(func(format uint32) {
+		fmt.Println(format)
 	})
-	chkfatal(client.MainLoop())
+
+	// The format events are sent in response to binding the shm object,
+	// so they will have arrived by the time this returns:
+	chkfatal(client.Roundtrip(ctx))
 }
@@ -1,17 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
 	"image"
+	"image/draw"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"os"
-
-	"github.com/justincormack/go-memfd"
+	"time"
 
 	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/shm"
 )
 
 var (
@@ -32,56 +33,43 @@ func main() {
 	chkfatal(err)
 	file.Close()
 
-	var (
-		shm        *wayland.Shm
-		compositor *wayland.Compositor
-	)
 	client, err := wayland.Dial("")
 	chkfatal(err)
-	client.OnGlobal(func(obj wayland.Object) {
-		switch o := obj.(type) {
-		case *wayland.Shm:
-			shm = o
-		case *wayland.Compositor:
-			compositor = o
-		default:
-			// Don't care.
-		}
-	})
-	chkfatal(client.Sync(func() {
-		if compositor == nil {
-			fmt.Println("Didn't receive needed compositor object; exiting.")
-			os.Exit(1)
-		}
-		if shm == nil {
-			fmt.Println("Didn't receive needed shm object; exiting.")
-			os.Exit(1)
-		}
 
-		// Unsubscribe to globals:
-		client.OnGlobal(nil)
-
-		mfd, err := memfd.Create()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bind := func(iface string) wayland.Object {
+		global, err := client.Globals().WaitFor(ctx, iface)
+		chkfatal(err)
+		obj, err := client.Globals().BindGlobal(global.Name, 0)
 		chkfatal(err)
-		bounds := img.Bounds()
+		return obj
+	}
+	compositor := bind("wl_compositor").(*wayland.Compositor)
+	wlShm := bind("wl_shm").(*wayland.Shm)
+	shell := bind("wl_shell").(*wayland.Shell)
+
+	surface, err := compositor.CreateSurface()
+	chkfatal(err)
+	shellSurface, err := shell.GetShellSurface(surface)
+	chkfatal(err)
+	shellSurface.OnPing(func(serial uint32) {
+		chkfatal(shellSurface.Pong(serial))
+	})
+	chkfatal(shellSurface.SetToplevel())
+	chkfatal(shellSurface.SetTitle(*imgPath))
 
-		// We assume the xgrb8888 pixel format, which the protocol says all
-		// renderers should support.
-		size := bounds.Dx() * bounds.Dy() * 4
+	// We use the xrgb8888 pixel format, which all compositors must
+	// support.
+	bounds := img.Bounds()
+	pool, err := shm.NewPool(wlShm, bounds.Dx()*bounds.Dy()*4)
+	chkfatal(err)
+	buf, err := pool.NewBuffer(bounds.Dx(), bounds.Dy(), wayland.ShmFormatXrgb8888)
+	chkfatal(err)
+	draw.Draw(buf.Image(), buf.Image().Bounds(), img, bounds.Min, draw.Src)
 
-		chkfatal(mfd.Truncate(int64(size)))
-		mfdBytes, err := mfd.Map()
-		chkfatal(err)
-		pool, err := shm.CreatePool(int(mfd.Fd()), int32(size))
-		chkfatal(err)
-		buf, err := pool.CreateBuffer(
-			0,
-			int32(bounds.Dx()),
-			int32(bounds.Dy()),
-			int32(4*bounds.Dx()),
-			wayland.ShmFormatXrgb8888,
-		)
-		chkfatal(err)
-	}))
+	chkfatal(buf.Attach(surface, 0, 0))
+	chkfatal(surface.Damage(0, 0, int32(bounds.Dx()), int32(bounds.Dy())))
+	chkfatal(surface.Commit())
 	chkfatal(client.MainLoop())
 }
@@ -0,0 +1,269 @@
+package wayland
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A global object advertised by the server via wl_registry.
+type Global struct {
+	// The numeric name the server assigned to the global; this is what
+	// gets passed to BindGlobal.
+	Name uint32
+
+	Interface string
+
+	// The highest version of the interface the server supports.
+	Version uint32
+}
+
+// Globals keeps track of the globals the server has advertised, without
+// binding them. Use Client.Globals to get a client's tracker.
+//
+// The tracker is updated as the registry's events are dispatched; the registry
+// is on the client's default queue, so until that has been dispatched (e.g. by
+// a call to Client.Roundtrip), the tracker will be empty.
+type Globals struct {
+	client *Client
+
+	// Held while invoking the add and remove callbacks, so that they see
+	// changes one at a time, in order.
+	callbackLock sync.Mutex
+
+	// Guards the fields below.
+	lock    sync.Mutex
+	globals map[uint32]Global
+
+	// Closed (and replaced) whenever a global is added or removed.
+	changed chan struct{}
+
+	nextCallback int
+	onAdd        map[int]func(Global)
+	onRemove     map[int]func(Global)
+}
+
+func newGlobals(c *Client) *Globals {
+	return &Globals{
+		client:   c,
+		globals:  make(map[uint32]Global),
+		changed:  make(chan struct{}),
+		onAdd:    make(map[int]func(Global)),
+		onRemove: make(map[int]func(Global)),
+	}
+}
+
+// Return the client's global tracker.
+func (c *Client) Globals() *Globals {
+	return c.globals
+}
+
+// Return the currently advertised globals, sorted by name.
+func (g *Globals) List() []Global {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.list()
+}
+
+// Like List, but g.lock must be held.
+func (g *Globals) list() []Global {
+	ret := make([]Global, 0, len(g.globals))
+	for _, gl := range g.globals {
+		ret = append(ret, gl)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// Return a global implementing the named interface. If there are several
+// (e.g. multiple wl_outputs), the one with the lowest name is returned, which
+// is normally the one advertised first.
+func (g *Globals) Lookup(interface_ string) (Global, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.lookup(interface_)
+}
+
+func (g *Globals) lookup(interface_ string) (ret Global, ok bool) {
+	for _, gl := range g.globals {
+		if gl.Interface == interface_ && (!ok || gl.Name < ret.Name) {
+			ret, ok = gl, true
+		}
+	}
+	return ret, ok
+}
+
+// Bind the global with the given name. The object is bound at the highest
+// version supported by both the server and this library, but no higher than
+// maxVersion, unless maxVersion is 0. The returned object will be a proxy
+// of the appropriate type, e.g. *Seat for wl_seat, assigned to the
+// registry's queue.
+//
+// Returns ErrUnknownGlobal if the server hasn't advertised such a global, or
+// an error wrapping ErrUnsupportedInterface if the library doesn't know about
+// its interface.
+func (g *Globals) BindGlobal(name uint32, maxVersion uint32) (Object, error) {
+	g.lock.Lock()
+	gl, ok := g.globals[name]
+	g.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownGlobal, name)
+	}
+	info, ok := interfaceRegistry[gl.Interface]
+	if !ok {
+		return nil, unsupportedInterface(gl.Interface)
+	}
+	version := gl.Version
+	if info.version < version {
+		version = info.version
+	}
+	if maxVersion != 0 && maxVersion < version {
+		version = maxVersion
+	}
+	return g.client.registry.Bind(name, gl.Interface, version)
+}
+
+// Wait until the server advertises a global implementing the named interface,
+// and return it. Dispatches the registry's queue while waiting, so the same
+// restrictions apply as for EventQueue.Dispatch.
+func (g *Globals) WaitFor(ctx context.Context, interface_ string) (Global, error) {
+	c := g.client
+	c.lock.Lock()
+	q := c.registry.getQueue()
+	c.lock.Unlock()
+	for {
+		g.lock.Lock()
+		gl, ok := g.lookup(interface_)
+		changed := g.changed
+		g.lock.Unlock()
+		if ok {
+			return gl, nil
+		}
+
+		// Wait for events, but also stop waiting if someone else
+		// dispatches the queue and changes the globals:
+		waitCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-changed:
+				cancel()
+			case <-waitCtx.Done():
+			}
+		}()
+		err := q.wait(waitCtx, nil)
+		cancel()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Global{}, ctxErr
+		} else if err != nil && err != context.Canceled {
+			return Global{}, err
+		}
+		if err := q.DispatchPending(); err != nil {
+			return Global{}, err
+		}
+		if err := c.serverError(); err != nil {
+			return Global{}, err
+		}
+	}
+}
+
+// Register a callback to be invoked whenever a global is added. It is
+// immediately invoked for each global which is already known. Returns a
+// function which unregisters the callback.
+//
+// The callbacks are invoked from whichever goroutine dispatches the
+// registry's queue. OnAdd and OnRemove must not be called from within a
+// callback.
+func (g *Globals) OnAdd(cb func(Global)) (cancel func()) {
+	g.callbackLock.Lock()
+	defer g.callbackLock.Unlock()
+	g.lock.Lock()
+	known := g.list()
+	id := g.register(g.onAdd, cb)
+	g.lock.Unlock()
+	for _, gl := range known {
+		cb(gl)
+	}
+	return func() { g.unregister(g.onAdd, id) }
+}
+
+// Register a callback to be invoked whenever a global is removed. Returns a
+// function which unregisters the callback. See also OnAdd.
+func (g *Globals) OnRemove(cb func(Global)) (cancel func()) {
+	g.callbackLock.Lock()
+	defer g.callbackLock.Unlock()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	id := g.register(g.onRemove, cb)
+	return func() { g.unregister(g.onRemove, id) }
+}
+
+// Add cb to the callbacks in m, returning its key. g.lock must be held.
+func (g *Globals) register(m map[int]func(Global), cb func(Global)) int {
+	id := g.nextCallback
+	g.nextCallback++
+	m[id] = cb
+	return id
+}
+
+func (g *Globals) unregister(m map[int]func(Global), id int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(m, id)
+}
+
+// Return the callbacks in m, in the order they were registered. g.lock must be
+// held.
+func callbacks(m map[int]func(Global)) []func(Global) {
+	ids := make([]int, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	ret := make([]func(Global), len(ids))
+	for i, id := range ids {
+		ret[i] = m[id]
+	}
+	return ret
+}
+
+// Handle a wl_registry.global event.
+func (g *Globals) add(gl Global) {
+	g.callbackLock.Lock()
+	defer g.callbackLock.Unlock()
+	g.lock.Lock()
+	g.globals[gl.Name] = gl
+	g.notifyChanged()
+	cbs := callbacks(g.onAdd)
+	g.lock.Unlock()
+	for _, cb := range cbs {
+		cb(gl)
+	}
+}
+
+// Handle a wl_registry.global_remove event.
+func (g *Globals) remove(name uint32) {
+	g.callbackLock.Lock()
+	defer g.callbackLock.Unlock()
+	g.lock.Lock()
+	gl, ok := g.globals[name]
+	if !ok {
+		g.lock.Unlock()
+		return
+	}
+	delete(g.globals, name)
+	g.notifyChanged()
+	cbs := callbacks(g.onRemove)
+	g.lock.Unlock()
+	for _, cb := range cbs {
+		cb(gl)
+	}
+}
+
+// Wake up anyone waiting for the globals to change. g.lock must be held.
+func (g *Globals) notifyChanged() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
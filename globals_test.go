@@ -0,0 +1,188 @@
+package wayland
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Advertise the globals gs via the registry with the given id.
+func (s *testServer) advertise(registry ObjectId, gs ...Global) {
+	for _, g := range gs {
+		s.sendEvent(registry, 0, g.Name, g.Interface, g.Version)
+	}
+}
+
+// Globals should be bound at the highest version both sides support, and
+// only when asked.
+func TestBindGlobal(t *testing.T) {
+	client, server := newTestClient(t)
+	registry := client.GetRegistry().Id()
+	server.advertise(registry,
+		Global{Name: 1, Interface: "wl_seat", Version: 7},
+		Global{Name: 2, Interface: "wl_shm", Version: 1},
+		Global{Name: 3, Interface: "zz_unknown", Version: 1},
+	)
+	go func() {
+		// get_registry, then sync.
+		server.readRequest()
+		req, _ := server.readRequest()
+		server.sendEvent(ObjectId(req.arg(0)), 0, uint32(0))
+	}()
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	globals := client.Globals()
+	if list := globals.List(); len(list) != 3 || list[0].Interface != "wl_seat" {
+		t.Fatalf("Unexpected globals: %v", list)
+	}
+	client.lock.Lock()
+	nobjs := len(client.objects)
+	client.lock.Unlock()
+
+	obj, err := globals.BindGlobal(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seat, ok := obj.(*Seat)
+	if !ok {
+		t.Fatalf("Expected a *Seat, but got %T", obj)
+	}
+	if seat.Version() != 6 {
+		t.Fatalf("Seat bound at version %d, expected 6", seat.Version())
+	}
+	req, err := server.readRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &bytes.Buffer{}
+	write_uint(want, 1)
+	write_string(want, "wl_seat")
+	write_uint(want, 6)
+	write_new_id(want, seat)
+	if req.Sender != registry || req.Opcode != 0 || !bytes.Equal(req.body, want.Bytes()) {
+		t.Fatalf("Bad bind request: %v %x", req.header, req.body)
+	}
+	client.lock.Lock()
+	if len(client.objects) != nobjs+1 {
+		t.Fatal("Binding a global should create exactly one object")
+	}
+	client.lock.Unlock()
+
+	obj, err = globals.BindGlobal(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Version() != 2 {
+		t.Fatalf("Seat bound at version %d, expected 2", obj.Version())
+	}
+	if _, err = globals.BindGlobal(3, 0); !errors.Is(err, ErrUnsupportedInterface) {
+		t.Fatalf("Expected ErrUnsupportedInterface, but got %v", err)
+	}
+	if _, err = globals.BindGlobal(4, 0); !errors.Is(err, ErrUnknownGlobal) {
+		t.Fatalf("Expected ErrUnknownGlobal, but got %v", err)
+	}
+}
+
+// OnAdd should report existing globals as well as new ones, and OnRemove
+// should report removals.
+func TestGlobalsCallbacks(t *testing.T) {
+	client, server := newTestClient(t)
+	server.serveSync()
+	ctx := context.Background()
+	registry := client.GetRegistry().Id()
+	globals := client.Globals()
+
+	server.advertise(registry, Global{Name: 1, Interface: "wl_output", Version: 3})
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var added, removed []Global
+	cancelAdd := globals.OnAdd(func(g Global) { added = append(added, g) })
+	globals.OnRemove(func(g Global) { removed = append(removed, g) })
+	if len(added) != 1 || added[0].Name != 1 {
+		t.Fatalf("Existing globals not replayed: %v", added)
+	}
+
+	server.advertise(registry, Global{Name: 2, Interface: "wl_output", Version: 3})
+	server.sendEvent(registry, 1, uint32(1))
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 || added[1].Name != 2 {
+		t.Fatalf("New global not reported: %v", added)
+	}
+	if len(removed) != 1 || removed[0] != (Global{Name: 1, Interface: "wl_output", Version: 3}) {
+		t.Fatalf("Removed global not reported: %v", removed)
+	}
+	if g, ok := globals.Lookup("wl_output"); !ok || g.Name != 2 {
+		t.Fatalf("Lookup returned %v, %v", g, ok)
+	}
+
+	cancelAdd()
+	server.advertise(registry, Global{Name: 3, Interface: "wl_output", Version: 3})
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 {
+		t.Fatal("Callback called after being cancelled")
+	}
+}
+
+// Setting the registry's handlers shouldn't stop the client from tracking
+// globals.
+func TestGlobalsRegistryHandlers(t *testing.T) {
+	client, server := newTestClient(t)
+	server.serveSync()
+	ctx := context.Background()
+	registry := client.GetRegistry()
+	var added, removed int
+	registry.OnGlobal(func(uint32, string, uint32) { added++ })
+	registry.OnGlobalRemove(func(uint32) { removed++ })
+
+	server.advertise(registry.Id(),
+		Global{Name: 1, Interface: "wl_output", Version: 3},
+		Global{Name: 2, Interface: "wl_shm", Version: 1},
+	)
+	server.sendEvent(registry.Id(), 1, uint32(1))
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 || removed != 1 {
+		t.Fatalf("Handlers saw %d globals added and %d removed", added, removed)
+	}
+	if _, ok := client.Globals().Lookup("wl_output"); ok {
+		t.Fatal("Removed global is still present")
+	}
+	if g, ok := client.Globals().Lookup("wl_shm"); !ok || g.Name != 2 {
+		t.Fatalf("Lookup returned %v, %v", g, ok)
+	}
+}
+
+// WaitFor should return once the global shows up, or when the context is done.
+func TestGlobalsWaitFor(t *testing.T) {
+	client, server := newTestClient(t)
+	registry := client.GetRegistry().Id()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		server.advertise(registry, Global{Name: 5, Interface: "wl_seat", Version: 1})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	g, err := client.Globals().WaitFor(ctx, "wl_seat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Name != 5 {
+		t.Fatalf("Wrong global: %v", g)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.Globals().WaitFor(ctx, "wl_output")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected a timeout, but got %v", err)
+	}
+}
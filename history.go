@@ -0,0 +1,211 @@
+package wayland
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// A record of the most recent messages sent and received, so that when the
+// server reports a protocol error, we can show what the client had been
+// doing with the object concerned. Recording a message copies at most
+// historyDataSize bytes of its body into a fixed-size ring buffer, so it
+// never allocates.
+
+const (
+	// The number of messages remembered.
+	historySize = 256
+
+	// How much of each message's body is kept; arguments past this point
+	// show up as <truncated>.
+	historyDataSize = 64
+
+	// How many of each message's file descriptors are kept.
+	historyFds = 4
+
+	// For how many of each message's object arguments the interface is
+	// kept.
+	historyObjs = 4
+)
+
+type historyEntry struct {
+	// The message, which was a request if request is true, or an event
+	// otherwise.
+	key     messageKey
+	request bool
+	sender  ObjectId
+
+	// The start of the message's body, and its file descriptors.
+	n    int
+	data [historyDataSize]byte
+	nfds int
+	fds  [historyFds]int
+
+	// The interfaces of the objects passed as object arguments, in
+	// order, as they were when the message was recorded; their ids may
+	// since have been reused for objects of other interfaces. "" for
+	// objects which weren't known.
+	nobjs int
+	objs  [historyObjs]string
+}
+
+// The message, as looked up in the interface registry.
+func (e *historyEntry) message() *messageInfo {
+	if e.request {
+		return &e.key.info.requests[e.key.opcode]
+	}
+	return &e.key.info.events[e.key.opcode]
+}
+
+// A ring buffer of historyEntries. Guarded by Client.lock.
+type history struct {
+	entries [historySize]historyEntry
+	next    int // The index to record the next message at.
+	full    bool
+}
+
+// Record a message sent or received by the object with the given id. data is
+// the message's body. Returns the new entry, whose objs the caller must fill
+// in.
+func (h *history) record(key messageKey, request bool, sender ObjectId, data []byte, fds []int) *historyEntry {
+	e := &h.entries[h.next]
+	e.key = key
+	e.request = request
+	e.sender = sender
+	e.n = copy(e.data[:], data)
+	e.nfds = copy(e.fds[:], fds)
+	e.nobjs = 0
+	h.next++
+	if h.next == historySize {
+		h.next = 0
+		h.full = true
+	}
+	return e
+}
+
+// Call f on each entry, oldest first.
+func (h *history) each(f func(e *historyEntry)) {
+	if h.full {
+		for i := h.next; i < historySize; i++ {
+			f(&h.entries[i])
+		}
+	}
+	for i := 0; i < h.next; i++ {
+		f(&h.entries[i])
+	}
+}
+
+// Record a message in c's history. c.lock must be held.
+func (c *Client) recordMessage(obj remoteProxy, request bool, opcode uint16, data []byte, fds []int) {
+	info, ok := interfaceRegistry[obj.Interface()]
+	if !ok {
+		return
+	}
+	msgs := info.events
+	if request {
+		msgs = info.requests
+	}
+	if int(opcode) >= len(msgs) {
+		return
+	}
+	e := c.history.record(messageKey{info: info, opcode: opcode}, request, obj.Id(), data, fds)
+	eachObjectArg(&msgs[opcode], e.data[:e.n], func(arg argInfo, id ObjectId, _ string) {
+		if arg.type_ != "object" || e.nobjs == historyObjs {
+			return
+		}
+		e.objs[e.nobjs] = ""
+		if obj, ok := c.objects[id]; ok {
+			e.objs[e.nobjs] = obj.Interface()
+		}
+		e.nobjs++
+	})
+}
+
+// Return the remembered messages which were sent by or to the object with
+// the given id, or which refer to it in their arguments, oldest first and
+// formatted as for tracing. Objects are shown with the interfaces they had
+// when the message was recorded. c.lock must be held.
+func (c *Client) recentMessages(id ObjectId) []string {
+	var ret []string
+	c.history.each(func(e *historyEntry) {
+		msg := e.message()
+		if e.sender != id && !argsReferTo(msg, e.data[:e.n], id) {
+			return
+		}
+		prefix := ""
+		if e.request {
+			prefix = "-> "
+		}
+		ret = append(ret, c.formatMessage(prefix, e.key.info.name, e.sender, msg,
+			e.data[:e.n], e.fds[:e.nfds], e.objs[:e.nobjs]))
+	})
+	return ret
+}
+
+// Report whether any of the object or new_id arguments in data, which is
+// the (possibly truncated) body of a msg, is id.
+func argsReferTo(msg *messageInfo, data []byte, id ObjectId) bool {
+	found := false
+	eachObjectArg(msg, data, func(_ argInfo, arg ObjectId, _ string) {
+		if arg == id {
+			found = true
+		}
+	})
+	return found
+}
+
+// Call f for each object and new_id argument in data, the body of a msg, with
+// the argument's id and interface. For generic new_ids (as in
+// wl_registry.bind) the interface is the one sent in the message. Stops
+// early if data is too short.
+func eachObjectArg(msg *messageInfo, data []byte, f func(arg argInfo, id ObjectId, iface string)) {
+	offset := 0
+	for _, arg := range msg.args {
+		switch arg.type_ {
+		case "fd":
+		case "string", "array":
+			size, err := readU32(&offset, data)
+			if err != nil {
+				return
+			}
+			offset += ceil32(int(size))
+		case "object", "new_id":
+			iface := arg.interface_
+			if arg.type_ == "new_id" && iface == "" {
+				s, err := read_string(&offset, data)
+				if err != nil {
+					return
+				}
+				offset += 4 // The version.
+				iface = s
+			}
+			id, err := readU32(&offset, data)
+			if err != nil {
+				return
+			}
+			f(arg, ObjectId(id), iface)
+		default:
+			offset += 4
+		}
+	}
+}
+
+// libwayland reports requests from unknown objects, or referring to unknown
+// objects, as errors on the display, with messages like "invalid object 42".
+var invalidObjectRegexp = regexp.MustCompile(`invalid object (\d+)`)
+
+// Return the object a protocol error is about: usually the one it was sent
+// for, but see invalidObjectRegexp.
+func errorSubject(oid ObjectId, message string) ObjectId {
+	if oid != 1 {
+		return oid
+	}
+	m := invalidObjectRegexp.FindStringSubmatch(message)
+	if m == nil {
+		return oid
+	}
+	id, err := strconv.ParseUint(m[1], 10, 32)
+	if err != nil {
+		return oid
+	}
+	return ObjectId(id)
+}
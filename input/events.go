@@ -0,0 +1,177 @@
+package input
+
+import (
+	"time"
+
+	"zenhack.net/go/wayland"
+)
+
+// An input event. The concrete type is one of the event types defined in
+// this package, e.g. PointerMotion or Key.
+type Event interface {
+	Info() EventInfo
+}
+
+// Information common to all events.
+type EventInfo struct {
+	// The seat whose device produced the event.
+	Seat *Seat
+
+	// The surface which has the device's focus: for pointer and keyboard
+	// events, the surface most recently entered, and for touch events the
+	// surface on which the touch point went down. nil if there is no such
+	// surface, or if the client had already destroyed it when the event
+	// arrived.
+	Surface *wayland.Surface
+
+	// The serial of the event, or, for events which don't carry one, of the
+	// most recent event from the same device which did. Requests like
+	// Pointer.SetCursor need this.
+	Serial uint32
+
+	// The event's timestamp, relative to an unspecified base, or 0 for
+	// events without a timestamp.
+	Time time.Duration
+}
+
+func (e EventInfo) Info() EventInfo {
+	return e
+}
+
+// The pointer entered a surface. X and Y are surface-local coordinates.
+type PointerEnter struct {
+	EventInfo
+	X, Y float64
+}
+
+// The pointer left a surface. Also sent if the seat loses its pointer while
+// it is over a surface.
+type PointerLeave struct {
+	EventInfo
+}
+
+type PointerMotion struct {
+	EventInfo
+	X, Y float64
+}
+
+// A button was pressed or released. Button is a linux input event code,
+// e.g. BTN_LEFT.
+type PointerButton struct {
+	EventInfo
+	Button  uint32
+	Pressed bool
+}
+
+// Scrolling; Axis is one of wayland.PointerAxis*.
+type PointerAxis struct {
+	EventInfo
+	Axis  uint32
+	Value float64
+}
+
+// The source of the axis events in the current frame; Source is one of
+// wayland.PointerAxisSource*.
+type PointerAxisSource struct {
+	EventInfo
+	Source uint32
+}
+
+// Scrolling on the axis has stopped.
+type PointerAxisStop struct {
+	EventInfo
+	Axis uint32
+}
+
+// The number of discrete steps (e.g. wheel clicks) of the axis event in the
+// same frame.
+type PointerAxisDiscrete struct {
+	EventInfo
+	Axis     uint32
+	Discrete int32
+}
+
+// Marks the end of a group of pointer events which belong together. See
+// PointerFrameAccumulator.
+type PointerFrame struct {
+	EventInfo
+}
+
+// The keyboard's keymap. The handler takes ownership of Fd, and must close
+// it.
+type Keymap struct {
+	EventInfo
+	Format uint32
+	Fd     int
+	Size   uint32
+}
+
+// The keyboard focus entered a surface. Keys are the keys which are
+// currently pressed, as linux input event codes.
+type KeyboardEnter struct {
+	EventInfo
+	Keys []uint32
+}
+
+// The keyboard focus left a surface. Also sent if the seat loses its keyboard
+// while a surface has focus.
+type KeyboardLeave struct {
+	EventInfo
+}
+
+// A key was pressed or released. Key is a linux input event code; add 8 to
+// get an XKB keycode.
+type Key struct {
+	EventInfo
+	Key     uint32
+	Pressed bool
+}
+
+// The state of the keyboard's modifiers changed.
+type Modifiers struct {
+	EventInfo
+	Depressed, Latched, Locked uint32
+	Group                      uint32
+}
+
+// The keyboard's repeat rate (in characters per second) and delay. A rate
+// of 0 disables repeat.
+type RepeatInfo struct {
+	EventInfo
+	Rate  int32
+	Delay time.Duration
+}
+
+type TouchDown struct {
+	EventInfo
+	ID   int32
+	X, Y float64
+}
+
+type TouchUp struct {
+	EventInfo
+	ID int32
+}
+
+type TouchMotion struct {
+	EventInfo
+	ID   int32
+	X, Y float64
+}
+
+// Marks the end of a group of touch events which belong together.
+type TouchFrame struct {
+	EventInfo
+}
+
+// The compositor has taken over the touch points; any active ones should be
+// forgotten. Also sent if the seat loses its touch device while there are
+// active touch points.
+type TouchCancel struct {
+	EventInfo
+}
+
+// Convert a protocol timestamp, in milliseconds, to a Duration.
+func msec(t uint32) time.Duration {
+	return time.Duration(t) * time.Millisecond
+}
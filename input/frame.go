@@ -0,0 +1,198 @@
+package input
+
+import (
+	"zenhack.net/go/wayland"
+)
+
+// A group of pointer events which belong together, as collected by a
+// PointerFrameAccumulator. For example, scrolling diagonally produces axis
+// events for both axes, which should be applied together.
+type PointerFrameData struct {
+	// As of the last event in the frame: Surface is the surface the
+	// pointer is over at the end of the frame, if any, and Time is the
+	// latest timestamp.
+	EventInfo
+
+	// Whether the pointer left a surface during the frame, and if so
+	// which one. If the pointer moved from one surface to another, both
+	// Leave and Enter are set.
+	Leave       bool
+	LeftSurface *wayland.Surface
+
+	// Whether the pointer entered Surface during the frame.
+	Enter bool
+
+	// Whether the pointer's position changed, either by entering a surface
+	// or by moving. X and Y are the surface-local position at the end of
+	// the frame, and DX and DY the distance moved since the previous frame;
+	// the latter are zero if the pointer entered the surface in this frame.
+	Motion bool
+	X, Y   float64
+	DX, DY float64
+
+	// Buttons pressed or released during the frame, in order.
+	Buttons []PointerButton
+
+	// Scrolling during the frame, indexed by axis
+	// (wayland.PointerAxisVerticalScroll or
+	// wayland.PointerAxisHorizontalScroll).
+	Axes [2]AxisFrame
+
+	// The source of the axis events, one of wayland.PointerAxisSource*,
+	// if the server said.
+	HasSource bool
+	Source    uint32
+}
+
+// Scrolling on one axis during a frame.
+type AxisFrame struct {
+	// Whether there were any events for the axis.
+	Active bool
+
+	// The total distance scrolled, in surface-local coordinates.
+	Value float64
+
+	// The total number of discrete steps, e.g. wheel clicks, or 0 if the
+	// source is continuous.
+	Discrete int32
+
+	// Whether scrolling stopped, e.g. because the user lifted their
+	// fingers off a touchpad. Clients may use this to end kinetic
+	// scrolling.
+	Stop bool
+}
+
+// A PointerFrameAccumulator collects pointer events into frames.
+//
+// wl_pointer version 5 and later group events into frames, terminated by a
+// PointerFrame event; the accumulator delivers a PointerFrameData for each.
+// Older servers don't send frame events, so for those each event is
+// delivered as a frame of its own. Likewise, the PointerLeave sent when a
+// seat loses its pointer ends the frame.
+type PointerFrameAccumulator struct {
+	handler func(PointerFrameData)
+
+	// Per seat, since frames from different seats are independent.
+	seats map[*Seat]*pointerFrameState
+}
+
+type pointerFrameState struct {
+	// The frame being accumulated.
+	frame PointerFrameData
+	dirty bool
+
+	// The position of the pointer as of the last frame, and whether it is
+	// known.
+	hasPosition bool
+	x, y        float64
+}
+
+// Create an accumulator which delivers frames to handler.
+func NewPointerFrameAccumulator(handler func(PointerFrameData)) *PointerFrameAccumulator {
+	return &PointerFrameAccumulator{
+		handler: handler,
+		seats:   make(map[*Seat]*pointerFrameState),
+	}
+}
+
+// Process an event. Returns true if it was a pointer event, which the
+// accumulator has consumed, or false if it was some other kind of event, which
+// the caller should handle itself. Typical usage in a Seat's handler:
+//
+//	if !acc.Handle(ev) {
+//		// handle keyboard and touch events...
+//	}
+func (a *PointerFrameAccumulator) Handle(ev Event) bool {
+	info := ev.Info()
+	st, ok := a.seats[info.Seat]
+	if !ok {
+		st = &pointerFrameState{}
+		a.seats[info.Seat] = st
+	}
+	f := &st.frame
+
+	switch ev := ev.(type) {
+	case PointerEnter:
+		f.Enter = true
+		f.Motion = true
+		f.X, f.Y = ev.X, ev.Y
+		st.hasPosition = false
+	case PointerLeave:
+		f.Leave = true
+		f.LeftSurface = ev.Surface
+		f.Enter = false
+		f.Motion = false
+		st.hasPosition = false
+	case PointerMotion:
+		f.Motion = true
+		f.X, f.Y = ev.X, ev.Y
+	case PointerButton:
+		f.Buttons = append(f.Buttons, ev)
+	case PointerAxis:
+		if ev.Axis < uint32(len(f.Axes)) {
+			f.Axes[ev.Axis].Active = true
+			f.Axes[ev.Axis].Value += ev.Value
+		}
+	case PointerAxisDiscrete:
+		if ev.Axis < uint32(len(f.Axes)) {
+			f.Axes[ev.Axis].Active = true
+			f.Axes[ev.Axis].Discrete += ev.Discrete
+		}
+	case PointerAxisStop:
+		if ev.Axis < uint32(len(f.Axes)) {
+			f.Axes[ev.Axis].Active = true
+			f.Axes[ev.Axis].Stop = true
+		}
+	case PointerAxisSource:
+		f.HasSource = true
+		f.Source = ev.Source
+	case PointerFrame:
+		a.flush(st)
+		return true
+	default:
+		return false
+	}
+
+	st.dirty = true
+	if info.Time != 0 {
+		f.Time = info.Time
+	}
+	f.Seat = info.Seat
+	f.Serial = info.Serial
+	if _, ok := ev.(PointerLeave); ok {
+		f.Surface = nil
+	} else {
+		f.Surface = info.Surface
+	}
+	if !framed(info.Seat) {
+		a.flush(st)
+	}
+	return true
+}
+
+// Deliver the accumulated frame, if it isn't empty, and start a new one.
+func (a *PointerFrameAccumulator) flush(st *pointerFrameState) {
+	if !st.dirty {
+		return
+	}
+	f := st.frame
+	if f.Motion {
+		if st.hasPosition {
+			f.DX, f.DY = f.X-st.x, f.Y-st.y
+		}
+		st.hasPosition = true
+		st.x, st.y = f.X, f.Y
+	}
+	st.frame = PointerFrameData{}
+	st.dirty = false
+	a.handler(f)
+}
+
+// Report whether the seat's pointer sends frame events.
+func framed(seat *Seat) bool {
+	if seat == nil {
+		return false
+	}
+	p := seat.Pointer()
+	return p != nil && p.Version() >= 5
+}
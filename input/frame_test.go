@@ -0,0 +1,186 @@
+package input
+
+import (
+	"context"
+	"testing"
+
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/internal/wltest"
+)
+
+// A client with a seat, and a surface for its devices to focus.
+type seatFixture struct {
+	t       *testing.T
+	client  *wayland.Client
+	server  *wltest.Server
+	rec     *recorder
+	seatId  wayland.ObjectId
+	surface *wayland.Surface
+}
+
+// Set up a seat of the given version, whose events are passed to handler.
+func newSeatFixture(t *testing.T, version uint32, handler func(Event)) *seatFixture {
+	client, server := wltest.NewClient(t)
+	f := &seatFixture{
+		t:      t,
+		client: client,
+		server: server,
+		rec:    &recorder{},
+	}
+	server.Serve(f.rec.handle)
+	t.Cleanup(Watch(client, handler))
+	server.Advertise(1, "wl_seat", version)
+	server.Advertise(2, "wl_compositor", 4)
+	f.roundtrip2()
+	f.seatId = wayland.ObjectId(f.rec.find(t, wltest.RegistryId, 0).Arg(5))
+
+	obj, err := client.Globals().BindGlobal(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.surface, err = obj.(*wayland.Compositor).CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (f *seatFixture) roundtrip() {
+	f.t.Helper()
+	if err := f.client.Roundtrip(context.Background()); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// Requests made by event handlers are sent after the sync request, so it
+// takes a second round trip to be sure the server has seen them.
+func (f *seatFixture) roundtrip2() {
+	f.t.Helper()
+	f.roundtrip()
+	f.roundtrip()
+}
+
+// Advertise the capabilities, and return the ids of the devices the client
+// creates in response (0 for those it doesn't).
+func (f *seatFixture) setCapabilities(caps uint32) (pointer, keyboard wayland.ObjectId) {
+	f.t.Helper()
+	f.server.SendEvent(f.seatId, 0, caps)
+	f.roundtrip2()
+	if caps&wayland.SeatCapabilityPointer != 0 {
+		pointer = wayland.ObjectId(f.rec.find(f.t, f.seatId, 0).Arg(0))
+	}
+	if caps&wayland.SeatCapabilityKeyboard != 0 {
+		keyboard = wayland.ObjectId(f.rec.find(f.t, f.seatId, 1).Arg(0))
+	}
+	return pointer, keyboard
+}
+
+// Events between frame events should be delivered as one frame.
+func TestPointerFrames(t *testing.T) {
+	var frames []PointerFrameData
+	acc := NewPointerFrameAccumulator(func(f PointerFrameData) {
+		frames = append(frames, f)
+	})
+	var other []Event
+	f := newSeatFixture(t, 5, func(ev Event) {
+		if !acc.Handle(ev) {
+			other = append(other, ev)
+		}
+	})
+	pointerId, keyboardId := f.setCapabilities(
+		wayland.SeatCapabilityPointer | wayland.SeatCapabilityKeyboard)
+	s := f.server
+	vert, horiz := uint32(wayland.PointerAxisVerticalScroll), uint32(wayland.PointerAxisHorizontalScroll)
+
+	s.SendEvent(pointerId, 0, uint32(1), f.surface.Id(), 10.0, 20.0)
+	s.SendEvent(pointerId, 5)
+	s.SendEvent(pointerId, 2, uint32(100), 12.0, 23.0)
+	s.SendEvent(pointerId, 6, uint32(wayland.PointerAxisSourceWheel))
+	s.SendEvent(pointerId, 4, uint32(100), vert, 15.0)
+	s.SendEvent(pointerId, 8, vert, int32(1))
+	s.SendEvent(pointerId, 4, uint32(100), horiz, -5.0)
+	s.SendEvent(pointerId, 7, uint32(110), horiz)
+	s.SendEvent(keyboardId, 4, uint32(2), uint32(0), uint32(0), uint32(0), uint32(0))
+	s.SendEvent(pointerId, 5)
+	s.SendEvent(pointerId, 3, uint32(3), uint32(120), uint32(0x110), uint32(wayland.PointerButtonStatePressed))
+	s.SendEvent(pointerId, 3, uint32(4), uint32(130), uint32(0x110), uint32(0))
+	s.SendEvent(pointerId, 5)
+	s.SendEvent(pointerId, 1, uint32(5), f.surface.Id())
+	s.SendEvent(pointerId, 5)
+	f.roundtrip()
+
+	if len(other) != 1 {
+		t.Fatalf("Non-pointer events not passed through: %v", other)
+	}
+	if len(frames) != 4 {
+		t.Fatalf("Expected 4 frames, but got %d: %+v", len(frames), frames)
+	}
+	enter, scroll, click, leave := frames[0], frames[1], frames[2], frames[3]
+	if !enter.Enter || !enter.Motion || enter.X != 10 || enter.Y != 20 ||
+		enter.DX != 0 || enter.Surface != f.surface || enter.Serial != 1 {
+		t.Errorf("Bad enter frame: %+v", enter)
+	}
+	if scroll.Enter || !scroll.Motion || scroll.DX != 2 || scroll.DY != 3 {
+		t.Errorf("Bad motion in scroll frame: %+v", scroll)
+	}
+	if !scroll.HasSource || scroll.Source != wayland.PointerAxisSourceWheel {
+		t.Errorf("Bad axis source: %+v", scroll)
+	}
+	if (scroll.Axes[vert] != AxisFrame{Active: true, Value: 15, Discrete: 1}) {
+		t.Errorf("Bad vertical axis: %+v", scroll.Axes[vert])
+	}
+	if (scroll.Axes[horiz] != AxisFrame{Active: true, Value: -5, Stop: true}) {
+		t.Errorf("Bad horizontal axis: %+v", scroll.Axes[horiz])
+	}
+	if len(click.Buttons) != 2 || !click.Buttons[0].Pressed || click.Buttons[1].Pressed ||
+		click.Motion || click.Serial != 4 {
+		t.Errorf("Bad click frame: %+v", click)
+	}
+	if !leave.Leave || leave.LeftSurface != f.surface || leave.Surface != nil {
+		t.Errorf("Bad leave frame: %+v", leave)
+	}
+}
+
+// Servers which don't send frame events should get a frame per event.
+func TestPointerFramesLegacy(t *testing.T) {
+	var frames []PointerFrameData
+	acc := NewPointerFrameAccumulator(func(f PointerFrameData) {
+		frames = append(frames, f)
+	})
+	f := newSeatFixture(t, 4, func(ev Event) { acc.Handle(ev) })
+	pointerId, _ := f.setCapabilities(wayland.SeatCapabilityPointer)
+
+	f.server.SendEvent(pointerId, 0, uint32(1), f.surface.Id(), 10.0, 20.0)
+	f.server.SendEvent(pointerId, 2, uint32(100), 11.0, 20.0)
+	f.server.SendEvent(pointerId, 4, uint32(100), uint32(wayland.PointerAxisVerticalScroll), 15.0)
+	f.roundtrip()
+	if len(frames) != 3 {
+		t.Fatalf("Expected 3 frames, but got %d: %+v", len(frames), frames)
+	}
+	if frames[1].DX != 1 || !frames[2].Axes[0].Active || frames[2].Motion {
+		t.Fatalf("Bad frames: %+v", frames)
+	}
+}
+
+// A v5 pointer sends no frame event after the leave which the seat
+// synthesizes when it loses the pointer, so that should end the frame.
+func TestPointerFramesCapabilityRemoved(t *testing.T) {
+	var frames []PointerFrameData
+	acc := NewPointerFrameAccumulator(func(f PointerFrameData) {
+		frames = append(frames, f)
+	})
+	f := newSeatFixture(t, 5, func(ev Event) { acc.Handle(ev) })
+	pointerId, _ := f.setCapabilities(wayland.SeatCapabilityPointer)
+
+	f.server.SendEvent(pointerId, 0, uint32(1), f.surface.Id(), 10.0, 20.0)
+	f.server.SendEvent(pointerId, 5)
+	f.server.SendEvent(pointerId, 2, uint32(100), 11.0, 20.0)
+	f.server.SendEvent(f.seatId, 0, uint32(0))
+	f.roundtrip()
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 frames, but got %d: %+v", len(frames), frames)
+	}
+	if last := frames[1]; !last.Leave || last.LeftSurface != f.surface || last.Surface != nil {
+		t.Fatalf("Bad leave frame: %+v", last)
+	}
+}
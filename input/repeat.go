@@ -0,0 +1,173 @@
+package input
+
+import (
+	"sync"
+	"time"
+)
+
+// The repeat rate and delay to use if the keyboard doesn't send
+// repeat_info, which was added in wl_keyboard version 4.
+const (
+	DefaultRepeatRate  = 25
+	DefaultRepeatDelay = 600 * time.Millisecond
+)
+
+// A synthetic key press, generated by a KeyRepeater while a key is held down.
+// The embedded Key is the original press, except that Time is advanced to
+// when the repeat was due.
+type KeyRepeat struct {
+	Key
+
+	// How many times the key has repeated, starting with 1.
+	Count int
+}
+
+// A Clock schedules the timers used by a KeyRepeater. It exists so tests can
+// substitute a fake clock; the default uses time.AfterFunc.
+type Clock interface {
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a timer scheduled by a Clock. *time.Timer satisfies this.
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// A KeyRepeater implements key repeat. Compositors never repeat keys
+// themselves; instead they tell the client how fast to repeat them, via
+// wl_keyboard.repeat_info, and it is up to the client to do so.
+//
+// Pass all of a seat's events to Handle; while a key is held down, the
+// repeater sends KeyRepeat events on the channel returned by C, after the
+// keyboard's repeat delay and then at its repeat rate. Only the most
+// recently pressed key repeats. Repeating stops when the key is released,
+// another key is pressed, or the keyboard focus leaves the surface.
+//
+// If the receiver falls behind, repeats are dropped rather than queued up,
+// so a key never keeps repeating after it's released.
+type KeyRepeater struct {
+	clock Clock
+	c     chan KeyRepeat
+
+	lock   sync.Mutex
+	closed bool
+	rate   int32
+	delay  time.Duration
+
+	// The key currently repeating, if any. gen is incremented whenever
+	// this changes, so timers which were stopped too late can tell
+	// they're stale.
+	repeating bool
+	key       Key
+	count     int
+	timer     Timer
+	gen       uint64
+}
+
+// Create a KeyRepeater. If clock is nil, the real time is used.
+func NewKeyRepeater(clock Clock) *KeyRepeater {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &KeyRepeater{
+		clock: clock,
+		c:     make(chan KeyRepeat, 1),
+		rate:  DefaultRepeatRate,
+		delay: DefaultRepeatDelay,
+	}
+}
+
+// Return the channel on which repeats are delivered. The channel is closed
+// by Close.
+func (r *KeyRepeater) C() <-chan KeyRepeat {
+	return r.c
+}
+
+// Process an event. Events other than Key, KeyboardLeave and RepeatInfo are
+// ignored, so it's fine to pass everything.
+func (r *KeyRepeater) Handle(ev Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	switch ev := ev.(type) {
+	case RepeatInfo:
+		r.rate, r.delay = ev.Rate, ev.Delay
+		if r.rate <= 0 {
+			r.stop()
+		}
+	case Key:
+		if ev.Pressed {
+			r.stop()
+			if r.rate > 0 {
+				r.repeating = true
+				r.key = ev
+				r.schedule(r.delay)
+			}
+		} else if r.repeating && ev.Key == r.key.Key && ev.Seat == r.key.Seat {
+			r.stop()
+		}
+	case KeyboardLeave:
+		if r.repeating && ev.Seat == r.key.Seat {
+			r.stop()
+		}
+	}
+}
+
+// Stop repeating, and close the channel returned by C.
+func (r *KeyRepeater) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	r.stop()
+	r.closed = true
+	close(r.c)
+}
+
+// Schedule the next repeat. Must be called with the lock held.
+func (r *KeyRepeater) schedule(d time.Duration) {
+	gen := r.gen
+	r.timer = r.clock.AfterFunc(d, func() {
+		r.fire(gen, d)
+	})
+}
+
+func (r *KeyRepeater) fire(gen uint64, d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if gen != r.gen || r.closed {
+		return
+	}
+	r.count++
+	r.key.Time += d
+	select {
+	case r.c <- KeyRepeat{Key: r.key, Count: r.count}:
+	default:
+	}
+	r.schedule(time.Second / time.Duration(r.rate))
+}
+
+// Stop repeating the current key, if any, and discard any repeat waiting to
+// be received. Must be called with the lock held.
+func (r *KeyRepeater) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.repeating = false
+	r.count = 0
+	r.gen++
+	select {
+	case <-r.c:
+	default:
+	}
+}
@@ -0,0 +1,157 @@
+package input
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Clock whose time only moves when told to.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Duration
+	f       func()
+	stopped bool
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTimer{clock: c, at: c.now + d, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+// Advance the clock, firing any timers which come due, in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now + d
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at < c.timers[j].at })
+		if len(c.timers) == 0 || c.timers[0].at > end {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.stopped {
+			continue
+		}
+		t.stopped = true
+		c.now = t.at
+		c.lock.Unlock()
+		t.f()
+		c.lock.Lock()
+	}
+	c.now = end
+	c.lock.Unlock()
+}
+
+func expectRepeat(t *testing.T, r *KeyRepeater, key uint32, count int, at time.Duration) {
+	t.Helper()
+	select {
+	case ev := <-r.C():
+		if ev.Key.Key != key || ev.Count != count || ev.Time != at || !ev.Pressed {
+			t.Fatalf("Got repeat %+v, expected key %d, count %d at %v", ev, key, count, at)
+		}
+	default:
+		t.Fatalf("No repeat; expected key %d, count %d", key, count)
+	}
+}
+
+func expectNoRepeat(t *testing.T, r *KeyRepeater) {
+	t.Helper()
+	select {
+	case ev := <-r.C():
+		t.Fatalf("Unexpected repeat: %+v", ev)
+	default:
+	}
+}
+
+func keyEvent(key uint32, pressed bool, ms int) Key {
+	return Key{
+		EventInfo: EventInfo{Time: time.Duration(ms) * time.Millisecond},
+		Key:       key,
+		Pressed:   pressed,
+	}
+}
+
+func TestKeyRepeater(t *testing.T) {
+	clock := &fakeClock{}
+	r := NewKeyRepeater(clock)
+	ms := time.Millisecond
+
+	// Before repeat_info, the defaults apply:
+	r.Handle(keyEvent(30, true, 1000))
+	clock.Advance(DefaultRepeatDelay - ms)
+	expectNoRepeat(t, r)
+	clock.Advance(ms)
+	expectRepeat(t, r, 30, 1, 1000*ms+DefaultRepeatDelay)
+	r.Handle(keyEvent(30, false, 1700))
+
+	r.Handle(RepeatInfo{Rate: 10, Delay: 200 * ms})
+	r.Handle(keyEvent(31, true, 2000))
+	clock.Advance(200 * ms)
+	expectRepeat(t, r, 31, 1, 2200*ms)
+	clock.Advance(100 * ms)
+	expectRepeat(t, r, 31, 2, 2300*ms)
+
+	// Releasing some other key doesn't matter, but pressing one takes
+	// over:
+	r.Handle(keyEvent(30, false, 2350))
+	clock.Advance(100 * ms)
+	expectRepeat(t, r, 31, 3, 2400*ms)
+	r.Handle(keyEvent(32, true, 2450))
+	clock.Advance(100 * ms)
+	expectNoRepeat(t, r)
+	clock.Advance(100 * ms)
+	expectRepeat(t, r, 32, 1, 2650*ms)
+
+	// If the receiver falls behind, repeats are dropped:
+	clock.Advance(time.Second)
+	expectRepeat(t, r, 32, 2, 2750*ms)
+	expectNoRepeat(t, r)
+
+	// Releasing the key stops it, and discards any pending repeat:
+	clock.Advance(100 * ms)
+	r.Handle(keyEvent(32, false, 3700))
+	expectNoRepeat(t, r)
+	clock.Advance(time.Second)
+	expectNoRepeat(t, r)
+
+	// As does losing focus:
+	r.Handle(keyEvent(33, true, 5000))
+	clock.Advance(100 * ms)
+	r.Handle(KeyboardLeave{})
+	clock.Advance(time.Second)
+	expectNoRepeat(t, r)
+
+	// A rate of 0 disables repeat:
+	r.Handle(keyEvent(34, true, 6000))
+	r.Handle(RepeatInfo{Rate: 0, Delay: 200 * ms})
+	r.Handle(keyEvent(35, true, 6100))
+	clock.Advance(time.Second)
+	expectNoRepeat(t, r)
+
+	r.Handle(RepeatInfo{Rate: 10, Delay: 200 * ms})
+	r.Handle(keyEvent(36, true, 7000))
+	r.Close()
+	clock.Advance(time.Second)
+	if _, ok := <-r.C(); ok {
+		t.Fatal("Channel not closed")
+	}
+}
@@ -0,0 +1,434 @@
+// Package input turns the events of wayland seats and their devices into a
+// single stream of typed events.
+//
+// A wl_seat advertises which kinds of devices (pointer, keyboard, touch) it
+// has, and the client must create and destroy a proxy for each as they come
+// and go. A Seat does this automatically, and passes the events from all of
+// its devices to a single handler, in the order they arrive.
+package input
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"zenhack.net/go/wayland"
+)
+
+// A Seat manages the devices of a wl_seat, and delivers their events to a
+// handler.
+//
+// Events are delivered from whichever goroutine dispatches the seat's event
+// queue; the devices are assigned to the same queue as the seat.
+type Seat struct {
+	seat    *wayland.Seat
+	handler func(Event)
+
+	removeListeners []func()
+
+	// Guards the fields below, which are only modified from the
+	// dispatching goroutine, but may be read by the accessors below from
+	// any goroutine.
+	lock     sync.Mutex
+	pointer  *wayland.Pointer
+	keyboard *wayland.Keyboard
+	touch    *wayland.Touch
+	closed   bool
+
+	// Only accessed from the dispatching goroutine:
+	pointerFocus  *wayland.Surface
+	pointerSerial uint32
+
+	keyboardFocus  *wayland.Surface
+	keyboardSerial uint32
+
+	touchFocus  map[int32]*wayland.Surface
+	touchSerial uint32
+}
+
+// Start managing the devices of seat, delivering their events to handler.
+// As with other event handlers, NewSeat should be called before anything
+// dispatches the seat's queue, or from the goroutine which does.
+func NewSeat(seat *wayland.Seat, handler func(Event)) *Seat {
+	s := &Seat{
+		seat:       seat,
+		handler:    handler,
+		touchFocus: make(map[int32]*wayland.Surface),
+	}
+	s.removeListeners = []func(){
+		seat.AddCapabilitiesListener(s.capabilities),
+	}
+	return s
+}
+
+// Return the underlying wl_seat.
+func (s *Seat) Proxy() *wayland.Seat {
+	return s.seat
+}
+
+// Return the seat's pointer, or nil if it doesn't have one.
+func (s *Seat) Pointer() *wayland.Pointer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pointer
+}
+
+// Return the seat's keyboard, or nil if it doesn't have one.
+func (s *Seat) Keyboard() *wayland.Keyboard {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.keyboard
+}
+
+// Return the seat's touch device, or nil if it doesn't have one.
+func (s *Seat) Touch() *wayland.Touch {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.touch
+}
+
+// Stop delivering events, and release the seat's devices. The seat itself is
+// not released; that is up to whoever bound it.
+func (s *Seat) Close() error {
+	for _, remove := range s.removeListeners {
+		remove()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	var errs []error
+	if s.pointer != nil {
+		errs = append(errs, releasePointer(s.pointer))
+		s.pointer = nil
+	}
+	if s.keyboard != nil {
+		errs = append(errs, releaseKeyboard(s.keyboard))
+		s.keyboard = nil
+	}
+	if s.touch != nil {
+		errs = append(errs, releaseTouch(s.touch))
+		s.touch = nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handle wl_seat.capabilities, creating and destroying devices as needed.
+func (s *Seat) capabilities(caps uint32) {
+	s.lock.Lock()
+	pointer, keyboard, touch := s.pointer, s.keyboard, s.touch
+	s.lock.Unlock()
+
+	hasPointer := caps&wayland.SeatCapabilityPointer != 0
+	if hasPointer && pointer == nil {
+		if p, err := s.seat.GetPointer(); err == nil {
+			s.watchPointer(p)
+			pointer = p
+		}
+	} else if !hasPointer && pointer != nil {
+		// Drop the pointer before ending its focus: a v5 pointer won't
+		// send a frame event after our synthetic leave, and handlers
+		// (such as PointerFrameAccumulator) need to know not to wait
+		// for one.
+		s.lock.Lock()
+		s.pointer = nil
+		s.lock.Unlock()
+		if s.pointerFocus != nil {
+			s.emit(PointerLeave{s.info(s.pointerFocus, s.pointerSerial, 0)})
+			s.pointerFocus = nil
+		}
+		releasePointer(pointer)
+		pointer = nil
+	}
+
+	hasKeyboard := caps&wayland.SeatCapabilityKeyboard != 0
+	if hasKeyboard && keyboard == nil {
+		if k, err := s.seat.GetKeyboard(); err == nil {
+			s.watchKeyboard(k)
+			keyboard = k
+		}
+	} else if !hasKeyboard && keyboard != nil {
+		if s.keyboardFocus != nil {
+			s.emit(KeyboardLeave{s.info(s.keyboardFocus, s.keyboardSerial, 0)})
+			s.keyboardFocus = nil
+		}
+		releaseKeyboard(keyboard)
+		keyboard = nil
+	}
+
+	hasTouch := caps&wayland.SeatCapabilityTouch != 0
+	if hasTouch && touch == nil {
+		if t, err := s.seat.GetTouch(); err == nil {
+			s.watchTouch(t)
+			touch = t
+		}
+	} else if !hasTouch && touch != nil {
+		if len(s.touchFocus) > 0 {
+			s.emit(TouchCancel{s.info(nil, s.touchSerial, 0)})
+			s.touchFocus = make(map[int32]*wayland.Surface)
+		}
+		releaseTouch(touch)
+		touch = nil
+	}
+
+	s.lock.Lock()
+	s.pointer, s.keyboard, s.touch = pointer, keyboard, touch
+	s.lock.Unlock()
+}
+
+// Deliver ev to the handler, unless the Seat has been closed. (Devices can't
+// be destroyed before version 3, so they may still send events.)
+func (s *Seat) emit(ev Event) {
+	s.lock.Lock()
+	closed := s.closed
+	s.lock.Unlock()
+	if closed {
+		if km, ok := ev.(Keymap); ok {
+			unix.Close(km.Fd)
+		}
+		return
+	}
+	s.handler(ev)
+}
+
+func (s *Seat) info(surface *wayland.Surface, serial uint32, time uint32) EventInfo {
+	return EventInfo{
+		Seat:    s,
+		Surface: surface,
+		Serial:  serial,
+		Time:    msec(time),
+	}
+}
+
+func (s *Seat) watchPointer(p *wayland.Pointer) {
+	p.AddEnterListener(func(serial uint32, surface *wayland.Surface, x, y wayland.Fixed) {
+		s.pointerFocus, s.pointerSerial = surface, serial
+		s.emit(PointerEnter{
+			EventInfo: s.info(surface, serial, 0),
+			X:         x.Float64(),
+			Y:         y.Float64(),
+		})
+	})
+	p.AddLeaveListener(func(serial uint32, surface *wayland.Surface) {
+		s.pointerFocus, s.pointerSerial = nil, serial
+		s.emit(PointerLeave{s.info(surface, serial, 0)})
+	})
+	p.AddMotionListener(func(time uint32, x, y wayland.Fixed) {
+		s.emit(PointerMotion{
+			EventInfo: s.info(s.pointerFocus, s.pointerSerial, time),
+			X:         x.Float64(),
+			Y:         y.Float64(),
+		})
+	})
+	p.AddButtonListener(func(serial, time, button, state uint32) {
+		s.pointerSerial = serial
+		s.emit(PointerButton{
+			EventInfo: s.info(s.pointerFocus, serial, time),
+			Button:    button,
+			Pressed:   state == wayland.PointerButtonStatePressed,
+		})
+	})
+	p.AddAxisListener(func(time, axis uint32, value wayland.Fixed) {
+		s.emit(PointerAxis{
+			EventInfo: s.info(s.pointerFocus, s.pointerSerial, time),
+			Axis:      axis,
+			Value:     value.Float64(),
+		})
+	})
+	p.AddFrameListener(func() {
+		s.emit(PointerFrame{s.info(s.pointerFocus, s.pointerSerial, 0)})
+	})
+	p.AddAxisSourceListener(func(source uint32) {
+		s.emit(PointerAxisSource{
+			EventInfo: s.info(s.pointerFocus, s.pointerSerial, 0),
+			Source:    source,
+		})
+	})
+	p.AddAxisStopListener(func(time, axis uint32) {
+		s.emit(PointerAxisStop{
+			EventInfo: s.info(s.pointerFocus, s.pointerSerial, time),
+			Axis:      axis,
+		})
+	})
+	p.AddAxisDiscreteListener(func(axis uint32, discrete int32) {
+		s.emit(PointerAxisDiscrete{
+			EventInfo: s.info(s.pointerFocus, s.pointerSerial, 0),
+			Axis:      axis,
+			Discrete:  discrete,
+		})
+	})
+}
+
+func (s *Seat) watchKeyboard(k *wayland.Keyboard) {
+	k.AddKeymapListener(func(format uint32, fd int, size uint32) {
+		s.emit(Keymap{
+			EventInfo: s.info(s.keyboardFocus, s.keyboardSerial, 0),
+			Format:    format,
+			Fd:        fd,
+			Size:      size,
+		})
+	})
+	k.AddEnterListener(func(serial uint32, surface *wayland.Surface, keys []byte) {
+		s.keyboardFocus, s.keyboardSerial = surface, serial
+		s.emit(KeyboardEnter{
+			EventInfo: s.info(surface, serial, 0),
+			Keys:      decodeKeys(keys),
+		})
+	})
+	k.AddLeaveListener(func(serial uint32, surface *wayland.Surface) {
+		s.keyboardFocus, s.keyboardSerial = nil, serial
+		s.emit(KeyboardLeave{s.info(surface, serial, 0)})
+	})
+	k.AddKeyListener(func(serial, time, key, state uint32) {
+		s.keyboardSerial = serial
+		s.emit(Key{
+			EventInfo: s.info(s.keyboardFocus, serial, time),
+			Key:       key,
+			Pressed:   state == wayland.KeyboardKeyStatePressed,
+		})
+	})
+	k.AddModifiersListener(func(serial, depressed, latched, locked, group uint32) {
+		s.keyboardSerial = serial
+		s.emit(Modifiers{
+			EventInfo: s.info(s.keyboardFocus, serial, 0),
+			Depressed: depressed,
+			Latched:   latched,
+			Locked:    locked,
+			Group:     group,
+		})
+	})
+	k.AddRepeatInfoListener(func(rate, delay int32) {
+		s.emit(RepeatInfo{
+			EventInfo: s.info(s.keyboardFocus, s.keyboardSerial, 0),
+			Rate:      rate,
+			Delay:     msec(uint32(delay)),
+		})
+	})
+}
+
+func (s *Seat) watchTouch(t *wayland.Touch) {
+	t.AddDownListener(func(serial, time uint32, surface *wayland.Surface, id int32, x, y wayland.Fixed) {
+		s.touchFocus[id] = surface
+		s.touchSerial = serial
+		s.emit(TouchDown{
+			EventInfo: s.info(surface, serial, time),
+			ID:        id,
+			X:         x.Float64(),
+			Y:         y.Float64(),
+		})
+	})
+	t.AddUpListener(func(serial, time uint32, id int32) {
+		surface := s.touchFocus[id]
+		delete(s.touchFocus, id)
+		s.touchSerial = serial
+		s.emit(TouchUp{
+			EventInfo: s.info(surface, serial, time),
+			ID:        id,
+		})
+	})
+	t.AddMotionListener(func(time uint32, id int32, x, y wayland.Fixed) {
+		s.emit(TouchMotion{
+			EventInfo: s.info(s.touchFocus[id], s.touchSerial, time),
+			ID:        id,
+			X:         x.Float64(),
+			Y:         y.Float64(),
+		})
+	})
+	t.AddFrameListener(func() {
+		s.emit(TouchFrame{s.info(nil, s.touchSerial, 0)})
+	})
+	t.AddCancelListener(func() {
+		s.touchFocus = make(map[int32]*wayland.Surface)
+		s.emit(TouchCancel{s.info(nil, s.touchSerial, 0)})
+	})
+}
+
+// Decode the keys argument of wl_keyboard.enter, an array of uint32s.
+func decodeKeys(buf []byte) []uint32 {
+	keys := make([]uint32, len(buf)/4)
+	for i := range keys {
+		keys[i] = binary.NativeEndian.Uint32(buf[4*i:])
+	}
+	return keys
+}
+
+// The release requests for devices were only added in version 3; before that
+// there is no way to destroy them.
+
+func releasePointer(p *wayland.Pointer) error {
+	if p.Version() < 3 {
+		return nil
+	}
+	return p.Release()
+}
+
+func releaseKeyboard(k *wayland.Keyboard) error {
+	if k.Version() < 3 {
+		return nil
+	}
+	return k.Release()
+}
+
+func releaseTouch(t *wayland.Touch) error {
+	if t.Version() < 3 {
+		return nil
+	}
+	return t.Release()
+}
+
+// Bind every seat the server advertises, now or later, and deliver the events
+// of their devices to handler. Returns a function which stops doing so, and
+// releases the seats.
+//
+// Like wayland.Globals.OnAdd, Watch must not be called from within a Globals
+// callback.
+func Watch(c *wayland.Client, handler func(Event)) (stop func()) {
+	var (
+		lock  sync.Mutex
+		seats = make(map[uint32]*Seat)
+	)
+	closeSeat := func(s *Seat) {
+		s.Close()
+		if s.seat.Version() >= 5 {
+			s.seat.Release()
+		}
+	}
+	globals := c.Globals()
+	cancelAdd := globals.OnAdd(func(g wayland.Global) {
+		if g.Interface != "wl_seat" {
+			return
+		}
+		obj, err := globals.BindGlobal(g.Name, 0)
+		if err != nil {
+			return
+		}
+		s := NewSeat(obj.(*wayland.Seat), handler)
+		lock.Lock()
+		defer lock.Unlock()
+		seats[g.Name] = s
+	})
+	cancelRemove := globals.OnRemove(func(g wayland.Global) {
+		lock.Lock()
+		s, ok := seats[g.Name]
+		delete(seats, g.Name)
+		lock.Unlock()
+		if ok {
+			closeSeat(s)
+		}
+	})
+	return func() {
+		cancelAdd()
+		cancelRemove()
+		lock.Lock()
+		defer lock.Unlock()
+		for name, s := range seats {
+			closeSeat(s)
+			delete(seats, name)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package input
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/internal/wltest"
+)
+
+// A server which records the requests it receives.
+type recorder struct {
+	lock     sync.Mutex
+	requests []wltest.Request
+}
+
+func (r *recorder) handle(req wltest.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests = append(r.requests, req)
+}
+
+// Return the first recorded request with the given sender and opcode.
+func (r *recorder) find(t *testing.T, sender wayland.ObjectId, opcode uint16) wltest.Request {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, req := range r.requests {
+		if req.Sender == sender && req.Opcode == opcode {
+			return req
+		}
+	}
+	t.Fatalf("No request with opcode %d on object %d", opcode, sender)
+	return wltest.Request{}
+}
+
+func TestSeat(t *testing.T) {
+	client, server := wltest.NewClient(t)
+	rec := &recorder{}
+	server.Serve(rec.handle)
+	ctx := context.Background()
+	roundtrip := func() {
+		t.Helper()
+		if err := client.Roundtrip(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Requests made by event handlers are sent after the sync request, so
+	// it takes a second round trip to be sure the server has seen them.
+	roundtrip2 := func() {
+		t.Helper()
+		roundtrip()
+		roundtrip()
+	}
+
+	var events []Event
+	stop := Watch(client, func(ev Event) {
+		events = append(events, ev)
+	})
+	defer stop()
+	server.Advertise(1, "wl_seat", 6)
+	server.Advertise(2, "wl_compositor", 4)
+	roundtrip2()
+	seatId := wayland.ObjectId(rec.find(t, wltest.RegistryId, 0).Arg(5))
+
+	obj, err := client.Globals().BindGlobal(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	surface, err := obj.(*wayland.Compositor).CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.SendEvent(seatId, 0, uint32(wayland.SeatCapabilityPointer|wayland.SeatCapabilityKeyboard))
+	roundtrip2()
+	pointerId := wayland.ObjectId(rec.find(t, seatId, 0).Arg(0))
+	keyboardId := wayland.ObjectId(rec.find(t, seatId, 1).Arg(0))
+
+	keys := make([]byte, 4)
+	binary.NativeEndian.PutUint32(keys, 30)
+	server.SendEvent(pointerId, 0, uint32(10), surface.Id(), 1.5, 2.5)
+	server.SendEvent(pointerId, 2, uint32(100), 3.0, 4.0)
+	server.SendEvent(pointerId, 3, uint32(11), uint32(200), uint32(0x110), uint32(wayland.PointerButtonStatePressed))
+	server.SendEvent(pointerId, 5)
+	server.SendEvent(keyboardId, 1, uint32(12), surface.Id(), keys)
+	server.SendEvent(keyboardId, 3, uint32(13), uint32(300), uint32(31), uint32(wayland.KeyboardKeyStatePressed))
+	server.SendEvent(keyboardId, 4, uint32(14), uint32(1), uint32(0), uint32(2), uint32(0))
+	roundtrip()
+
+	s := events[0].Info().Seat
+	if s.Pointer() == nil || s.Keyboard() == nil || s.Touch() != nil {
+		t.Fatal("Wrong set of devices")
+	}
+	info := func(serial uint32, ms int) EventInfo {
+		return EventInfo{
+			Seat:    s,
+			Surface: surface,
+			Serial:  serial,
+			Time:    time.Duration(ms) * time.Millisecond,
+		}
+	}
+	want := []Event{
+		PointerEnter{info(10, 0), 1.5, 2.5},
+		PointerMotion{info(10, 100), 3, 4},
+		PointerButton{info(11, 200), 0x110, true},
+		PointerFrame{info(11, 0)},
+		KeyboardEnter{info(12, 0), []uint32{30}},
+		Key{info(13, 300), 31, true},
+		Modifiers{info(14, 0), 1, 0, 2, 0},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("Got events:\n%+v\nexpected:\n%+v", events, want)
+	}
+
+	// Losing the devices should end their focus, and release them:
+	events = nil
+	server.SendEvent(seatId, 0, uint32(0))
+	roundtrip()
+	want = []Event{
+		PointerLeave{info(11, 0)},
+		KeyboardLeave{info(14, 0)},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("Got events:\n%+v\nexpected:\n%+v", events, want)
+	}
+	if s.Pointer() != nil || s.Keyboard() != nil {
+		t.Fatal("Devices not removed")
+	}
+	roundtrip()
+	rec.find(t, pointerId, 1)
+	rec.find(t, keyboardId, 0)
+}
@@ -1,6 +1,109 @@
 package wayland
 
-type interfaceIdent struct {
-	Name    string
-	Version uint32
+import (
+	"fmt"
+)
+
+// Static information about an interface, generated from the protocol
+// description. interfaceRegistry maps interface names to these.
+type interfaceInfo struct {
+	name     string
+	version  uint32
+	requests []messageInfo
+	events   []messageInfo
+
+	// Create a proxy for an object implementing the interface.
+	new func(c *Client, id ObjectId) remoteProxy
+}
+
+// Information about a request or event.
+type messageInfo struct {
+	name string
+	args []argInfo
+}
+
+type argInfo struct {
+	name string
+
+	// The type as named in the protocol description, e.g. "uint" or
+	// "new_id".
+	type_ string
+
+	// For object and new_id arguments, the name of the interface, if the
+	// protocol specifies one.
+	interface_ string
+}
+
+// Register proxies for any new_id arguments in buf, the body of sender's
+// event with the given opcode; info is sender's interface. The server
+// allocates these ids, and may refer to the new objects in later messages,
+// before the message creating them has been dispatched; so this must be done
+// as messages are read, rather than when they are dispatched. Objects created
+// by events for zombies are registered as zombies themselves. c.lock must be
+// held.
+func (c *Client) registerNewObjects(sender remoteProxy, info *interfaceInfo, opcode uint16, buf []byte) error {
+	msg := &info.events[opcode]
+	offset := 0
+	for _, arg := range msg.args {
+		switch arg.type_ {
+		case "fd":
+		case "string", "array":
+			size, err := readU32(&offset, buf)
+			if err != nil {
+				return err
+			}
+			offset += ceil32(int(size))
+		case "new_id":
+			id, err := read_new_id(&offset, buf)
+			if err != nil {
+				return err
+			}
+			newInfo, ok := interfaceRegistry[arg.interface_]
+			if !ok {
+				return fmt.Errorf("Can't create object %d for %s.%s: "+
+					"unknown interface %q",
+					id, sender.Interface(), msg.name, arg.interface_)
+			}
+			if id < minServerId {
+				return fmt.Errorf("Server created object with "+
+					"client-side id %d", id)
+			}
+			if old, ok := c.objects[id]; ok && !isZombie(old) {
+				return fmt.Errorf("Server created object with "+
+					"id %d, which is already in use", id)
+			}
+			obj := newInfo.new(c, id)
+			obj.base().queue = sender.base().queue
+			obj.base().version = sender.Version()
+			obj.base().createdBy = origin{
+				messageKey: messageKey{info: info, opcode: opcode},
+				sender:     sender.Id(),
+				event:      true,
+			}
+			c.objects[id] = obj
+			if isZombie(sender) {
+				// Nothing will ever handle the new object's
+				// events, but the server may still send them.
+				c.destroy(obj)
+			}
+		default:
+			offset += 4
+		}
+	}
+	return nil
+}
+
+// Return the object with the given id, or nil if there is no such object (or
+// it has been destroyed).
+func (c *Client) lookupObject(id ObjectId) remoteProxy {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	obj, ok := c.objects[id]
+	if !ok {
+		return nil
+	}
+	if isZombie(obj) {
+		return nil
+	}
+	return obj
 }
@@ -0,0 +1,243 @@
+// Package capture defines a file format for recordings of wayland sessions:
+// the messages exchanged on one connection, in order, with placeholders (and
+// optionally snapshots of the contents) for the file descriptors passed along
+// with them.
+//
+// Captures are made with wayland-sniffer's -record flag, and replayed with
+// wltest's Server.Replay. They are stored as JSON lines, one Message per line.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type Direction string
+
+const (
+	Request Direction = "request" // Sent by the client.
+	Event   Direction = "event"   // Sent by the server.
+)
+
+// A recorded message.
+type Message struct {
+	// When the message was seen, relative to the start of the session.
+	Time time.Duration `json:"time"`
+
+	Direction Direction `json:"direction"`
+
+	// The whole message, header included, in the recording machine's byte
+	// order.
+	Data []byte `json:"data"`
+
+	Fds []Fd `json:"fds,omitempty"`
+}
+
+// What kind of file a file descriptor referred to.
+type FdKind string
+
+const (
+	// A regular file, most often a memfd used for shared memory, or a
+	// keymap.
+	Shm FdKind = "shm"
+
+	// The read and write ends of pipes, e.g. for transferring clipboard
+	// contents.
+	PipeReader FdKind = "pipe-read"
+	PipeWriter FdKind = "pipe-write"
+
+	// Anything else.
+	Other FdKind = "other"
+)
+
+// A recorded file descriptor.
+type Fd struct {
+	Kind FdKind `json:"kind"`
+
+	// A snapshot of the file's contents when the message was sent, if one
+	// was taken. For shm, this is the start of the file; for pipe readers,
+	// whatever was waiting to be read. Nothing is recorded for other
+	// kinds.
+	Content []byte `json:"content,omitempty"`
+}
+
+// Return a description of fd, with a snapshot of at most limit bytes of its
+// contents. This doesn't disturb the file's offset, or consume data from
+// pipes.
+func Describe(fd int, limit int) Fd {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return Fd{Kind: Other}
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		ret := Fd{Kind: Shm}
+		if limit > 0 && st.Size > 0 {
+			if int64(limit) > st.Size {
+				limit = int(st.Size)
+			}
+			buf := make([]byte, limit)
+			n, _ := unix.Pread(fd, buf, 0)
+			if n > 0 {
+				ret.Content = buf[:n]
+			}
+		}
+		return ret
+	case unix.S_IFIFO:
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+		if err == nil && flags&unix.O_ACCMODE == unix.O_WRONLY {
+			return Fd{Kind: PipeWriter}
+		}
+		return Fd{Kind: PipeReader, Content: peekPipe(fd, limit)}
+	default:
+		return Fd{Kind: Other}
+	}
+}
+
+// Return up to limit bytes of the data waiting in the pipe fd, without
+// consuming it.
+func peekPipe(fd int, limit int) []byte {
+	if limit <= 0 {
+		return nil
+	}
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return nil
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+	n, err := unix.Tee(fd, p[1], limit, unix.SPLICE_F_NONBLOCK)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	buf := make([]byte, n)
+	m, _ := unix.Read(p[0], buf)
+	if m <= 0 {
+		return nil
+	}
+	return buf[:m]
+}
+
+// Create a file descriptor standing in for a recorded one: a memfd holding
+// the snapshot for Shm, the appropriate end of a pipe for pipes, and
+// /dev/null otherwise. For PipeReaders, the snapshot is written to the pipe;
+// data written to PipeWriters is discarded.
+func (f Fd) Open() (int, error) {
+	switch f.Kind {
+	case Shm:
+		fd, err := unix.MemfdCreate("capture", unix.MFD_CLOEXEC)
+		if err != nil {
+			return -1, err
+		}
+		if _, err := unix.Pwrite(fd, f.Content, 0); err != nil && len(f.Content) > 0 {
+			unix.Close(fd)
+			return -1, err
+		}
+		return fd, nil
+	case PipeReader, PipeWriter:
+		var p [2]int
+		if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+			return -1, err
+		}
+		r, w := os.NewFile(uintptr(p[0]), "pipe"), os.NewFile(uintptr(p[1]), "pipe")
+		if f.Kind == PipeWriter {
+			go func() {
+				io.Copy(io.Discard, r)
+				r.Close()
+			}()
+			return dupClose(w)
+		}
+		go func() {
+			w.Write(f.Content)
+			w.Close()
+		}()
+		return dupClose(r)
+	default:
+		return unix.Open("/dev/null", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	}
+}
+
+// Return a duplicate of f's file descriptor, and close f.
+func dupClose(f *os.File) (int, error) {
+	defer f.Close()
+	return unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+}
+
+// Writes a capture. Safe for use by multiple goroutines.
+type Writer struct {
+	lock  sync.Mutex
+	w     *bufio.Writer
+	enc   *json.Encoder
+	start time.Time
+}
+
+// Return a Writer which writes to w. Message times are relative to when the
+// Writer is created.
+func NewWriter(w io.Writer) *Writer {
+	bw := bufio.NewWriter(w)
+	return &Writer{w: bw, enc: json.NewEncoder(bw), start: time.Now()}
+}
+
+// Record a message, seen at time t, along with descriptions of its fds.
+func (w *Writer) Write(t time.Time, dir Direction, data []byte, fds []Fd) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.enc.Encode(Message{
+		Time:      t.Sub(w.start),
+		Direction: dir,
+		Data:      data,
+		Fds:       fds,
+	})
+}
+
+// Write any buffered messages to the underlying io.Writer.
+func (w *Writer) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.w.Flush()
+}
+
+// Read a capture.
+func Read(r io.Reader) ([]Message, error) {
+	var ret []Message
+	dec := json.NewDecoder(r)
+	for {
+		var msg Message
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", len(ret), err)
+		}
+		if msg.Direction != Request && msg.Direction != Event {
+			return nil, fmt.Errorf("message %d: bad direction %q", len(ret), msg.Direction)
+		}
+		if len(msg.Data) < 8 {
+			return nil, fmt.Errorf("message %d: too short (%d bytes)", len(ret), len(msg.Data))
+		}
+		ret = append(ret, msg)
+	}
+}
+
+// Read a capture from a file.
+func Load(path string) ([]Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,107 @@
+package capture
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDescribe(t *testing.T) {
+	memfd, err := unix.MemfdCreate("test", unix.MFD_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(memfd)
+	if _, err := unix.Write(memfd, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := Describe(memfd, 3); !reflect.DeepEqual(got, Fd{Kind: Shm, Content: []byte("hel")}) {
+		t.Errorf("Got %+v for a memfd", got)
+	}
+	if got := Describe(memfd, 0); !reflect.DeepEqual(got, Fd{Kind: Shm}) {
+		t.Errorf("Got %+v for a memfd, without a snapshot", got)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if got := Describe(int(r.Fd()), 10); !reflect.DeepEqual(got, Fd{Kind: PipeReader, Content: []byte("abc")}) {
+		t.Errorf("Got %+v for a pipe", got)
+	}
+	if got := Describe(int(w.Fd()), 10); got.Kind != PipeWriter {
+		t.Errorf("Got %+v for the write end of a pipe", got)
+	}
+	// Taking the snapshot shouldn't have consumed the data:
+	var buf [10]byte
+	if n, err := r.Read(buf[:]); err != nil || string(buf[:n]) != "abc" {
+		t.Errorf("Read %q, %v from the pipe", buf[:n], err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	fd, err := Fd{Kind: Shm, Content: []byte("keymap")}.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Describe(fd, 100); string(got.Content) != "keymap" {
+		t.Errorf("Got %+v for a stand-in shm file", got)
+	}
+	unix.Close(fd)
+
+	fd, err = Fd{Kind: PipeReader, Content: []byte("clipboard")}.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fd), "pipe")
+	defer f.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(f); err != nil || buf.String() != "clipboard" {
+		t.Errorf("Read %q, %v from a stand-in pipe", buf.String(), err)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	start := time.Now()
+	msgs := []Message{
+		{Direction: Request, Data: []byte{1, 0, 0, 0, 1, 0, 12, 0, 2, 0, 0, 0}},
+		{
+			Direction: Event,
+			Data:      []byte{5, 0, 0, 0, 0, 0, 8, 0},
+			Fds:       []Fd{{Kind: Shm, Content: []byte{1, 2}}, {Kind: Other}},
+		},
+	}
+	for _, msg := range msgs {
+		if err := w.Write(start, msg.Direction, msg.Data, msg.Fds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		got[i].Time = 0
+	}
+	if !reflect.DeepEqual(got, msgs) {
+		t.Errorf("Got %+v, expected %+v", got, msgs)
+	}
+
+	if _, err := Read(bytes.NewBufferString(`{"direction":"sideways","data":"AQAAAAEADAACAAAA"}`)); err == nil {
+		t.Error("Read accepted a bad direction")
+	}
+}
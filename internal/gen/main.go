@@ -93,8 +93,19 @@ type Interface struct {
 	Enums       []Enum    `xml:"enum"`
 }
 
+// Report whether the interface defines an enum named "error".
+func (i Interface) HasErrorEnum() bool {
+	for _, enum := range i.Enums {
+		if enum.Name == "error" {
+			return true
+		}
+	}
+	return false
+}
+
 type Request struct {
 	Name        WlName `xml:"name,attr"`
+	Type        string `xml:"type,attr"`
 	Description Doc    `xml:"description"`
 	Args        Args   `xml:"arg"`
 }
@@ -110,6 +121,17 @@ type Arg struct {
 	Type      WlType `xml:"type,attr"`
 	Summary   string `xml:"summary,attr"`
 	Interface WlName `xml:"interface,attr"`
+	AllowNull bool   `xml:"allow-null,attr"`
+}
+
+// Return the suffix of the write_* and sizeOf_* functions for the argument.
+// Nullable strings are marshalled differently from other strings, so that
+// "" can be sent as null.
+func (a *Arg) Marshaler() string {
+	if a.Type == "string" && a.AllowNull {
+		return "nullable_string"
+	}
+	return string(a.Type)
 }
 
 func (a *Arg) GoType() string {
@@ -0,0 +1,157 @@
+package wltest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/internal/capture"
+)
+
+// Returned by Replay when the client's requests don't match the capture.
+type MismatchError struct {
+	// The index of the message in the capture.
+	Index int
+
+	// The message expected, and the request which was received instead.
+	// Got is nil if the client closed the connection.
+	Want capture.Message
+	Got  *Request
+
+	// What was wrong.
+	Reason string
+}
+
+func (e *MismatchError) Error() string {
+	want := describe(e.Want.Data)
+	if e.Got == nil {
+		return fmt.Sprintf("message %d: expected %s, but the client hung up", e.Index, want)
+	}
+	return fmt.Sprintf("message %d: expected %s, but got object %d opcode %d (%d bytes): %s",
+		e.Index, want, e.Got.Sender, e.Got.Opcode, 8+len(e.Got.Body), e.Reason)
+}
+
+// Describe the message whose whole data (header included) is data.
+func describe(data []byte) string {
+	return fmt.Sprintf("object %d opcode %d (%d bytes)",
+		hostEndian.Uint32(data[0:4]), uint16(hostEndian.Uint32(data[4:8])), len(data))
+}
+
+// Play the server's side of a captured session: send the client the events
+// in messages, in order, and check that the requests it sends in between
+// match those in messages. Each event is sent once all the requests before it
+// have been received, and file descriptors are replaced by stand-ins (see
+// capture.Fd.Open). Timings are ignored.
+//
+// Requests must match byte for byte, and must be accompanied by the same
+// number and kinds of file descriptors; for fds whose contents were
+// snapshotted, the start of the file must match the snapshot too.
+//
+// Returns nil once every message has been played, a *MismatchError if the
+// client deviates from the capture, or ctx.Err() if ctx is canceled (in which
+// case the connection is closed). Replay must not be used at the same time
+// as Serve or ReadRequest.
+func (s *Server) Replay(ctx context.Context, messages []capture.Message) error {
+	stop := context.AfterFunc(ctx, func() {
+		s.transport.Close()
+	})
+	defer stop()
+
+	// Fds which have been received, but not yet matched with requests.
+	// ReadRequest attributes every fd it has received to the first request
+	// to be read, so we match them up here instead.
+	var fds []int
+	defer func() {
+		closeAll(fds)
+	}()
+	for i, msg := range messages {
+		if msg.Direction == capture.Event {
+			if err := s.sendRecorded(msg); err != nil {
+				return fmt.Errorf("message %d: %w", i, err)
+			}
+			continue
+		}
+		req, err := s.ReadRequest()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return &MismatchError{Index: i, Want: msg}
+		}
+		fds = append(fds, req.Fds...)
+		req.Fds = nil
+		mismatch := func(format string, args ...interface{}) error {
+			return &MismatchError{
+				Index:  i,
+				Want:   msg,
+				Got:    &req,
+				Reason: fmt.Sprintf(format, args...),
+			}
+		}
+		var hdr [8]byte
+		hostEndian.PutUint32(hdr[0:4], uint32(req.Sender))
+		hostEndian.PutUint32(hdr[4:8], uint32(8+len(req.Body))<<16|uint32(req.Opcode))
+		if !bytes.Equal(hdr[:], msg.Data[:8]) {
+			return mismatch("wrong header")
+		}
+		if !bytes.Equal(req.Body, msg.Data[8:]) {
+			return mismatch("body differs: expected %x, got %x", msg.Data[8:], req.Body)
+		}
+		if len(fds) < len(msg.Fds) {
+			return mismatch("expected %d fds, got %d", len(msg.Fds), len(fds))
+		}
+		for j, want := range msg.Fds {
+			got := capture.Describe(fds[j], len(want.Content))
+			if got.Kind != want.Kind {
+				return mismatch("fd %d is a %s, expected a %s", j, got.Kind, want.Kind)
+			}
+			if want.Content != nil && !bytes.Equal(got.Content, want.Content) {
+				return mismatch("contents of fd %d differ", j)
+			}
+		}
+		closeAll(fds[:len(msg.Fds)])
+		fds = fds[len(msg.Fds):]
+	}
+	return nil
+}
+
+// Send a recorded event to the client, with stand-ins for its fds.
+func (s *Server) sendRecorded(msg capture.Message) error {
+	var fds []int
+	defer func() {
+		closeAll(fds)
+	}()
+	for _, f := range msg.Fds {
+		fd, err := f.Open()
+		if err != nil {
+			return err
+		}
+		fds = append(fds, fd)
+	}
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	return s.transport.Send(msg.Data, fds)
+}
+
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+// Return a new client, and play the server's side of the captured session to
+// it in the background, as with Server.Replay. The returned channel receives
+// Replay's result.
+func NewReplayClient(t *testing.T, messages []capture.Message) (*wayland.Client, <-chan error) {
+	client, server := NewClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Replay(ctx, messages)
+	}()
+	return client, done
+}
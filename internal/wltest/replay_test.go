@@ -0,0 +1,48 @@
+package wltest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/internal/capture"
+)
+
+func message(t *testing.T, dir capture.Direction, sender wayland.ObjectId, opcode uint16, args ...interface{}) capture.Message {
+	data, _, err := Marshal(sender, opcode, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return capture.Message{Direction: dir, Data: data}
+}
+
+func TestReplay(t *testing.T) {
+	messages := []capture.Message{
+		message(t, capture.Request, 1, 1, uint32(RegistryId)),
+		message(t, capture.Event, RegistryId, 0, uint32(1), "wl_compositor", uint32(4)),
+		message(t, capture.Request, 1, 0, uint32(3)),
+		message(t, capture.Event, 3, 0, uint32(0)),
+		message(t, capture.Event, 1, 1, uint32(3)),
+	}
+	client, done := NewReplayClient(t, messages)
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if globals := client.Globals().List(); len(globals) != 1 || globals[0].Interface != "wl_compositor" {
+		t.Errorf("Got globals %v", globals)
+	}
+
+	// If the client does something else, Replay should say so:
+	client, done = NewReplayClient(t, messages)
+	if _, err := client.GetRegistry().Bind(1, "wl_compositor", 4); err != nil {
+		t.Fatal(err)
+	}
+	var mismatch *MismatchError
+	if err := <-done; !errors.As(err, &mismatch) || mismatch.Index != 2 || mismatch.Got.Sender != RegistryId {
+		t.Fatalf("Expected a mismatch at message 2, but got %v", err)
+	}
+}
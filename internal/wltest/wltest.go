@@ -0,0 +1,206 @@
+// Package wltest provides a minimal stand-in for a compositor, for testing
+// code built on top of the wayland package. It speaks the wire protocol
+// directly, so tests can send arbitrary events and inspect the requests the
+// client makes.
+package wltest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"zenhack.net/go/wayland"
+)
+
+var hostEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// The id of the registry created by wayland.NewClient.
+const RegistryId = wayland.ObjectId(2)
+
+// A fake server, connected to a client via wayland.Pipe.
+type Server struct {
+	t         *testing.T
+	transport wayland.Transport
+
+	// Guards sending, so that events can be sent from several goroutines.
+	sendLock sync.Mutex
+
+	inData []byte
+	inFds  []int
+}
+
+// A file descriptor argument to SendEvent.
+type Fd int
+
+// A request received from the client.
+type Request struct {
+	Sender wayland.ObjectId
+	Opcode uint16
+	Body   []byte
+
+	// File descriptors which were received along with the request. Since
+	// the server doesn't know the signatures of requests, these are
+	// whatever fds had arrived by the time the request was read.
+	Fds []int
+}
+
+// Return a new client connected to a Server. Both are closed when the test
+// finishes.
+func NewClient(t *testing.T) (*wayland.Client, *Server) {
+	clientSide, serverSide := wayland.Pipe()
+	client, err := wayland.NewClient(clientSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		serverSide.Close()
+	})
+	return client, &Server{t: t, transport: serverSide}
+}
+
+// Send an event to the client. Arguments are as for Marshal.
+func (s *Server) SendEvent(sender wayland.ObjectId, opcode uint16, args ...interface{}) {
+	msg, fds, err := Marshal(sender, opcode, args...)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	if err := s.transport.Send(msg, fds); err != nil {
+		s.t.Error(err)
+	}
+}
+
+// Marshal a message, returning its data (header included) and fds. Arguments
+// must be uint32s, int32s, ObjectIds, float64s (sent as fixed), strings,
+// []bytes (sent as arrays) or Fds.
+func Marshal(sender wayland.ObjectId, opcode uint16, args ...interface{}) ([]byte, []int, error) {
+	body := &bytes.Buffer{}
+	fds := []int{}
+	u32 := func(v uint32) {
+		var buf [4]byte
+		hostEndian.PutUint32(buf[:], v)
+		body.Write(buf[:])
+	}
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case Fd:
+			fds = append(fds, int(arg))
+		case uint32:
+			u32(arg)
+		case int32:
+			u32(uint32(arg))
+		case wayland.ObjectId:
+			u32(uint32(arg))
+		case float64:
+			u32(uint32(int32(math.Round(arg * 256))))
+		case string:
+			u32(uint32(len(arg) + 1))
+			body.WriteString(arg)
+			body.WriteByte(0)
+			pad(body)
+		case []byte:
+			u32(uint32(len(arg)))
+			body.Write(arg)
+			pad(body)
+		default:
+			return nil, nil, fmt.Errorf("wltest: unsupported argument type %T", arg)
+		}
+	}
+	msg := &bytes.Buffer{}
+	var hdr [8]byte
+	hostEndian.PutUint32(hdr[:4], uint32(sender))
+	hostEndian.PutUint32(hdr[4:], uint32(8+body.Len())<<16|uint32(opcode))
+	msg.Write(hdr[:])
+	msg.Write(body.Bytes())
+	return msg.Bytes(), fds, nil
+}
+
+func pad(buf *bytes.Buffer) {
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+// Advertise a global via the registry.
+func (s *Server) Advertise(name uint32, interface_ string, version uint32) {
+	s.SendEvent(RegistryId, 0, name, interface_, version)
+}
+
+// Announce the removal of a global.
+func (s *Server) RemoveGlobal(name uint32) {
+	s.SendEvent(RegistryId, 1, name)
+}
+
+// Read the next request from the client. Returns an error if the connection
+// has been closed.
+func (s *Server) ReadRequest() (Request, error) {
+	for len(s.inData) < 8 || len(s.inData) < int(s.peekSize()) {
+		var (
+			data [4096]byte
+			fds  [28]int
+		)
+		n, fdn, err := s.transport.Recv(data[:], fds[:])
+		s.inData = append(s.inData, data[:n]...)
+		s.inFds = append(s.inFds, fds[:fdn]...)
+		if n == 0 && err != nil {
+			return Request{}, err
+		}
+	}
+	size := s.peekSize()
+	opcodeAndSize := hostEndian.Uint32(s.inData[4:8])
+	req := Request{
+		Sender: wayland.ObjectId(hostEndian.Uint32(s.inData[:4])),
+		Opcode: uint16(opcodeAndSize),
+		Body:   append([]byte(nil), s.inData[8:size]...),
+		Fds:    s.inFds,
+	}
+	s.inData = s.inData[size:]
+	s.inFds = nil
+	return req, nil
+}
+
+func (s *Server) peekSize() uint16 {
+	return uint16(hostEndian.Uint32(s.inData[4:8]) >> 16)
+}
+
+// Return the i-th 32-bit argument of the request.
+func (r Request) Arg(i int) uint32 {
+	return hostEndian.Uint32(r.Body[4*i:])
+}
+
+// Serve requests until the connection is closed, replying to wl_display.sync
+// so that the client can make round trips. All requests other than sync are
+// passed to handle, if it is not nil; it is called from the server's
+// goroutine. Returns a channel which is closed when the server stops.
+func (s *Server) Serve(handle func(Request)) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			req, err := s.ReadRequest()
+			if err != nil {
+				return
+			}
+			if req.Sender == 1 && req.Opcode == 0 {
+				id := wayland.ObjectId(req.Arg(0))
+				s.SendEvent(id, 0, uint32(0))
+				s.SendEvent(1, 1, uint32(id))
+			} else if handle != nil {
+				handle(req)
+			}
+		}
+	}()
+	return done
+}
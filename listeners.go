@@ -0,0 +1,80 @@
+package wayland
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Per-object state which the application can attach to proxies: user data and
+// additional event listeners. The generated AddXxxListener methods are built
+// on addListener; see also the OnXxx methods, which set a single callback
+// that is invoked before any listeners.
+
+// A listener added with one of the AddXxxListener methods. cb is a function
+// with the signature appropriate for the event.
+type listener struct {
+	id uint64
+	cb interface{}
+}
+
+// Attach arbitrary data to the object, replacing any previous value.
+func (o *remoteObject) SetUserData(data interface{}) {
+	o.conn.lock.Lock()
+	defer o.conn.lock.Unlock()
+	o.userData = data
+}
+
+// Return the data most recently passed to SetUserData, or nil if there is
+// none.
+func (o *remoteObject) UserData() interface{} {
+	o.conn.lock.Lock()
+	defer o.conn.lock.Unlock()
+	return o.userData
+}
+
+// Add cb as a listener for the event with the given opcode. Returns a function
+// which removes it again. o.conn.lock must be held.
+func (o *remoteObject) addListener(opcode uint16, cb interface{}) (remove func()) {
+	if o.listeners == nil {
+		o.listeners = make(map[uint16][]listener)
+	}
+	o.nextListener++
+	id := o.nextListener
+	o.listeners[opcode] = append(o.listeners[opcode], listener{id: id, cb: cb})
+	return func() {
+		o.conn.lock.Lock()
+		defer o.conn.lock.Unlock()
+		ls := o.listeners[opcode]
+		for i := range ls {
+			if ls[i].id == id {
+				// Copy, rather than modifying in place, since
+				// handleEvent may be iterating over the old
+				// slice:
+				o.listeners[opcode] = append(ls[:i:i], ls[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Return the listeners for the event with the given opcode, in the order they
+// were added. o.conn.lock must be held.
+func (o *remoteObject) getListeners(opcode uint16) []listener {
+	return o.listeners[opcode]
+}
+
+// Duplicate each of the file descriptors, so that an event carrying them can
+// be delivered to more than one callback, each of which owns its fds. If any
+// of the calls to dup fail, the copies made so far are closed and an error is
+// returned.
+func dupAll(fds []int) ([]int, error) {
+	ret := make([]int, 0, len(fds))
+	for _, fd := range fds {
+		newFd, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			closeAll(ret)
+			return nil, err
+		}
+		ret = append(ret, newFd)
+	}
+	return ret, nil
+}
@@ -0,0 +1,93 @@
+package wayland
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Listeners should be invoked after the On callback, in the order they were
+// added, until they are removed.
+func TestListeners(t *testing.T) {
+	client, server := newTestClient(t)
+	server.serveSync()
+	output := addTestObject(client, &Output{}).(*Output)
+
+	var calls []string
+	output.OnScale(func(factor int32) {
+		calls = append(calls, "on")
+	})
+	removeA := output.AddScaleListener(func(factor int32) {
+		calls = append(calls, "a")
+	})
+	output.AddScaleListener(func(factor int32) {
+		calls = append(calls, "b")
+	})
+	output.AddDoneListener(func() {
+		calls = append(calls, "done")
+	})
+
+	server.sendEvent(output.Id(), 3, int32(2))
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	removeA()
+	server.sendEvent(output.Id(), 3, int32(2))
+	server.sendEvent(output.Id(), 2)
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"on", "a", "b", "on", "b", "done"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("Got calls %v, expected %v", calls, want)
+	}
+}
+
+// Each callback for an event carrying fds should get its own copies.
+func TestListenerFds(t *testing.T) {
+	client, server := newTestClient(t)
+	server.serveSync()
+	kbd := addTestObject(client, &Keyboard{}).(*Keyboard)
+
+	var got []int
+	keymap := func(format uint32, fd int, size uint32) {
+		got = append(got, fd)
+	}
+	kbd.OnKeymap(keymap)
+	kbd.AddKeymapListener(keymap)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	server.sendEvent(kbd.Id(), 0, uint32(KeyboardKeymapFormatXkbV1), testFd(w.Fd()), uint32(0))
+	w.Close()
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] == got[1] {
+		t.Fatalf("Expected two distinct fds, but got %v", got)
+	}
+	for _, fd := range got {
+		f := os.NewFile(uintptr(fd), "keymap")
+		if _, err := f.Write([]byte("x")); err != nil {
+			t.Fatalf("Can't write to fd %d: %v", fd, err)
+		}
+		f.Close()
+	}
+}
+
+func TestUserData(t *testing.T) {
+	client, _ := newTestClient(t)
+	surface := addTestObject(client, &Surface{}).(*Surface)
+	if surface.UserData() != nil {
+		t.Fatal("User data should initially be nil")
+	}
+	type window struct{ title string }
+	surface.SetUserData(&window{title: "hello"})
+	if w, ok := surface.UserData().(*window); !ok || w.title != "hello" {
+		t.Fatalf("Got user data %v", surface.UserData())
+	}
+}
@@ -2,6 +2,7 @@ package wayland
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 	"testing/quick"
 )
@@ -35,3 +36,125 @@ func TestHeaderMarshal(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// Test write_string and read_string against each other.
+func TestStringMarshal(t *testing.T) {
+	err := quick.Check(func(s string, next uint32) bool {
+		if strings.IndexByte(s, 0) >= 0 {
+			// Can't be represented on the wire.
+			return true
+		}
+		buf := &bytes.Buffer{}
+		n, err := write_string(buf, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(sizeOf_string(s)) {
+			t.Log("Error: wrote", n, "bytes, but sizeOf_string says", sizeOf_string(s))
+			return false
+		}
+		write_uint(buf, next)
+		offset := 0
+		newS, err := read_string(&offset, buf.Bytes())
+		if err != nil || newS != s {
+			t.Log("Error: wrote", s, "but read", newS, "with error", err)
+			return false
+		}
+		newNext, err := read_uint(&offset, buf.Bytes())
+		if err != nil || newNext != next {
+			t.Log("Error: string was not padded correctly")
+			return false
+		}
+		return true
+	}, nil)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// A null string has a size of zero, and no contents.
+func TestReadNullString(t *testing.T) {
+	buf := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	offset := 0
+	s, err := read_string(&offset, buf)
+	if err != nil || s != "" || offset != 4 {
+		t.Fatalf("Got %q, %v, with offset %d", s, err, offset)
+	}
+}
+
+// Arrays other than the first in a message should be read from their own
+// offset.
+func TestReadArray(t *testing.T) {
+	buf := &bytes.Buffer{}
+	write_uint(buf, 3)
+	buf.Write([]byte{1, 2, 3, 0})
+	write_uint(buf, 2)
+	buf.Write([]byte{4, 5, 0, 0})
+	offset := 0
+	for _, want := range [][]byte{{1, 2, 3}, {4, 5}} {
+		got, err := read_array(&offset, buf.Bytes())
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("Read %v, %v; expected %v", got, err, want)
+		}
+	}
+	if offset != buf.Len() {
+		t.Fatalf("Read up to offset %d of %d", offset, buf.Len())
+	}
+}
+
+func TestFixedConversion(t *testing.T) {
+	for _, v := range []float64{0, 1, -1, 2.5, -2.5, 1.0 / 256, 8388607} {
+		if got := FixedFromFloat64(v).Float64(); got != v {
+			t.Errorf("FixedFromFloat64(%v).Float64() = %v", v, got)
+		}
+	}
+}
+
+// Null object arguments should be written as id 0, whether they're passed as
+// nil interfaces or nil pointers.
+func TestNullObjectMarshal(t *testing.T) {
+	for _, obj := range []Object{nil, (*Surface)(nil)} {
+		buf := &bytes.Buffer{}
+		if _, err := write_object(buf, obj); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), []byte{0, 0, 0, 0}) {
+			t.Errorf("Wrote %v for %#v", buf.Bytes(), obj)
+		}
+	}
+}
+
+// An Object implemented by a value rather than a pointer.
+type valueObject struct{ id ObjectId }
+
+func (o valueObject) Id() ObjectId      { return o.id }
+func (o valueObject) Interface() string { return "test_value" }
+func (o valueObject) Version() uint32   { return 1 }
+
+// Objects which aren't pointers can't be nil, and should be written as is.
+func TestValueObjectMarshal(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if _, err := write_object(buf, valueObject{id: 7}); err != nil {
+		t.Fatal(err)
+	}
+	offset := 0
+	if id, err := read_uint(&offset, buf.Bytes()); err != nil || id != 7 {
+		t.Errorf("Wrote %v", buf.Bytes())
+	}
+}
+
+// Empty nullable strings should be written as null, i.e. with length 0.
+func TestNullStringMarshal(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if _, err := write_nullable_string(buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0, 0, 0, 0}) || sizeOf_nullable_string("") != 4 {
+		t.Errorf("Wrote %v for an empty nullable string", buf.Bytes())
+	}
+	buf.Reset()
+	write_nullable_string(buf, "ab")
+	if buf.Len() != 8 || int(sizeOf_nullable_string("ab")) != buf.Len() {
+		t.Errorf("Wrote %v for a non-empty nullable string", buf.Bytes())
+	}
+}
@@ -0,0 +1,225 @@
+package wayland
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+// Allocates client-side object ids. Ids are only reused after the server has
+// acknowledged the destruction of the object which had them, via
+// wl_display.delete_id.
+type idAllocator struct {
+	// The lowest id which has never been allocated.
+	next ObjectId
+
+	// Ids which have been released, and may be handed out again. Like
+	// libwayland, we reuse the most recently released id first.
+	free []ObjectId
+}
+
+func (a *idAllocator) alloc() ObjectId {
+	if n := len(a.free); n > 0 {
+		id := a.free[n-1]
+		a.free = a.free[:n-1]
+		return id
+	}
+	id := a.next
+	a.next++
+	return id
+}
+
+func (a *idAllocator) release(id ObjectId) {
+	a.free = append(a.free, id)
+}
+
+// A zombie stands in for an object which the client has destroyed, but
+// whose destruction the server has not yet acknowledged. The server may
+// still send events to the object in the meantime; the zombie discards them,
+// closing any file descriptors they carry, so that they don't leak or get
+// attributed to the wrong message.
+type zombie struct {
+	remoteObject
+	interface_ string
+	version    uint32
+	fdCounts   *fdCounts
+}
+
+func (z *zombie) Interface() string {
+	return z.interface_
+}
+
+func (z *zombie) Version() uint32 {
+	return z.version
+}
+
+func (z *zombie) getFdCounts() *fdCounts {
+	return z.fdCounts
+}
+
+func (z *zombie) handleEvent(opcode uint16, buf []byte, fds []int) {
+	closeAll(fds)
+}
+
+func isZombie(obj remoteProxy) bool {
+	_, ok := obj.(*zombie)
+	return ok
+}
+
+// Record that the client has destroyed obj. c.lock must be held.
+//
+// The server doesn't send delete_id for ids it allocated, so zombies for those
+// are only removed when the server reuses the id for a new object.
+func (c *Client) destroy(obj remoteProxy) {
+	id := obj.Id()
+	obj.base().destroyed = true
+	c.objects[id] = &zombie{
+		remoteObject: remoteObject{
+			id:        id,
+			conn:      c,
+			createdBy: obj.base().createdBy,
+		},
+		interface_: obj.Interface(),
+		version:    obj.Version(),
+		fdCounts:   obj.getFdCounts(),
+	}
+}
+
+// Handle a wl_display.delete_id event; the server will not refer to id again,
+// so it can be reused.
+func (c *Client) deleteId(id ObjectId) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.objects[id]; !ok || id >= minServerId {
+		// Either the server is confused, or we are; in any case we
+		// shouldn't release an id we aren't using.
+		return
+	}
+	delete(c.objects, id)
+	c.ids.release(id)
+}
+
+// The message which created an object, if any: sender's request or event
+// with the given opcode.
+type origin struct {
+	messageKey
+	sender ObjectId
+	event  bool
+}
+
+// Format the origin like "wl_compositor@3.create_surface", or as "" for
+// objects with no origin (i.e. the display).
+func (o origin) String() string {
+	if o.info == nil {
+		return ""
+	}
+	msgs := o.info.requests
+	if o.event {
+		msgs = o.info.events
+	}
+	return o.info.name + "@" + strconv.FormatUint(uint64(o.sender), 10) + "." +
+		msgs[o.opcode].name
+}
+
+// Record obj as the origin of the objects created by a request it is
+// sending. data is the whole message, header included. c.lock must be held.
+func (c *Client) recordOrigins(obj remoteProxy, opcode uint16, data []byte) {
+	info, ok := interfaceRegistry[obj.Interface()]
+	if !ok || int(opcode) >= len(info.requests) {
+		return
+	}
+	msg := &info.requests[opcode]
+	eachObjectArg(msg, data[8:], func(arg argInfo, id ObjectId, _ string) {
+		if arg.type_ != "new_id" {
+			return
+		}
+		if created, ok := c.objects[id]; ok {
+			created.base().createdBy = origin{
+				messageKey: messageKey{info: info, opcode: opcode},
+				sender:     obj.Id(),
+			}
+		}
+	})
+}
+
+// Whether an object is in use, or has been destroyed by the client but not
+// yet released by the server.
+type ObjectState int
+
+const (
+	ObjectLive ObjectState = iota
+	ObjectZombie
+)
+
+func (s ObjectState) String() string {
+	switch s {
+	case ObjectLive:
+		return "live"
+	case ObjectZombie:
+		return "zombie"
+	default:
+		return "ObjectState(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// Marshal the state as its name, so that it's readable in JSON.
+func (s ObjectState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Information about an object, as returned by Client.Objects.
+type ObjectInfo struct {
+	Id        ObjectId
+	Interface string
+	Version   uint32
+	State     ObjectState
+
+	// The message which created the object, like
+	// "wl_compositor@3.create_surface" (or, for objects created by the
+	// server, an event, like "wl_data_device@5.data_offer"). Empty for the
+	// display.
+	CreatedBy string
+}
+
+// Return a snapshot of the client's object table, sorted by id. This is
+// mainly useful for debugging; see also DumpObjects.
+func (c *Client) Objects() []ObjectInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ret := make([]ObjectInfo, 0, len(c.objects))
+	for id, obj := range c.objects {
+		info := ObjectInfo{
+			Id:        id,
+			Interface: obj.Interface(),
+			Version:   obj.Version(),
+			CreatedBy: obj.base().createdBy.String(),
+		}
+		if isZombie(obj) {
+			info.State = ObjectZombie
+		}
+		ret = append(ret, info)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret
+}
+
+// Write the client's object table to w as a table, one object per line.
+func (c *Client) DumpObjects(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tINTERFACE\tVERSION\tSTATE\tCREATED BY")
+	for _, obj := range c.Objects() {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\n",
+			obj.Id, obj.Interface, obj.Version, obj.State, obj.CreatedBy)
+	}
+	return tw.Flush()
+}
+
+// Write the client's object table to w as a JSON array of ObjectInfos.
+func (c *Client) DumpObjectsJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(c.Objects())
+}
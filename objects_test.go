@@ -0,0 +1,332 @@
+package wayland
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Ids should be reused once the server has deleted them, and not before.
+func TestIdReuse(t *testing.T) {
+	client, server := newTestClient(t)
+	server.serveSync()
+	ctx := context.Background()
+
+	// Each roundtrip allocates a callback, which the server deletes
+	// after sending done.
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	client.lock.Lock()
+	next := client.ids.next
+	client.lock.Unlock()
+	for i := 0; i < 10; i++ {
+		if err := client.Roundtrip(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.ids.next != next {
+		t.Fatalf("Ids were not reused: next id went from %d to %d",
+			next, client.ids.next)
+	}
+
+	// Ids of zombies must not be reused.
+	kbd := &Keyboard{remoteObject: remoteObject{id: client.newId(), conn: client}}
+	client.objects[kbd.id] = kbd
+	client.destroy(kbd)
+	if id := client.newId(); id == kbd.id {
+		t.Fatal("Id of a zombie object was reused")
+	}
+}
+
+// Events sent to a destroyed object before the server acknowledges its
+// destruction should be discarded, and their fds closed.
+func TestZombieEvents(t *testing.T) {
+	client, server := newTestClient(t)
+	kbd := addTestObject(client, &Keyboard{}).(*Keyboard)
+	keymapCalled := false
+	kbd.OnKeymap(func(format uint32, fd int, size uint32) {
+		keymapCalled = true
+	})
+	if err := kbd.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		// The release request:
+		server.readRequest()
+		// wl_keyboard.keymap, as if sent before the server saw the
+		// release:
+		server.sendEvent(kbd.Id(), 0, uint32(KeyboardKeymapFormatXkbV1), testFd(w.Fd()), uint32(0))
+		w.Close()
+		server.serveSync()
+	}()
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if keymapCalled {
+		t.Fatal("Event was delivered to a destroyed object")
+	}
+
+	// If the zombie closed its copy of the fd, there are no more write
+	// ends, so we should see EOF rather than timing out.
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [1]byte
+	if _, err := r.Read(buf[:]); err == nil || os.IsTimeout(err) {
+		t.Fatalf("Expected EOF, but got %v", err)
+	}
+}
+
+// Objects created by events sent to a destroyed object should be registered
+// too, so that their own events don't fail the connection.
+func TestZombieNewObjects(t *testing.T) {
+	client, server := newTestClient(t)
+	device := addTestObject(client, &DataDevice{}).(*DataDevice)
+	if err := device.Release(); err != nil {
+		t.Fatal(err)
+	}
+	offerId := ObjectId(minServerId)
+	go func() {
+		// The release request:
+		server.readRequest()
+		// wl_data_device.data_offer and wl_data_offer.offer, as if
+		// sent before the server saw the release:
+		server.sendEvent(device.Id(), 0, offerId)
+		server.sendEvent(offerId, 0, "text/plain")
+		server.serveSync()
+	}()
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client.lock.Lock()
+	offer, ok := client.objects[offerId]
+	client.lock.Unlock()
+	if !ok || !isZombie(offer) || offer.Interface() != "wl_data_offer" {
+		t.Fatalf("Expected a zombie wl_data_offer, but got %#v", offer)
+	}
+}
+
+// Objects created by the server should be registered, so that events sent to
+// them are delivered, and object arguments should resolve to the existing
+// proxies.
+func TestServerCreatedObjects(t *testing.T) {
+	client, server := newTestClient(t)
+	device := addTestObject(client, &DataDevice{}).(*DataDevice)
+	const offerId = ObjectId(minServerId)
+
+	var (
+		offer     *DataOffer
+		mimeTypes []string
+		selection []*DataOffer
+	)
+	device.OnDataOffer(func(o *DataOffer) {
+		offer = o
+		o.OnOffer(func(mimeType string) {
+			mimeTypes = append(mimeTypes, mimeType)
+		})
+	})
+	device.OnSelection(func(o *DataOffer) {
+		selection = append(selection, o)
+	})
+
+	go func() {
+		server.sendEvent(device.Id(), 0, offerId)
+		server.sendEvent(offerId, 0, "text/plain")
+		server.sendEvent(device.Id(), 5, offerId)
+		server.sendEvent(device.Id(), 5, ObjectId(0))
+		server.serveSync()
+	}()
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if offer == nil || offer.Id() != offerId {
+		t.Fatalf("Wrong offer: %v", offer)
+	}
+	if len(mimeTypes) != 1 || mimeTypes[0] != "text/plain" {
+		t.Fatalf("Wrong mime types: %v", mimeTypes)
+	}
+	if len(selection) != 2 || selection[0] != offer || selection[1] != nil {
+		t.Fatalf("Wrong selection events: %v", selection)
+	}
+
+	// After the client destroys a server-created object, the server may
+	// reuse its id without sending delete_id.
+	if err := offer.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if client.lookupObject(offerId) != nil {
+		t.Fatal("Destroyed server-created object is still live")
+	}
+	server.sendEvent(device.Id(), 0, offerId)
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if offer.Id() != offerId || client.lookupObject(offerId) != remoteProxy(offer) {
+		t.Fatal("Server could not reuse the id of a destroyed object")
+	}
+}
+
+func TestObjectsSnapshot(t *testing.T) {
+	client, server := newTestClient(t)
+	server.serveSync()
+	obj, err := client.GetRegistry().Bind(5, "wl_compositor", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	surface, err := obj.(*Compositor).CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := surface.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	device := addTestObject(client, &DataDevice{}).(*DataDevice)
+	server.sendEvent(device.Id(), 0, ObjectId(minServerId))
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ObjectInfo{
+		{Id: 1, Interface: "wl_display", Version: 1},
+		{Id: 2, Interface: "wl_registry", Version: 1, CreatedBy: "wl_display@1.get_registry"},
+		{Id: 3, Interface: "wl_compositor", Version: 4, CreatedBy: "wl_registry@2.bind"},
+		{Id: 4, Interface: "wl_surface", Version: 4, State: ObjectZombie,
+			CreatedBy: "wl_compositor@3.create_surface"},
+		{Id: 5, Interface: "wl_data_device", Version: 3},
+		{Id: minServerId, Interface: "wl_data_offer", Version: 3,
+			CreatedBy: "wl_data_device@5.data_offer"},
+	}
+	if got := client.Objects(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got objects:\n%+v\nexpected:\n%+v", got, want)
+	}
+
+	var text bytes.Buffer
+	if err := client.DumpObjects(&text); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	if len(lines) != len(want)+1 || !strings.HasPrefix(lines[0], "ID ") ||
+		strings.Join(strings.Fields(lines[4]), " ") != "4 wl_surface 4 zombie wl_compositor@3.create_surface" {
+		t.Errorf("Bad table:\n%s", text.String())
+	}
+
+	var buf bytes.Buffer
+	if err := client.DumpObjectsJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(want) || decoded[3]["State"] != "zombie" || decoded[3]["Id"] != 4.0 {
+		t.Errorf("Bad JSON: %s", buf.String())
+	}
+}
+
+// Protocol errors should come with the recent messages involving the object
+// concerned, including when libwayland reports it as an "invalid object" on
+// the display.
+func TestServerErrorRecent(t *testing.T) {
+	client, server := newTestClient(t)
+	compositor := addTestObject(client, &Compositor{}).(*Compositor)
+	surface, err := compositor.CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := surface.Attach(nil, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compositor.CreateRegion(); err != nil {
+		t.Fatal(err)
+	}
+	if err := surface.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < 5; i++ {
+			server.readRequest()
+		}
+		server.sendEvent(1, 0, ObjectId(1), uint32(DisplayErrorInvalidObject), "invalid object 4")
+	}()
+	err = client.Roundtrip(context.Background())
+
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("Expected a *ServerError, but got %v", err)
+	}
+	want := []string{
+		"-> wl_compositor@3.create_surface(new id wl_surface@4)",
+		"-> wl_surface@4.attach(nil, 0, 0)",
+		"-> wl_surface@4.destroy()",
+	}
+	if !reflect.DeepEqual(serverErr.Recent, want) {
+		t.Fatalf("Got recent messages:\n%q\nexpected:\n%q", serverErr.Recent, want)
+	}
+}
+
+// Objects in recent messages should be shown with the interfaces they had
+// at the time, even if their ids have since been reused.
+func TestServerErrorRecentReusedId(t *testing.T) {
+	client, server := newTestClient(t)
+	server.serveSync()
+	ctx := context.Background()
+	compositor := addTestObject(client, &Compositor{}).(*Compositor)
+	surface, err := compositor.CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	region, err := compositor.CreateRegion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := surface.SetOpaqueRegion(region); err != nil {
+		t.Fatal(err)
+	}
+	if err := region.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	server.sendEvent(1, 1, uint32(region.Id()))
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Reuse the region's id (and the sync callback's) for surfaces:
+	reused := false
+	for i := 0; i < 2; i++ {
+		s, err := compositor.CreateSurface()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reused = reused || s.Id() == region.Id()
+	}
+	if !reused {
+		t.Fatalf("Region's id %d was not reused", region.Id())
+	}
+
+	server.sendEvent(1, 0, surface.Id(), uint32(SurfaceErrorInvalidScale), "bad scale")
+	err = client.Roundtrip(ctx)
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("Expected a *ServerError, but got %v", err)
+	}
+	want := []string{
+		"-> wl_compositor@3.create_surface(new id wl_surface@4)",
+		"-> wl_surface@4.set_opaque_region(wl_region@5)",
+		`wl_display@1.error(wl_surface@4, 0, "bad scale")`,
+	}
+	if !reflect.DeepEqual(serverErr.Recent, want) {
+		t.Fatalf("Got recent messages:\n%q\nexpected:\n%q", serverErr.Recent, want)
+	}
+}
@@ -0,0 +1,376 @@
+package wayland
+
+import (
+	"sort"
+	"sync"
+)
+
+// A mode advertised for an output.
+type OutputModeInfo struct {
+	Width, Height int32
+
+	// Vertical refresh rate in mHz, or 0 if unknown.
+	Refresh int32
+
+	Current, Preferred bool
+}
+
+// A snapshot of the state of an output, as of the most recent
+// wl_output.done event. OutputInfos are never modified once published, and
+// callers must not modify them (or their Modes) either.
+type OutputInfo struct {
+	// The proxy for the output, e.g. for comparing with the arguments of
+	// Surface.OnEnter.
+	Output *Output
+
+	// The global name the output was bound from.
+	Global uint32
+
+	// Only sent by wl_output version 4 and later, which this library does
+	// not support yet; until then these are always empty.
+	Name, Description string
+
+	Make, Model string
+
+	// Position in the global compositor space.
+	X, Y int32
+
+	// Physical size in millimeters, or 0 if unknown.
+	PhysicalWidth, PhysicalHeight int32
+
+	Subpixel  OutputSubpixel
+	Transform OutputTransform
+	Scale     int32
+
+	// All of the modes the server has advertised, in the order it sent
+	// them. CurrentMode and PreferredMode are copies of the relevant
+	// entries, or zero if there are no such modes.
+	Modes         []OutputModeInfo
+	CurrentMode   OutputModeInfo
+	PreferredMode OutputModeInfo
+}
+
+// Outputs binds every wl_output global and aggregates each output's events
+// into OutputInfo snapshots. wl_output sends its properties as a series of
+// events, followed by done; the snapshot is only updated on done, so it never
+// reflects a partial update. (Version 1 outputs don't send done, so for those
+// the snapshot is updated after every event.)
+//
+// Like Globals, Outputs is updated as the registry's queue is dispatched, and
+// its callbacks are invoked from whichever goroutine does so.
+type Outputs struct {
+	client *Client
+
+	// Held while invoking callbacks; see Globals.callbackLock.
+	callbackLock sync.Mutex
+
+	// Guards the fields below.
+	lock    sync.Mutex
+	outputs map[uint32]*outputState
+
+	nextCallback int
+	onAdd        map[int]func(OutputInfo)
+	onChange     map[int]func(OutputInfo)
+	onRemove     map[int]func(OutputInfo)
+
+	cancelGlobals []func()
+}
+
+// The state of one output. Only accessed while dispatching the registry's
+// queue, except for current and published, which are guarded by
+// Outputs.lock.
+type outputState struct {
+	output  *Output
+	pending OutputInfo
+
+	current   OutputInfo
+	published bool
+}
+
+// Start tracking the client's outputs. NewOutputs must not be called from
+// within a Globals callback. As with event handlers, if the registry's queue
+// is being dispatched concurrently, events for outputs which are already
+// known may be missed; so call NewOutputs before dispatching starts, or from
+// the goroutine which does the dispatching.
+func NewOutputs(c *Client) *Outputs {
+	o := &Outputs{
+		client:   c,
+		outputs:  make(map[uint32]*outputState),
+		onAdd:    make(map[int]func(OutputInfo)),
+		onChange: make(map[int]func(OutputInfo)),
+		onRemove: make(map[int]func(OutputInfo)),
+	}
+	globals := c.Globals()
+	o.cancelGlobals = []func(){
+		globals.OnAdd(func(g Global) {
+			if g.Interface == "wl_output" {
+				o.add(g)
+			}
+		}),
+		globals.OnRemove(func(g Global) {
+			if g.Interface == "wl_output" {
+				o.remove(g.Name)
+			}
+		}),
+	}
+	return o
+}
+
+// Stop tracking outputs, and release the ones which have been bound.
+func (o *Outputs) Close() error {
+	for _, cancel := range o.cancelGlobals {
+		cancel()
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var err error
+	for name, st := range o.outputs {
+		if e := releaseOutput(st.output); e != nil && err == nil {
+			err = e
+		}
+		delete(o.outputs, name)
+	}
+	return err
+}
+
+// Return snapshots of all of the outputs which have been fully described by
+// the server, sorted by global name.
+func (o *Outputs) List() []OutputInfo {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.list()
+}
+
+// Like List, but o.lock must be held.
+func (o *Outputs) list() []OutputInfo {
+	ret := []OutputInfo{}
+	for _, st := range o.outputs {
+		if st.published {
+			ret = append(ret, st.current)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Global < ret[j].Global
+	})
+	return ret
+}
+
+// Return the most recent snapshot of the given output.
+func (o *Outputs) Lookup(output *Output) (OutputInfo, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, st := range o.outputs {
+		if st.output == output && st.published {
+			return st.current, true
+		}
+	}
+	return OutputInfo{}, false
+}
+
+// Register a callback to be invoked when an output has been fully described
+// for the first time. It is immediately invoked for each output which is
+// already known. Returns a function which unregisters the callback.
+//
+// As with Globals, none of the On methods may be called from within a
+// callback.
+func (o *Outputs) OnAdd(cb func(OutputInfo)) (cancel func()) {
+	o.callbackLock.Lock()
+	defer o.callbackLock.Unlock()
+	o.lock.Lock()
+	known := o.list()
+	id := o.register(o.onAdd, cb)
+	o.lock.Unlock()
+	for _, info := range known {
+		cb(info)
+	}
+	return func() { o.unregister(o.onAdd, id) }
+}
+
+// Register a callback to be invoked with the new snapshot whenever a known
+// output changes.
+func (o *Outputs) OnChange(cb func(OutputInfo)) (cancel func()) {
+	o.callbackLock.Lock()
+	defer o.callbackLock.Unlock()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	id := o.register(o.onChange, cb)
+	return func() { o.unregister(o.onChange, id) }
+}
+
+// Register a callback to be invoked with the last snapshot of an output when
+// it is unplugged.
+func (o *Outputs) OnRemove(cb func(OutputInfo)) (cancel func()) {
+	o.callbackLock.Lock()
+	defer o.callbackLock.Unlock()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	id := o.register(o.onRemove, cb)
+	return func() { o.unregister(o.onRemove, id) }
+}
+
+// o.lock must be held.
+func (o *Outputs) register(m map[int]func(OutputInfo), cb func(OutputInfo)) int {
+	id := o.nextCallback
+	o.nextCallback++
+	m[id] = cb
+	return id
+}
+
+func (o *Outputs) unregister(m map[int]func(OutputInfo), id int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(m, id)
+}
+
+// Invoke the callbacks in m with info, in the order they were registered.
+// o.callbackLock must be held, but not o.lock.
+func (o *Outputs) notify(m map[int]func(OutputInfo), info OutputInfo) {
+	o.lock.Lock()
+	ids := make([]int, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	cbs := make([]func(OutputInfo), len(ids))
+	for i, id := range ids {
+		cbs[i] = m[id]
+	}
+	o.lock.Unlock()
+	for _, cb := range cbs {
+		cb(info)
+	}
+}
+
+func (o *Outputs) add(g Global) {
+	obj, err := o.client.Globals().BindGlobal(g.Name, 0)
+	if err != nil {
+		// As with OnGlobal, there's nobody to return the error to, and
+		// we'd otherwise be missing an output.
+		o.client.fail(err)
+		return
+	}
+	st := &outputState{
+		output: obj.(*Output),
+		pending: OutputInfo{
+			Output: obj.(*Output),
+			Global: g.Name,
+			Scale:  1,
+		},
+	}
+	o.lock.Lock()
+	o.outputs[g.Name] = st
+	o.lock.Unlock()
+
+	out := st.output
+	out.AddGeometryListener(func(x, y, physicalWidth, physicalHeight, subpixel int32, make_, model string, transform int32) {
+		p := &st.pending
+		p.X, p.Y = x, y
+		p.PhysicalWidth, p.PhysicalHeight = physicalWidth, physicalHeight
+		p.Subpixel = OutputSubpixel(subpixel)
+		p.Make, p.Model = make_, model
+		p.Transform = OutputTransform(transform)
+		o.updated(st, false)
+	})
+	out.AddModeListener(func(flags uint32, width, height, refresh int32) {
+		st.setMode(OutputModeInfo{
+			Width:     width,
+			Height:    height,
+			Refresh:   refresh,
+			Current:   flags&OutputModeCurrent != 0,
+			Preferred: flags&OutputModePreferred != 0,
+		})
+		o.updated(st, false)
+	})
+	out.AddScaleListener(func(factor int32) {
+		st.pending.Scale = factor
+		o.updated(st, false)
+	})
+	out.AddDoneListener(func() {
+		o.updated(st, true)
+	})
+}
+
+// Record a mode event in the pending state.
+func (st *outputState) setMode(mode OutputModeInfo) {
+	// The modes slice may be shared with a published snapshot, so we
+	// always make a new one:
+	old := st.pending.Modes
+	modes := make([]OutputModeInfo, 0, len(old)+1)
+	found := false
+	for _, m := range old {
+		if mode.Current {
+			m.Current = false
+		}
+		if m.Width == mode.Width && m.Height == mode.Height && m.Refresh == mode.Refresh {
+			m = mode
+			found = true
+		}
+		modes = append(modes, m)
+	}
+	if !found {
+		modes = append(modes, mode)
+	}
+	st.pending.Modes = modes
+}
+
+// Called after each event for the output; done indicates whether it was the
+// done event. Publishes the pending state, if appropriate.
+func (o *Outputs) updated(st *outputState, done bool) {
+	if !done && st.output.Version() >= 2 {
+		return
+	}
+	info := st.pending
+	info.CurrentMode = OutputModeInfo{}
+	info.PreferredMode = OutputModeInfo{}
+	for _, m := range info.Modes {
+		if m.Current {
+			info.CurrentMode = m
+		}
+		if m.Preferred {
+			info.PreferredMode = m
+		}
+	}
+
+	o.callbackLock.Lock()
+	defer o.callbackLock.Unlock()
+	o.lock.Lock()
+	if o.outputs[info.Global] != st {
+		// Removed while we were waiting for done.
+		o.lock.Unlock()
+		return
+	}
+	first := !st.published
+	st.current = info
+	st.published = true
+	o.lock.Unlock()
+	if first {
+		o.notify(o.onAdd, info)
+	} else {
+		o.notify(o.onChange, info)
+	}
+}
+
+func (o *Outputs) remove(name uint32) {
+	o.callbackLock.Lock()
+	defer o.callbackLock.Unlock()
+	o.lock.Lock()
+	st, ok := o.outputs[name]
+	delete(o.outputs, name)
+	o.lock.Unlock()
+	if !ok {
+		return
+	}
+	releaseOutput(st.output)
+	if st.published {
+		o.notify(o.onRemove, st.current)
+	}
+}
+
+// Destroy the client's proxy for the output, if the protocol version allows
+// it. Prior to version 3 there is no way to do so.
+func releaseOutput(output *Output) error {
+	if output.Version() < 3 {
+		return nil
+	}
+	return output.Release()
+}
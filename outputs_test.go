@@ -0,0 +1,129 @@
+package wayland
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// Output events should be aggregated into snapshots, which are only published
+// on done.
+func TestOutputs(t *testing.T) {
+	client, server := newTestClient(t)
+	server.serveSync()
+	ctx := context.Background()
+	registry := client.GetRegistry().Id()
+	outputs := NewOutputs(client)
+
+	var added, changed, removed []OutputInfo
+	outputs.OnAdd(func(info OutputInfo) { added = append(added, info) })
+	outputs.OnChange(func(info OutputInfo) { changed = append(changed, info) })
+	outputs.OnRemove(func(info OutputInfo) { removed = append(removed, info) })
+
+	server.advertise(registry, Global{Name: 7, Interface: "wl_output", Version: 3})
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	outputs.lock.Lock()
+	id := outputs.outputs[7].output.Id()
+	outputs.lock.Unlock()
+
+	server.sendEvent(id, 0, int32(10), int32(20), int32(300), int32(200),
+		int32(OutputSubpixelHorizontalRgb), "ACME", "Screen", int32(OutputTransform90))
+	server.sendEvent(id, 1, uint32(OutputModeCurrent|OutputModePreferred),
+		int32(1920), int32(1080), int32(60000))
+	server.sendEvent(id, 1, uint32(0), int32(1280), int32(720), int32(60000))
+	server.sendEvent(id, 3, int32(2))
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs.List()) != 0 || len(added) != 0 {
+		t.Fatal("Output was published before done")
+	}
+
+	server.sendEvent(id, 2)
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 {
+		t.Fatalf("Expected one new output, but got %v", added)
+	}
+	info := added[0]
+	if info.Global != 7 || info.Output.Id() != id || info.Make != "ACME" ||
+		info.Model != "Screen" || info.X != 10 || info.Y != 20 ||
+		info.PhysicalWidth != 300 || info.PhysicalHeight != 200 ||
+		info.Subpixel != OutputSubpixelHorizontalRgb ||
+		info.Transform != OutputTransform90 || info.Scale != 2 {
+		t.Fatalf("Wrong output info: %+v", info)
+	}
+	if len(info.Modes) != 2 || info.CurrentMode.Width != 1920 || info.PreferredMode.Width != 1920 {
+		t.Fatalf("Wrong modes: %+v", info)
+	}
+
+	// Switch modes:
+	server.sendEvent(id, 1, uint32(OutputModeCurrent), int32(1280), int32(720), int32(60000))
+	server.sendEvent(id, 2)
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 {
+		t.Fatalf("Expected one change, but got %v", changed)
+	}
+	if changed[0].CurrentMode.Width != 1280 || changed[0].PreferredMode.Width != 1920 ||
+		len(changed[0].Modes) != 2 {
+		t.Fatalf("Wrong modes after change: %+v", changed[0])
+	}
+	if !info.Modes[0].Current || info.CurrentMode.Width != 1920 {
+		t.Fatal("Published snapshot was modified")
+	}
+	if got, ok := outputs.Lookup(info.Output); !ok || got.CurrentMode.Width != 1280 {
+		t.Fatalf("Lookup returned %+v, %v", got, ok)
+	}
+
+	// Unplug:
+	server.sendEvent(registry, 1, uint32(7))
+	if err := client.Roundtrip(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Global != 7 || len(outputs.List()) != 0 {
+		t.Fatalf("Output not removed: %v", removed)
+	}
+}
+
+// A transport whose sends fail once failSends is set.
+type failingTransport struct {
+	Transport
+	failSends atomic.Bool
+}
+
+var errSendFailed = errors.New("send failed")
+
+func (t *failingTransport) Send(data []byte, fds []int) error {
+	if t.failSends.Load() {
+		return errSendFailed
+	}
+	return t.Transport.Send(data, fds)
+}
+
+// If an output can't be bound, the connection should fail, rather than the
+// output going missing.
+func TestOutputsBindError(t *testing.T) {
+	clientSide, serverSide := Pipe()
+	transport := &failingTransport{Transport: clientSide}
+	client, server := newTestClientOn(t, transport, serverSide)
+	outputs := NewOutputs(client)
+	defer outputs.Close()
+
+	transport.failSends.Store(true)
+	server.advertise(client.GetRegistry().Id(), Global{Name: 7, Interface: "wl_output", Version: 3})
+	if err := client.DefaultQueue().Dispatch(); err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs.List()) != 0 {
+		t.Fatal("Output was added without being bound")
+	}
+	if err := client.DefaultQueue().Dispatch(); err != errSendFailed {
+		t.Fatalf("Expected %v, but got %v", errSendFailed, err)
+	}
+}
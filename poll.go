@@ -0,0 +1,181 @@
+package wayland
+
+import (
+	"errors"
+)
+
+// Support for driving a client from an external event loop, in the style of
+// libwayland's wl_display_prepare_read() & friends. A typical iteration of such
+// a loop looks like:
+//
+//	err := client.PrepareRead()
+//	for errors.Is(err, ErrEventsPending) {
+//		if err := client.DispatchPending(); err != nil {
+//			return err
+//		}
+//		err = client.PrepareRead()
+//	}
+//	if err != nil {
+//		return err
+//	}
+//	if err := client.Flush(); err != nil {
+//		client.CancelRead()
+//		return err
+//	}
+//	// ... wait for client.Fd() to become readable, along with
+//	// whatever else the loop is watching ...
+//	if readable {
+//		if err := client.ReadEvents(); err != nil {
+//			return err
+//		}
+//	} else {
+//		client.CancelRead()
+//	}
+//	return client.DispatchPending()
+
+// How a client reads messages from its transport.
+type readMode int
+
+const (
+	// Nothing has read from the transport yet.
+	readModeUnset readMode = iota
+
+	// A dedicated goroutine reads from the transport.
+	readModeGoroutine
+
+	// The application reads from the transport, using PrepareRead and
+	// ReadEvents.
+	readModeExternal
+)
+
+var (
+	ErrReaderRunning = errors.New("The client's reader goroutine is running")
+	ErrNotPollable   = errors.New("The client's transport does not support polling")
+	ErrEventsPending = errors.New("There are undispatched events in the queue")
+	ErrNotPrepared   = errors.New("ReadEvents called without PrepareRead")
+)
+
+// Return a file descriptor which polls as readable when there is data to read
+// from the connection, or -1 if the client's transport is not a
+// PollableTransport.
+func (c *Client) Fd() int {
+	pt, ok := c.transport.(PollableTransport)
+	if !ok {
+		return -1
+	}
+	return pt.Fd()
+}
+
+// Announce the intention to read from the connection. This must be followed
+// by a call to either ReadEvents or CancelRead.
+//
+// Returns ErrEventsPending if there are already events in the default queue;
+// in that case the caller should dispatch them and try again.
+//
+// The first call to PrepareRead switches the client to being driven by an
+// external event loop; after that the reader goroutine is never started, and
+// blocking methods like EventQueue.Dispatch read from the connection on the
+// calling goroutine instead. Returns ErrReaderRunning if the reader goroutine
+// has already been started.
+func (c *Client) PrepareRead() error {
+	return c.prepareRead(c.defaultQueue)
+}
+
+// Like PrepareRead, but returns ErrEventsPending if any of the (non-nil) queues
+// qs has events.
+func (c *Client) prepareRead(qs ...*EventQueue) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.readMode == readModeGoroutine {
+		return ErrReaderRunning
+	}
+	c.readMode = readModeExternal
+	for _, q := range qs {
+		if q.hasEvents() {
+			return ErrEventsPending
+		}
+	}
+	c.readers++
+	return nil
+}
+
+// Cancel a previous call to PrepareRead, without reading.
+func (c *Client) CancelRead() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readers--
+	if c.readers == 0 {
+		// Wake up anyone waiting for us to read:
+		c.readDone()
+	}
+}
+
+// Note that a read has finished (or won't happen), waking any goroutines
+// waiting in ReadEvents. c.lock must be held.
+func (c *Client) readDone() {
+	c.readSerial++
+	c.readCond.Broadcast()
+}
+
+// Read and queue whatever messages are available on the connection, without
+// blocking. Must be preceded by a call to PrepareRead.
+//
+// If several goroutines have called PrepareRead, only the last of them to call
+// ReadEvents actually reads from the connection; the others wait until it has
+// done so.
+func (c *Client) ReadEvents() error {
+	return c.readEvents(false)
+}
+
+func (c *Client) readEvents(block bool) error {
+	c.lock.Lock()
+	if c.readers <= 0 {
+		c.lock.Unlock()
+		return ErrNotPrepared
+	}
+	c.readers--
+	if c.err != nil {
+		defer c.lock.Unlock()
+		if c.readers == 0 {
+			c.readDone()
+		}
+		return c.err
+	}
+	if c.readers > 0 {
+		defer c.lock.Unlock()
+		// Wait for the last reader, unless the connection fails first
+		// (see Client.fail):
+		serial := c.readSerial
+		for serial == c.readSerial && c.err == nil {
+			c.readCond.Wait()
+		}
+		return c.err
+	}
+	c.lock.Unlock()
+
+	err := c.readAvailable(block)
+	if err != nil {
+		c.fail(err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDone()
+	return err
+}
+
+// Dispatch any events which are already in the default queue, without reading
+// from the connection.
+func (c *Client) DispatchPending() error {
+	return c.defaultQueue.DispatchPending()
+}
+
+// Requests are written to the transport as soon as they are made, so there is
+// never anything buffered for Flush to write; it exists so that event loops
+// written against libwayland's API have a counterpart. It returns the error
+// which caused the connection to fail, if any.
+func (c *Client) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
@@ -0,0 +1,145 @@
+package wayland
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Wait for fd to become readable, failing the test if it doesn't within a
+// reasonable amount of time.
+func pollReadable(t *testing.T, fd int) {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("Timed out waiting for the client's fd to become readable")
+	}
+}
+
+// Drive a client from a poll() based loop, without a reader goroutine.
+func TestExternalLoop(t *testing.T) {
+	for name, newPair := range transportPairs {
+		t.Run(name, func(t *testing.T) {
+			clientSide, serverSide := newPair(t)
+			client, server := newTestClientOn(t, clientSide, serverSide)
+			fd := client.Fd()
+			if fd < 0 {
+				t.Fatal("Transport did not provide a file descriptor")
+			}
+
+			done := false
+			cb, err := client.GetDisplay().Sync()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cb.OnDone(func(uint32) { done = true })
+
+			// Nothing has been sent yet, so this should return
+			// immediately, having read nothing.
+			if err := client.PrepareRead(); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.ReadEvents(); err != nil {
+				t.Fatal(err)
+			}
+
+			server.sendEvent(cb.Id(), 0, uint32(0))
+			for !done {
+				for client.PrepareRead() == ErrEventsPending {
+					client.DispatchPending()
+				}
+				if err := client.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				pollReadable(t, fd)
+				if err := client.ReadEvents(); err != nil {
+					t.Fatal(err)
+				}
+				if err := client.DispatchPending(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Once the client is driven externally, Dispatch should read on the calling
+// goroutine, and the reader goroutine should never start.
+func TestExternalDispatch(t *testing.T) {
+	client, server := newTestClient(t)
+	if err := client.PrepareRead(); err != nil {
+		t.Fatal(err)
+	}
+	client.CancelRead()
+
+	done := false
+	cb, err := client.GetDisplay().Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb.OnDone(func(uint32) { done = true })
+	server.sendEvent(cb.Id(), 0, uint32(0))
+	for !done {
+		if err := client.DefaultQueue().Dispatch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if client.readMode != readModeExternal {
+		t.Fatal("Dispatch switched the client away from external mode")
+	}
+}
+
+func TestPrepareReadWithReader(t *testing.T) {
+	client, _ := newTestClient(t)
+	client.startReader()
+	if err := client.PrepareRead(); err != ErrReaderRunning {
+		t.Fatalf("Expected ErrReaderRunning, but got %v", err)
+	}
+	if err := client.ReadEvents(); err != ErrNotPrepared {
+		t.Fatalf("Expected ErrNotPrepared, but got %v", err)
+	}
+}
+
+// Goroutines waiting in ReadEvents for another to read should return once
+// the connection fails.
+func TestReadEventsFailure(t *testing.T) {
+	client, _ := newTestClient(t)
+	for i := 0; i < 2; i++ {
+		if err := client.PrepareRead(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.ReadEvents()
+	}()
+	// Wait until the goroutine is waiting for the other reader:
+	for {
+		client.lock.Lock()
+		readers := client.readers
+		client.lock.Unlock()
+		if readers == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	failure := errors.New("connection failed")
+	client.fail(failure)
+	select {
+	case err := <-done:
+		if err != failure {
+			t.Fatalf("Expected %v, but got %v", failure, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadEvents did not return after the connection failed")
+	}
+	if err := client.ReadEvents(); err != failure {
+		t.Fatalf("Expected %v, but got %v", failure, err)
+	}
+}
@@ -0,0 +1,12 @@
+package wayland
+
+import (
+	_ "embed"
+)
+
+// The XML description of the core protocol, from which this package's
+// interfaces are generated. This is for tools which decode messages
+// generically, such as cmd/wayland-sniffer.
+//
+//go:embed wayland.xml
+var ProtocolXML []byte
@@ -0,0 +1,218 @@
+package wayland
+
+import (
+	"context"
+	"sync"
+)
+
+// An EventQueue holds events which have been read from the connection, but
+// not yet dispatched. Each object is assigned to a queue, and its events are
+// only delivered when that queue is dispatched. Objects created by requests
+// on an object are initially assigned to the same queue.
+//
+// Every client has a default queue, used by objects which have not been
+// assigned one explicitly. MainLoop dispatches the default queue.
+//
+// A queue may be dispatched from any goroutine, but only one goroutine will
+// dispatch a given queue at a time; events on a queue are always delivered
+// one at a time, in the order they arrived.
+type EventQueue struct {
+	client *Client
+
+	// Held while dispatching.
+	dispatchLock sync.Mutex
+
+	// Receives a value (if one is not already buffered) whenever events
+	// are added to the queue.
+	wake chan struct{}
+
+	// Guarded by client.lock.
+	events []event
+}
+
+// An event which has been read from the connection, but not yet dispatched.
+type event struct {
+	sender remoteProxy
+	opcode uint16
+	data   []byte
+	fds    []int
+}
+
+// Create a new event queue. Use SetQueue to assign objects to it.
+func (c *Client) NewQueue() *EventQueue {
+	return &EventQueue{
+		client: c,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Dispatch the queue, first waiting for events to arrive if none are already
+// queued.
+//
+// Neither Dispatch nor the other blocking methods of EventQueue may be called
+// from within an event handler which is being run by the same queue.
+func (q *EventQueue) Dispatch() error {
+	if err := q.wait(context.Background(), nil); err != nil {
+		return err
+	}
+	return q.DispatchPending()
+}
+
+// Block until the server has processed all requests sent so far, dispatching
+// the queue in the meantime. When Roundtrip returns nil, all events the server
+// sent in response to those requests have been dispatched.
+//
+// Returns early if ctx is canceled, if the server reports a protocol error
+// (in which case the error is a *ServerError), or if the connection fails.
+// When the client is driven by an external event loop, ctx is only checked
+// between reads.
+func (q *EventQueue) Roundtrip(ctx context.Context) error {
+	c := q.client
+
+	// Put the callback on a private queue, so that nobody else can
+	// dispatch its event before we've installed our handler.
+	syncQueue := c.NewQueue()
+	cb, err := c.displayOnQueue(syncQueue).Sync()
+	if err != nil {
+		return err
+	}
+	done := false
+	cb.OnDone(func(uint32) { done = true })
+	for {
+		if err := q.DispatchPending(); err != nil {
+			return err
+		}
+		if err := c.serverError(); err != nil {
+			return err
+		}
+		syncQueue.DispatchPending()
+		if done {
+			// Events sent before the callback's are already
+			// queued, but some may have arrived after the call
+			// to DispatchPending above:
+			return q.DispatchPending()
+		}
+		if err := q.wait(ctx, syncQueue); err != nil {
+			return err
+		}
+	}
+}
+
+// Dispatch any events which are already queued, without waiting for more.
+func (q *EventQueue) DispatchPending() error {
+	q.dispatchLock.Lock()
+	defer q.dispatchLock.Unlock()
+	c := q.client
+	for {
+		c.lock.Lock()
+		if len(q.events) == 0 {
+			c.lock.Unlock()
+			return nil
+		}
+		ev := q.events[0]
+		q.events[0] = event{}
+		q.events = q.events[1:]
+		c.stats.queued--
+		// Like libwayland, drop events for objects which the client
+		// has destroyed since they were queued, rather than running
+		// handlers on a destroyed object.
+		destroyed := ev.sender.base().destroyed
+		c.lock.Unlock()
+		if destroyed {
+			closeAll(ev.fds)
+			continue
+		}
+		ev.sender.handleEvent(ev.opcode, ev.data, ev.fds)
+	}
+}
+
+// Block until there are events in the queue (or in extra, if it is not nil),
+// the connection fails, or ctx is done.
+func (q *EventQueue) wait(ctx context.Context, extra *EventQueue) error {
+	c := q.client
+	if c.startReader() == readModeExternal {
+		return q.read(ctx, extra)
+	}
+	var extraWake chan struct{}
+	if extra != nil {
+		extraWake = extra.wake
+	}
+	for {
+		c.lock.Lock()
+		ready := q.hasEvents() || extra.hasEvents()
+		err := c.err
+		c.lock.Unlock()
+		if ready {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		select {
+		case <-q.wake:
+		case <-extraWake:
+		case <-c.failed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Like wait, but for clients driven by an external event loop, where there
+// is no reader goroutine: read from the connection on the current goroutine
+// until there are events.
+func (q *EventQueue) read(ctx context.Context, extra *EventQueue) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := q.client.prepareRead(q, extra)
+		if err == ErrEventsPending {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = q.client.readEvents(true); err != nil {
+			return err
+		}
+	}
+}
+
+// Return the number of events waiting in the queue.
+func (q *EventQueue) Len() int {
+	q.client.lock.Lock()
+	defer q.client.lock.Unlock()
+	return len(q.events)
+}
+
+// Report whether there are events in the queue. q may be nil, in which case
+// the result is false. q.client.lock must be held.
+func (q *EventQueue) hasEvents() bool {
+	return q != nil && len(q.events) > 0
+}
+
+// Add an event to the queue. c.lock must be held.
+func (q *EventQueue) push(ev event) {
+	q.events = append(q.events, ev)
+	q.client.stats.queued++
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Return the queue to which events for the object will be delivered.
+func (o *remoteObject) getQueue() *EventQueue {
+	if o.queue == nil {
+		return o.conn.defaultQueue
+	}
+	return o.queue
+}
+
+// Assign the object to the queue q. Events for the object which arrive after
+// this call will be delivered when q is dispatched. If q is nil, the object is
+// assigned to the client's default queue.
+func (o *remoteObject) SetQueue(q *EventQueue) {
+	o.conn.lock.Lock()
+	defer o.conn.lock.Unlock()
+	o.queue = q
+}
@@ -0,0 +1,78 @@
+package wayland
+
+import (
+	"context"
+	"testing"
+)
+
+// Events should be delivered only when the queue of the object they are sent
+// to is dispatched, and new objects should inherit their parent's queue.
+func TestQueueDispatch(t *testing.T) {
+	client, server := newTestClient(t)
+	display := client.GetDisplay()
+
+	defaultDone := false
+	defaultCb, err := display.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultCb.OnDone(func(uint32) { defaultDone = true })
+
+	q := client.NewQueue()
+	display.SetQueue(q)
+	queueDone := false
+	queueCb, err := display.Sync()
+	display.SetQueue(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueCb.OnDone(func(uint32) { queueDone = true })
+
+	server.sendEvent(queueCb.Id(), 0, uint32(0))
+	server.sendEvent(defaultCb.Id(), 0, uint32(0))
+
+	if err := client.DefaultQueue().Dispatch(); err != nil {
+		t.Fatal(err)
+	}
+	if !defaultDone {
+		t.Fatal("Event on the default queue was not dispatched")
+	}
+	if queueDone {
+		t.Fatal("Event on a separate queue was dispatched by the default queue")
+	}
+	if err := q.Dispatch(); err != nil {
+		t.Fatal(err)
+	}
+	if !queueDone {
+		t.Fatal("Event was not dispatched by its queue")
+	}
+}
+
+// Events which were queued before the client destroyed their object should
+// not be dispatched.
+func TestQueuedEventsAfterDestroy(t *testing.T) {
+	client, server := newTestClient(t)
+	surface := addTestObject(client, &Surface{}).(*Surface)
+	q := client.NewQueue()
+	surface.SetQueue(q)
+	entered := false
+	surface.OnEnter(func(*Output) { entered = true })
+
+	server.serveSync()
+	server.sendEvent(surface.Id(), 0, ObjectId(0))
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("Expected 1 queued event, but there are %d", q.Len())
+	}
+	if err := surface.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.DispatchPending(); err != nil {
+		t.Fatal(err)
+	}
+	if entered {
+		t.Fatal("Event was dispatched to a destroyed object")
+	}
+}
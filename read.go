@@ -42,15 +42,20 @@ func read_string(offset *int, buf []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	// The size includes the terminating NUL; a size of zero denotes a
+	// null string.
 	size := int(size32)
-	if *offset+ceil32(size+1) > len(buf) {
+	if size == 0 {
+		return "", nil
+	}
+	if *offset+ceil32(size) > len(buf) {
 		return "", io.ErrUnexpectedEOF
 	}
-	if buf[*offset+size] != 0 {
+	if buf[*offset+size-1] != 0 {
 		return "", ErrMissingNul
 	}
 	ret := string(buf[*offset : *offset+size-1])
-	*offset += ceil32(size + 1)
+	*offset += ceil32(size)
 	return ret, nil
 }
 
@@ -65,7 +70,7 @@ func read_array(offset *int, buf []byte) ([]byte, error) {
 	if *offset+ceil32(size) > len(buf) {
 		return nil, io.ErrUnexpectedEOF
 	}
-	ret := buf[*offset:size]
+	ret := buf[*offset : *offset+size]
 	*offset += ceil32(size)
 	return ret, err
 }
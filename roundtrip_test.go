@@ -0,0 +1,63 @@
+package wayland
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// After Roundtrip returns, events sent in response to earlier requests should
+// have been dispatched.
+func TestRoundtrip(t *testing.T) {
+	client, server := newTestClient(t)
+	server.serveSync()
+
+	done := false
+	cb, err := client.GetDisplay().Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb.OnDone(func(uint32) { done = true })
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !done {
+		t.Fatal("Event sent before the roundtrip completed was not dispatched")
+	}
+}
+
+func TestRoundtripServerError(t *testing.T) {
+	client, server := newTestClient(t)
+	go func() {
+		server.readRequest()
+		server.sendEvent(1, 0, ObjectId(1), uint32(DisplayErrorInvalidMethod), "bad request")
+	}()
+	err := client.Roundtrip(context.Background())
+	serverErr, ok := err.(*ServerError)
+	if !ok {
+		t.Fatalf("Expected a *ServerError, but got %v", err)
+	}
+	if serverErr.Message != "bad request" || serverErr.ErrorCode != uint32(DisplayErrorInvalidMethod) {
+		t.Fatalf("Wrong error: %v", serverErr)
+	}
+}
+
+func TestRoundtripDisconnect(t *testing.T) {
+	client, server := newTestClient(t)
+	go func() {
+		server.readRequest()
+		server.transport.Close()
+	}()
+	if err := client.Roundtrip(context.Background()); err == nil {
+		t.Fatal("Roundtrip succeeded, despite the server hanging up")
+	}
+}
+
+func TestRoundtripContext(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := client.Roundtrip(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, but got %v", err)
+	}
+}
@@ -1,152 +1,180 @@
 package wayland
 
 import (
-	"golang.org/x/sys/unix"
+	"bytes"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
 	testMessage = "hello"
 )
 
-// Test Conn.send and Conn.recv.
-func TestSendRecv(t *testing.T) {
-	// TEST_SEND_CHILD indicates that we've been spawned as a child by
-	// the test suite.
-	if os.Getenv("TEST_SEND_CHILD") == "1" {
-		testSendRecvChild(t)
-	} else {
-		testSendRecvParent(t)
-	}
-}
-
-func connFromFd(t *testing.T, fd int) *Client {
-	socket, err := net.FileConn(os.NewFile(uintptr(fd), "socket"))
+// Return a pair of connected unix transports, backed by a socketpair.
+func unixTransportPair(t *testing.T) (Transport, Transport) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	return newClient(socket.(*net.UnixConn))
+	transports := [2]Transport{}
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socket")
+		conn, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		transports[i] = NewUnixTransport(conn.(*net.UnixConn))
+	}
+	return transports[0], transports[1]
 }
 
-// Child half of TestSendRecv. Accept a message and file descriptor on fd #3,
-// then write the received message to the received file descriptor.
-func testSendRecvChild(t *testing.T) {
-	defer os.Exit(0)
+var transportPairs = map[string]func(t *testing.T) (Transport, Transport){
+	"unix": unixTransportPair,
+	"pipe": func(*testing.T) (Transport, Transport) { return Pipe() },
+}
 
-	defer unix.Close(3)
-	conn := connFromFd(t, 3)
+// Test Transport.Send and Transport.Recv: send the write end of a pipe and
+// a message over the transport, then write the received message to the
+// received file descriptor, and try to read the same message from the pipe.
+func TestSendRecv(t *testing.T) {
+	for name, newPair := range transportPairs {
+		t.Run(name, func(t *testing.T) {
+			a, b := newPair(t)
+			defer a.Close()
+			defer b.Close()
 
-	// Make the buffer a bit bigger than needed, so if we get more data than
-	// expected we catch it:
-	buf := make([]byte, len(testMessage)+2)
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			err = a.Send([]byte(testMessage), []int{int(w.Fd())})
+			w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	// make sure that if this is not overwritten, it can't be confused for
-	// a valid fd:
-	fds := []int{-1}
+			// Make the buffer a bit bigger than needed, so if we get more
+			// data than expected we catch it:
+			buf := make([]byte, len(testMessage)+2)
 
-	n, nfd, err := conn.recv(buf, fds)
-	if err != nil && err != io.EOF {
-		t.Fatal(err)
-	}
-	if n != len(testMessage) || nfd != len(fds) {
-		t.Fatalf("Wrong read lengths; expected (%d, %d) but got (%d, %d)",
-			len(testMessage), len(fds), n, nfd)
-	}
-	defer unix.Close(fds[0])
-	n, err = os.NewFile(uintptr(fds[0]), "pipe").Write(buf[:n])
-	if err != nil {
-		t.Fatal(err)
-	}
-	if n != len(testMessage) {
-		t.Fatal("Wrong write length; expected", len(testMessage), "but got", n)
-	}
-}
+			// make sure that if this is not overwritten, it can't be
+			// confused for a valid fd:
+			fds := []int{-1}
 
-// Execute the test binary, running only TestSendRecv, setting the
-// environment variable "TEST_SEND_CHILD" to 1 so the child knows it's
-// the child.
-func spawnTestChild(t *testing.T, fd int) (stdout, stderr io.ReadCloser, cmd *exec.Cmd, err error) {
-	cmd = exec.Command(os.Args[0], "-test.run", "^TestSendRecv$")
-	cmd.ExtraFiles = []*os.File{os.NewFile(uintptr(fd), "socket")}
-	cmd.Env = append(os.Environ(), "TEST_SEND_CHILD=1")
-	stdout, err = cmd.StdoutPipe()
-	if err != nil {
-		goto fail_stdout
-	}
-	stderr, err = cmd.StderrPipe()
-	if err != nil {
-		goto fail_stderr
-	}
-	if err = cmd.Start(); err != nil {
-		goto fail_start
+			n, nfd, err := b.Recv(buf, fds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(testMessage) || nfd != len(fds) {
+				t.Fatalf("Wrong read lengths; expected (%d, %d) but got (%d, %d)",
+					len(testMessage), len(fds), n, nfd)
+			}
+			recvW := os.NewFile(uintptr(fds[0]), "pipe")
+			n, err = recvW.Write(buf[:n])
+			recvW.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(testMessage) {
+				t.Fatal("Wrong write length; expected", len(testMessage), "but got", n)
+			}
+
+			sz, err := r.Read(buf)
+			if sz != len(testMessage) || err != nil {
+				t.Fatal("Read", sz, "bytes with error", err, "expected",
+					len(testMessage), "bytes and err == nil")
+			}
+			receivedMessage := string(buf[:sz])
+			if receivedMessage != testMessage {
+				t.Fatal("Expected", testMessage, "but got", receivedMessage)
+			}
+		})
 	}
-	return
-fail_start:
-	stderr.Close()
-fail_stderr:
-	stdout.Close()
-fail_stdout:
-	t.Fatal(err)
-	// The compiler doesn't seem to know that Fatal never returns:
-	panic("unreachable")
 }
 
-// Parent half of TestSendRecv. Spawn a child process with an attached socket,
-// send the write end of a pipe and a message over the socket, then try to
-// read the same message from the pipe.
-func testSendRecvParent(t *testing.T) {
+// Closing one end of a transport should cause the other end to see EOF,
+// after any data already sent has been received.
+func TestTransportClose(t *testing.T) {
+	for name, newPair := range transportPairs {
+		t.Run(name, func(t *testing.T) {
+			a, b := newPair(t)
+			defer b.Close()
+			if err := a.Send([]byte(testMessage), nil); err != nil {
+				t.Fatal(err)
+			}
+			a.Close()
 
-	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
-	if err != nil {
-		t.Fatal(err)
+			buf := make([]byte, len(testMessage))
+			n, _, err := b.Recv(buf, nil)
+			if err != nil || n != len(testMessage) {
+				t.Fatal("Read", n, "bytes with error", err, "expected",
+					len(testMessage), "bytes and err == nil")
+			}
+			_, _, err = b.Recv(buf, nil)
+			if err != io.EOF {
+				t.Fatal("Expected EOF, but got", err)
+			}
+		})
 	}
-	defer unix.Close(fds[1])
+}
 
-	stdout, stderr, cmd, err := spawnTestChild(t, fds[0])
-	unix.Close(fds[0])
+// The client should be able to reassemble messages which arrive in pieces.
+func TestClientPartialMessage(t *testing.T) {
+	clientSide, serverSide := Pipe()
+	defer serverSide.Close()
+	client, err := NewClient(clientSide)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		time.AfterFunc(3*time.Second, func() { cmd.Process.Kill() })
-		outbytes, err := ioutil.ReadAll(stdout)
-		t.Logf("output from child (error %v): %s", err, outbytes)
-		errbytes, err := ioutil.ReadAll(stderr)
-		t.Logf("stderr from child (error %v): %s", err, errbytes)
-		stdout.Close()
-		stderr.Close()
-		if err := cmd.Wait(); err != nil {
-			t.Fatal("Error from child:", err)
-		}
-	}()
+	defer client.Close()
+	registryId := client.GetRegistry().Id()
 
-	conn := connFromFd(t, fds[1])
-	r, w, err := os.Pipe()
-	if err != nil {
+	// wl_display.delete_id(registryId), split across two sends:
+	msg := &bytes.Buffer{}
+	header{Sender: 1, Opcode: 1, Size: 12}.WriteTo(msg)
+	write_uint(msg, uint32(registryId))
+	for _, part := range [][]byte{msg.Bytes()[:6], msg.Bytes()[6:]} {
+		if err := serverSide.Send(part, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.readAvailable(true); err != nil {
 		t.Fatal(err)
 	}
-	defer r.Close()
-	err = conn.send([]byte(testMessage), []int{int(w.Fd())})
-	w.Close()
+	if _, ok := client.objects[registryId]; ok {
+		t.Fatal("delete_id was not handled")
+	}
+}
+
+// Closing a client over a unix socket while its reader is blocked should
+// stop MainLoop with an error.
+func TestCloseWhileReading(t *testing.T) {
+	clientSide, serverSide := unixTransportPair(t)
+	defer serverSide.Close()
+	client, err := NewClient(clientSide)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Make the buffer a bit bigger, so we can tell if the child writes
-	// more data than expected.
-	buf := make([]byte, len(testMessage)+2)
-	sz, err := r.Read(buf)
-	if sz != len(testMessage) || err != nil {
-		t.Fatal("Read", sz, "bytes with error", err, "expected",
-			len(testMessage), "bytes and err == nil")
-	}
-	receivedMessage := string(buf[:sz])
-	if receivedMessage != testMessage {
-		t.Fatal("Expected", testMessage, "but got", receivedMessage)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.MainLoop()
+	}()
+	// Give the reader a chance to block:
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("MainLoop returned nil after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MainLoop did not return after Close")
 	}
 }
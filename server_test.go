@@ -0,0 +1,144 @@
+package wayland
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A minimal stand-in for a compositor, for use in tests. It talks to a client
+// over an in-process Pipe.
+type testServer struct {
+	t         *testing.T
+	transport Transport
+	inData    []byte
+	inFds     []int
+}
+
+// Return a new client connected to a testServer.
+func newTestClient(t *testing.T) (*Client, *testServer) {
+	clientSide, serverSide := Pipe()
+	return newTestClientOn(t, clientSide, serverSide)
+}
+
+// Like newTestClient, but use the supplied transports.
+func newTestClientOn(t *testing.T, clientSide, serverSide Transport) (*Client, *testServer) {
+	client, err := NewClient(clientSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		serverSide.Close()
+	})
+	return client, &testServer{t: t, transport: serverSide}
+}
+
+// A file descriptor argument to testServer.sendEvent.
+type testFd int
+
+// Send an event to the client. Arguments must be uint32s, int32s, ObjectIds,
+// Fixeds, strings or testFds.
+func (s *testServer) sendEvent(sender ObjectId, opcode uint16, args ...interface{}) {
+	body := &bytes.Buffer{}
+	fds := []int{}
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case testFd:
+			fds = append(fds, int(arg))
+		case uint32:
+			write_uint(body, arg)
+		case int32:
+			write_int(body, arg)
+		case ObjectId:
+			write_uint(body, uint32(arg))
+		case Fixed:
+			write_fixed(body, arg)
+		case string:
+			write_string(body, arg)
+		default:
+			s.t.Fatalf("testServer: unsupported argument type %T", arg)
+		}
+	}
+	msg := &bytes.Buffer{}
+	header{
+		Sender: sender,
+		Opcode: opcode,
+		Size:   uint16(8 + body.Len()),
+	}.WriteTo(msg)
+	msg.Write(body.Bytes())
+	if err := s.transport.Send(msg.Bytes(), fds); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// A request received by a testServer.
+type testRequest struct {
+	header
+	body []byte
+}
+
+// Read the next request from the client. Returns an error if the connection
+// has been closed.
+func (s *testServer) readRequest() (testRequest, error) {
+	for len(s.inData) < 8 || len(s.inData) < int(s.peekSize()) {
+		var (
+			data [4096]byte
+			fds  [maxFdsPerRecv]int
+		)
+		n, fdn, err := s.transport.Recv(data[:], fds[:])
+		s.inData = append(s.inData, data[:n]...)
+		s.inFds = append(s.inFds, fds[:fdn]...)
+		if n == 0 && err != nil {
+			return testRequest{}, err
+		}
+	}
+	req := testRequest{}
+	(&req.header).ReadFrom(bytes.NewReader(s.inData))
+	req.body = append([]byte(nil), s.inData[8:req.Size]...)
+	s.inData = s.inData[req.Size:]
+	return req, nil
+}
+
+func (s *testServer) peekSize() uint16 {
+	return uint16(hostEndian.Uint32(s.inData[4:8]) >> 16)
+}
+
+// Return the i-th 32-bit argument of the request.
+func (r testRequest) arg(i int) uint32 {
+	return hostEndian.Uint32(r.body[4*i:])
+}
+
+// Reply to wl_display.sync requests, until the connection is closed. Other
+// requests are ignored. Returns a channel which is closed when the server
+// stops.
+func (s *testServer) serveSync() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			req, err := s.readRequest()
+			if err != nil {
+				return
+			}
+			if req.Sender == 1 && req.Opcode == 0 {
+				id := ObjectId(req.arg(0))
+				s.sendEvent(id, 0, uint32(0))
+				s.sendEvent(1, 1, uint32(id))
+			}
+		}
+	}()
+	return done
+}
+
+// Register obj with the client under a fresh id, as if it had been created by
+// a request. Returns obj.
+func addTestObject(c *Client, obj remoteProxy) remoteProxy {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	o := obj.base()
+	o.conn = c
+	o.id = c.newId()
+	o.version = interfaceRegistry[obj.Interface()].version
+	c.objects[o.id] = obj
+	return obj
+}
@@ -0,0 +1,180 @@
+package shm
+
+import (
+	"image/draw"
+	"math"
+
+	"zenhack.net/go/wayland"
+)
+
+// A Buffer is a wl_buffer allocated from a Pool.
+type Buffer struct {
+	pool   *Pool
+	buffer *wayland.Buffer
+	span   span
+
+	width, height, stride int
+	format                uint32
+	data                  []byte
+	image                 draw.Image
+
+	// Guarded by the pool's lock:
+	busy           bool // Attached, and not yet released.
+	destroyPending bool // Destroy was called while busy.
+	destroyed      bool
+
+	// If not nil, called (without the lock held) when the compositor
+	// releases the buffer. Used by Swapchain.
+	onIdle func()
+}
+
+// Allocate a buffer of the given dimensions, in pixels, and format, which
+// must be one of the following wayland.ShmFormat* constants:
+//
+//   - ShmFormatArgb8888
+//   - ShmFormatXrgb8888
+//   - ShmFormatAbgr8888
+//   - ShmFormatXbgr8888
+//   - ShmFormatRgb565
+//
+// The compositor must support the format; argb8888 and xrgb8888 are always
+// supported. The width and height must be positive, and small enough that
+// the buffer's size fits in an int32; otherwise NewBuffer returns
+// ErrInvalidSize.
+func (p *Pool) NewBuffer(width, height int, format uint32) (*Buffer, error) {
+	f, ok := formats[format]
+	if !ok {
+		return nil, ErrUnsupportedFormat
+	}
+	// Bound the width first, so that computing the stride can't overflow.
+	if width <= 0 || height <= 0 || width > (math.MaxInt32-3)/f.bytesPerPixel {
+		return nil, ErrInvalidSize
+	}
+	stride := (width*f.bytesPerPixel + 3) &^ 3
+	if stride < width*f.bytesPerPixel || height > math.MaxInt32/stride {
+		return nil, ErrInvalidSize
+	}
+	size := stride * height
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.destroyed {
+		return nil, ErrDestroyed
+	}
+	offset, err := p.alloc(size)
+	if err != nil {
+		return nil, err
+	}
+	buffer, err := p.pool.CreateBuffer(int32(offset), int32(width), int32(height), int32(stride), format)
+	if err != nil {
+		p.release(span{offset, align(size)})
+		return nil, err
+	}
+	b := &Buffer{
+		pool:   p,
+		buffer: buffer,
+		span:   span{offset, align(size)},
+		width:  width,
+		height: height,
+		stride: stride,
+		format: format,
+		data:   p.data[offset : offset+size : offset+size],
+	}
+	b.image = f.newImage(b.data, width, height, stride)
+	buffer.AddReleaseListener(b.onRelease)
+	return b, nil
+}
+
+// Return the underlying wl_buffer.
+func (b *Buffer) Proxy() *wayland.Buffer {
+	return b.buffer
+}
+
+// Return the buffer's width, in pixels.
+func (b *Buffer) Width() int {
+	return b.width
+}
+
+// Return the buffer's height, in pixels.
+func (b *Buffer) Height() int {
+	return b.height
+}
+
+// Return the number of bytes between the starts of consecutive rows.
+func (b *Buffer) Stride() int {
+	return b.stride
+}
+
+// Return the buffer's format, one of wayland.ShmFormat*.
+func (b *Buffer) Format() uint32 {
+	return b.format
+}
+
+// Return the buffer's memory, which is Stride() * Height() bytes.
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+// Return the buffer's memory as an image. Drawing on it modifies the buffer.
+// The concrete type depends on the format; for ShmFormatAbgr8888, whose byte
+// order matches, it's an *image.RGBA.
+func (b *Buffer) Image() draw.Image {
+	return b.image
+}
+
+// Attach the buffer to the surface, as with wl_surface.attach, and mark it
+// busy until the compositor releases it.
+func (b *Buffer) Attach(surface *wayland.Surface, x, y int32) error {
+	b.pool.lock.Lock()
+	b.busy = true
+	b.pool.lock.Unlock()
+	return surface.Attach(b.buffer, x, y)
+}
+
+// Report whether the compositor may still be reading from the buffer, i.e.
+// it has been attached to a surface and not yet released. A busy buffer must
+// not be drawn on.
+func (b *Buffer) Busy() bool {
+	b.pool.lock.Lock()
+	defer b.pool.lock.Unlock()
+	return b.busy
+}
+
+// Destroy the buffer, and return its memory to the pool. If the buffer is
+// busy, this happens once the compositor releases it, so the memory isn't
+// reused while it may still be read.
+func (b *Buffer) Destroy() error {
+	b.pool.lock.Lock()
+	defer b.pool.lock.Unlock()
+	if b.busy {
+		b.destroyPending = true
+		return nil
+	}
+	return b.destroy()
+}
+
+// Must be called with the pool's lock held.
+func (b *Buffer) destroy() error {
+	if b.destroyed {
+		return nil
+	}
+	b.destroyed = true
+	err := b.buffer.Destroy()
+	if !b.pool.destroyed {
+		b.pool.release(b.span)
+	}
+	return err
+}
+
+func (b *Buffer) onRelease() {
+	b.pool.lock.Lock()
+	b.busy = false
+	if b.destroyPending {
+		b.destroy()
+	}
+	onIdle := b.onIdle
+	b.pool.lock.Unlock()
+	if onIdle != nil {
+		onIdle()
+	}
+}
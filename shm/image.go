@@ -0,0 +1,175 @@
+package shm
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"zenhack.net/go/wayland"
+)
+
+// A pixel format we know how to draw on.
+type format struct {
+	bytesPerPixel int
+	newImage      func(data []byte, width, height, stride int) draw.Image
+}
+
+// wl_shm formats are little-endian, so e.g. argb8888 is stored as B, G, R, A.
+var formats = map[uint32]format{
+	wayland.ShmFormatArgb8888: {4, func(data []byte, w, h, stride int) draw.Image {
+		return &BGRA{Pix: data, Stride: stride, Rect: image.Rect(0, 0, w, h)}
+	}},
+	wayland.ShmFormatXrgb8888: {4, func(data []byte, w, h, stride int) draw.Image {
+		return &BGRX{Pix: data, Stride: stride, Rect: image.Rect(0, 0, w, h)}
+	}},
+	wayland.ShmFormatAbgr8888: {4, func(data []byte, w, h, stride int) draw.Image {
+		return &image.RGBA{Pix: data, Stride: stride, Rect: image.Rect(0, 0, w, h)}
+	}},
+	wayland.ShmFormatXbgr8888: {4, func(data []byte, w, h, stride int) draw.Image {
+		return &RGBX{Pix: data, Stride: stride, Rect: image.Rect(0, 0, w, h)}
+	}},
+	wayland.ShmFormatRgb565: {2, func(data []byte, w, h, stride int) draw.Image {
+		return &RGB565{Pix: data, Stride: stride, Rect: image.Rect(0, 0, w, h)}
+	}},
+}
+
+// An image in the argb8888 format, i.e. bytes in the order B, G, R, A, with
+// premultiplied alpha. The fields are as for image.RGBA.
+type BGRA struct {
+	Pix    []byte
+	Stride int
+	Rect   image.Rectangle
+}
+
+func (m *BGRA) ColorModel() color.Model { return color.RGBAModel }
+func (m *BGRA) Bounds() image.Rectangle { return m.Rect }
+
+func (m *BGRA) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(m.Rect)) {
+		return color.RGBA{}
+	}
+	p := m.Pix[m.PixOffset(x, y):]
+	return color.RGBA{R: p[2], G: p[1], B: p[0], A: p[3]}
+}
+
+func (m *BGRA) Set(x, y int, c color.Color) {
+	if !(image.Point{x, y}.In(m.Rect)) {
+		return
+	}
+	r, g, b, a := c.RGBA()
+	p := m.Pix[m.PixOffset(x, y):]
+	p[0], p[1], p[2], p[3] = uint8(b>>8), uint8(g>>8), uint8(r>>8), uint8(a>>8)
+}
+
+// Return the index of the first byte of the pixel at (x, y).
+func (m *BGRA) PixOffset(x, y int) int {
+	return (y-m.Rect.Min.Y)*m.Stride + (x-m.Rect.Min.X)*4
+}
+
+// An image in the xrgb8888 format, i.e. bytes in the order B, G, R, and one
+// which is ignored. Pixels are always opaque; translucent colors are drawn as
+// if over black.
+type BGRX struct {
+	Pix    []byte
+	Stride int
+	Rect   image.Rectangle
+}
+
+func (m *BGRX) ColorModel() color.Model { return color.RGBAModel }
+func (m *BGRX) Bounds() image.Rectangle { return m.Rect }
+func (m *BGRX) Opaque() bool            { return true }
+
+func (m *BGRX) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(m.Rect)) {
+		return color.RGBA{}
+	}
+	p := m.Pix[m.PixOffset(x, y):]
+	return color.RGBA{R: p[2], G: p[1], B: p[0], A: 0xff}
+}
+
+func (m *BGRX) Set(x, y int, c color.Color) {
+	if !(image.Point{x, y}.In(m.Rect)) {
+		return
+	}
+	r, g, b, _ := c.RGBA()
+	p := m.Pix[m.PixOffset(x, y):]
+	p[0], p[1], p[2], p[3] = uint8(b>>8), uint8(g>>8), uint8(r>>8), 0xff
+}
+
+// Return the index of the first byte of the pixel at (x, y).
+func (m *BGRX) PixOffset(x, y int) int {
+	return (y-m.Rect.Min.Y)*m.Stride + (x-m.Rect.Min.X)*4
+}
+
+// An image in the xbgr8888 format, i.e. bytes in the order R, G, B, and one
+// which is ignored. Like BGRX, pixels are always opaque.
+type RGBX struct {
+	Pix    []byte
+	Stride int
+	Rect   image.Rectangle
+}
+
+func (m *RGBX) ColorModel() color.Model { return color.RGBAModel }
+func (m *RGBX) Bounds() image.Rectangle { return m.Rect }
+func (m *RGBX) Opaque() bool            { return true }
+
+func (m *RGBX) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(m.Rect)) {
+		return color.RGBA{}
+	}
+	p := m.Pix[m.PixOffset(x, y):]
+	return color.RGBA{R: p[0], G: p[1], B: p[2], A: 0xff}
+}
+
+func (m *RGBX) Set(x, y int, c color.Color) {
+	if !(image.Point{x, y}.In(m.Rect)) {
+		return
+	}
+	r, g, b, _ := c.RGBA()
+	p := m.Pix[m.PixOffset(x, y):]
+	p[0], p[1], p[2], p[3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), 0xff
+}
+
+// Return the index of the first byte of the pixel at (x, y).
+func (m *RGBX) PixOffset(x, y int) int {
+	return (y-m.Rect.Min.Y)*m.Stride + (x-m.Rect.Min.X)*4
+}
+
+// An image in the rgb565 format, i.e. little-endian 16-bit pixels with 5 bits
+// of red in the most significant bits, then 6 of green and 5 of blue. Like
+// BGRX, pixels are always opaque.
+type RGB565 struct {
+	Pix    []byte
+	Stride int
+	Rect   image.Rectangle
+}
+
+func (m *RGB565) ColorModel() color.Model { return color.RGBAModel }
+func (m *RGB565) Bounds() image.Rectangle { return m.Rect }
+func (m *RGB565) Opaque() bool            { return true }
+
+func (m *RGB565) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(m.Rect)) {
+		return color.RGBA{}
+	}
+	v := binary.LittleEndian.Uint16(m.Pix[m.PixOffset(x, y):])
+	r, g, b := uint8(v>>11), uint8(v>>5)&0x3f, uint8(v)&0x1f
+	// Replicate the high bits into the low ones, so that full intensity
+	// maps to 0xff:
+	return color.RGBA{R: r<<3 | r>>2, G: g<<2 | g>>4, B: b<<3 | b>>2, A: 0xff}
+}
+
+func (m *RGB565) Set(x, y int, c color.Color) {
+	if !(image.Point{x, y}.In(m.Rect)) {
+		return
+	}
+	r, g, b, _ := c.RGBA()
+	v := uint16(r>>11)<<11 | uint16(g>>10)<<5 | uint16(b>>11)
+	binary.LittleEndian.PutUint16(m.Pix[m.PixOffset(x, y):], v)
+}
+
+// Return the index of the first byte of the pixel at (x, y).
+func (m *RGB565) PixOffset(x, y int) int {
+	return (y-m.Rect.Min.Y)*m.Stride + (x-m.Rect.Min.X)*2
+}
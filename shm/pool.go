@@ -0,0 +1,196 @@
+// Package shm manages shared memory buffers, for clients which draw on the
+// CPU.
+//
+// A Pool is a wl_shm_pool backed by a memfd, from which Buffers of any size
+// are allocated; the pool grows as needed. Each Buffer can be drawn on as a
+// draw.Image, and keeps track of whether the compositor is still using it.
+// A Swapchain takes care of cycling through buffers for a surface.
+package shm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"zenhack.net/go/wayland"
+)
+
+var (
+	// NewBuffer was asked for a format this package doesn't support.
+	ErrUnsupportedFormat = errors.New("shm: unsupported format")
+
+	// The pool has been destroyed.
+	ErrDestroyed = errors.New("shm: pool destroyed")
+
+	// NewBuffer was asked for a buffer with no pixels, or one too big to
+	// describe to the compositor.
+	ErrInvalidSize = errors.New("shm: invalid buffer size")
+)
+
+// Offsets and sizes of allocations are multiples of this.
+const alignment = 64
+
+// A Pool is a region of shared memory, from which buffers are allocated.
+type Pool struct {
+	shm *wayland.Shm
+
+	lock      sync.Mutex
+	destroyed bool
+	pool      *wayland.ShmPool
+	fd        int
+	size      int
+
+	// The memory is re-mapped whenever the pool grows. Earlier mappings
+	// are kept until the pool is destroyed, so the slices (and images)
+	// of existing buffers stay valid; they're all mappings of the same
+	// memory.
+	data     []byte
+	mappings [][]byte
+
+	// Unallocated regions of the pool, ordered by offset. Adjacent
+	// regions are always merged.
+	free []span
+}
+
+type span struct {
+	offset, size int
+}
+
+// Create a pool of the given initial size, in bytes.
+func NewPool(shm *wayland.Shm, size int) (*Pool, error) {
+	size = align(size)
+	if size <= 0 {
+		size = alignment
+	}
+	fd, err := unix.MemfdCreate("wayland-shm", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return nil, fmt.Errorf("shm: creating memfd: %w", err)
+	}
+	p := &Pool{shm: shm, fd: fd}
+	if err := p.resize(size); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// The compositor maps the memory too; sealing it against shrinking
+	// assures it that it can't be made to fault by us truncating it.
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK); err != nil {
+		p.unmap()
+		unix.Close(fd)
+		return nil, fmt.Errorf("shm: sealing memfd: %w", err)
+	}
+	p.pool, err = shm.CreatePool(fd, int32(size))
+	if err != nil {
+		p.unmap()
+		unix.Close(fd)
+		return nil, err
+	}
+	p.free = []span{{0, size}}
+	return p, nil
+}
+
+// Return the current size of the pool, in bytes.
+func (p *Pool) Size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.size
+}
+
+// Destroy the pool, and unmap its memory. Buffers allocated from it must not
+// be used afterwards, though the compositor may go on using any which are
+// attached to surfaces.
+func (p *Pool) Destroy() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.destroyed {
+		return nil
+	}
+	p.destroyed = true
+	err := p.pool.Destroy()
+	p.unmap()
+	unix.Close(p.fd)
+	return err
+}
+
+// Grow the memfd to size, and map it. Must be called with the lock held.
+func (p *Pool) resize(size int) error {
+	if err := unix.Ftruncate(p.fd, int64(size)); err != nil {
+		return fmt.Errorf("shm: growing pool: %w", err)
+	}
+	data, err := unix.Mmap(p.fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("shm: mapping pool: %w", err)
+	}
+	p.size = size
+	p.data = data
+	p.mappings = append(p.mappings, data)
+	return nil
+}
+
+func (p *Pool) unmap() {
+	for _, m := range p.mappings {
+		unix.Munmap(m)
+	}
+	p.mappings = nil
+	p.data = nil
+}
+
+// Allocate size bytes from the pool, growing it if need be. Must be called
+// with the lock held.
+func (p *Pool) alloc(size int) (offset int, err error) {
+	size = align(size)
+	for i, s := range p.free {
+		if s.size >= size {
+			if s.size == size {
+				p.free = append(p.free[:i], p.free[i+1:]...)
+			} else {
+				p.free[i] = span{s.offset + size, s.size - size}
+			}
+			return s.offset, nil
+		}
+	}
+
+	// No room; grow the pool, at least doubling it so we don't have to
+	// do this too often.
+	newSize := 2 * p.size
+	if need := p.size + size; newSize < need {
+		newSize = need
+	}
+	if newSize > 1<<31-1 {
+		return 0, fmt.Errorf("shm: pool too large")
+	}
+	oldSize := p.size
+	if err := p.resize(newSize); err != nil {
+		return 0, err
+	}
+	if err := p.pool.Resize(int32(newSize)); err != nil {
+		return 0, err
+	}
+	p.release(span{oldSize, newSize - oldSize})
+	return p.alloc(size)
+}
+
+// Return a span to the free list. Must be called with the lock held.
+func (p *Pool) release(s span) {
+	i := 0
+	for i < len(p.free) && p.free[i].offset < s.offset {
+		i++
+	}
+	p.free = append(p.free, span{})
+	copy(p.free[i+1:], p.free[i:])
+	p.free[i] = s
+	// Merge with the neighbours, if they're adjacent:
+	if i+1 < len(p.free) && s.offset+s.size == p.free[i+1].offset {
+		p.free[i].size += p.free[i+1].size
+		p.free = append(p.free[:i+1], p.free[i+2:]...)
+	}
+	if i > 0 && p.free[i-1].offset+p.free[i-1].size == s.offset {
+		p.free[i-1].size += p.free[i].size
+		p.free = append(p.free[:i], p.free[i+1:]...)
+	}
+}
+
+func align(n int) int {
+	return (n + alignment - 1) &^ (alignment - 1)
+}
@@ -0,0 +1,238 @@
+package shm
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"zenhack.net/go/wayland"
+	"zenhack.net/go/wayland/internal/wltest"
+)
+
+// A server which records the requests it receives.
+type recorder struct {
+	lock     sync.Mutex
+	requests []wltest.Request
+}
+
+func (r *recorder) handle(req wltest.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests = append(r.requests, req)
+}
+
+// Return the recorded requests with the given sender and opcode.
+func (r *recorder) find(sender wayland.ObjectId, opcode uint16) []wltest.Request {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ret []wltest.Request
+	for _, req := range r.requests {
+		if req.Sender == sender && req.Opcode == opcode {
+			ret = append(ret, req)
+		}
+	}
+	return ret
+}
+
+// Return all of the fds received; see the comment in the cursor package's
+// tests.
+func (r *recorder) fds() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ret []int
+	for _, req := range r.requests {
+		ret = append(ret, req.Fds...)
+	}
+	return ret
+}
+
+// Request opcodes.
+const (
+	shmCreatePool    = 0
+	poolCreateBuffer = 0
+	poolResize       = 2
+	bufferDestroy    = 0
+)
+
+// Event opcodes.
+const (
+	bufferRelease = 0
+)
+
+type fixture struct {
+	t      *testing.T
+	client *wayland.Client
+	server *wltest.Server
+	rec    *recorder
+	shm    *wayland.Shm
+}
+
+func newFixture(t *testing.T) *fixture {
+	client, server := wltest.NewClient(t)
+	f := &fixture{t: t, client: client, server: server, rec: &recorder{}}
+	server.Serve(f.rec.handle)
+	server.Advertise(1, "wl_shm", 1)
+	server.Advertise(2, "wl_compositor", 4)
+	f.roundtrip()
+	obj, err := client.Globals().BindGlobal(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.shm = obj.(*wayland.Shm)
+	return f
+}
+
+func (f *fixture) roundtrip() {
+	f.t.Helper()
+	if err := f.client.Roundtrip(context.Background()); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	f := newFixture(t)
+	pool, err := NewPool(f.shm, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+	if pool.Size() != 128 {
+		t.Errorf("Expected size to be rounded up to 128, but got %d", pool.Size())
+	}
+
+	// 5x4 at 4 bytes per pixel is exactly 80 bytes, so this should fit:
+	a, err := pool.NewBuffer(5, 4, wayland.ShmFormatArgb8888)
+	if err != nil {
+		t.Fatal(err)
+	}
+	draw.Draw(a.Image(), a.Image().Bounds(), image.NewUniform(color.RGBA{R: 0x11, G: 0x22, B: 0x33, A: 0xff}), image.Point{}, draw.Src)
+	f.roundtrip()
+
+	req := f.rec.find(f.shm.Id(), shmCreatePool)
+	fds := f.rec.fds()
+	if len(req) != 1 || len(fds) != 1 || req[0].Arg(1) != 128 {
+		t.Fatalf("Bad create_pool: %+v", req)
+	}
+	poolId := wayland.ObjectId(req[0].Arg(0))
+	data, err := unix.Mmap(fds[0], 0, 128, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Munmap(data)
+	defer unix.Close(fds[0])
+	if got := data[4*7 : 4*8]; string(got) != "\x33\x22\x11\xff" {
+		t.Errorf("Bad pixel data: %x", got)
+	}
+	creates := f.rec.find(poolId, poolCreateBuffer)
+	// id, offset, width, height, stride, format
+	if len(creates) != 1 || creates[0].Arg(1) != 0 || creates[0].Arg(2) != 5 ||
+		creates[0].Arg(3) != 4 || creates[0].Arg(4) != 20 || creates[0].Arg(5) != wayland.ShmFormatArgb8888 {
+		t.Fatalf("Bad create_buffer: %+v", creates)
+	}
+
+	// There's no room for a second buffer, so the pool should grow. The
+	// first buffer's image should stay usable:
+	b, err := pool.NewBuffer(3, 3, wayland.ShmFormatRgb565)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.roundtrip()
+	resizes := f.rec.find(poolId, poolResize)
+	if len(resizes) != 1 || resizes[0].Arg(0) != 256 || pool.Size() != 256 {
+		t.Fatalf("Bad resize: %+v", resizes)
+	}
+	creates = f.rec.find(poolId, poolCreateBuffer)
+	// Rows of 6 bytes are padded to 8:
+	if len(creates) != 2 || creates[1].Arg(1) != 128 || creates[1].Arg(4) != 8 {
+		t.Fatalf("Bad create_buffer: %+v", creates)
+	}
+	a.Image().Set(0, 0, color.RGBA{A: 0xff})
+	if data[0] != 0 || data[4] != 0x33 {
+		t.Error("Old buffer not drawable after the pool grew")
+	}
+
+	// Destroying a busy buffer should wait until the compositor releases
+	// it:
+	obj, err := f.client.Globals().BindGlobal(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	surface, err := obj.(*wayland.Compositor).CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Busy() {
+		t.Fatal("Buffer busy before being attached")
+	}
+	if err := b.Attach(surface, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Busy() {
+		t.Fatal("Buffer not busy")
+	}
+	if err := b.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	f.roundtrip()
+	if len(f.rec.find(b.Proxy().Id(), bufferDestroy)) != 0 {
+		t.Fatal("Busy buffer destroyed")
+	}
+	f.server.SendEvent(b.Proxy().Id(), bufferRelease)
+	f.roundtrip()
+	f.roundtrip()
+	if b.Busy() {
+		t.Error("Buffer still busy after release")
+	}
+	if len(f.rec.find(b.Proxy().Id(), bufferDestroy)) != 1 {
+		t.Fatal("Buffer not destroyed after release")
+	}
+
+	// ...and then its memory should be reused:
+	c, err := pool.NewBuffer(4, 4, wayland.ShmFormatXrgb8888)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.roundtrip()
+	creates = f.rec.find(poolId, poolCreateBuffer)
+	if len(creates) != 3 || creates[2].Arg(1) != 128 {
+		t.Errorf("Freed memory not reused: %+v", creates)
+	}
+	c.Destroy()
+
+	if _, err := pool.NewBuffer(1, 1, 0xdeadbeef); err != ErrUnsupportedFormat {
+		t.Errorf("Expected ErrUnsupportedFormat, but got %v", err)
+	}
+	for _, size := range [][2]int{{0, 4}, {4, 0}, {-1, 4}, {1 << 30, 1}, {1 << 15, 1 << 15}} {
+		if _, err := pool.NewBuffer(size[0], size[1], wayland.ShmFormatXrgb8888); err != ErrInvalidSize {
+			t.Errorf("NewBuffer(%d, %d): expected ErrInvalidSize, but got %v", size[0], size[1], err)
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	colors := []color.RGBA{
+		{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		{R: 0xff, A: 0xff},
+		{G: 0xff, A: 0xff},
+		{B: 0xff, A: 0xff},
+		{A: 0xff},
+	}
+	for format, f := range formats {
+		data := make([]byte, 4*f.bytesPerPixel*len(colors))
+		img := f.newImage(data, len(colors), 2, len(colors)*f.bytesPerPixel)
+		for x, c := range colors {
+			img.Set(x, 1, c)
+			if got := color.RGBAModel.Convert(img.At(x, 1)); got != c {
+				t.Errorf("Format %#x: set %v, but got %v", format, c, got)
+			}
+			if got := color.RGBAModel.Convert(img.At(x, 0)); got.(color.RGBA).R != 0 {
+				t.Errorf("Format %#x: Set wrote to the wrong row", format)
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package shm
+
+import (
+	"context"
+	"errors"
+	"image"
+	"sync"
+
+	"zenhack.net/go/wayland"
+)
+
+// Returned by Present when there is no buffer to present: either Next
+// hasn't been called since the last Present, or a Resize (say, in response
+// to a configure event handled on another goroutine) has invalidated the
+// buffer it returned. Call Next again, and redraw.
+var ErrNoBuffer = errors.New("shm: no buffer to present; call Next again")
+
+// If a buffer's damage accumulates more rectangles than this, they're
+// merged into their bounding box.
+const maxDamageRects = 16
+
+// A Swapchain manages a small set of buffers for a surface, which are drawn
+// on in turn. It keeps track of which buffers the compositor has released,
+// and which parts of each buffer are out of date, and paces drawing using
+// frame callbacks.
+//
+// A typical render loop, run on its own goroutine while another one
+// dispatches events (e.g. with Client.MainLoop), looks like:
+//
+//	for {
+//		buf, damage, err := sc.Next(ctx)
+//		if err != nil {
+//			return err
+//		}
+//		changed := redraw(buf.Image(), damage)
+//		if err := sc.Present(changed); err != nil {
+//			return err
+//		}
+//	}
+//
+// where redraw must bring everything within damage up to date, and returns
+// the regions which differ from the previous frame.
+type Swapchain struct {
+	pool    *Pool
+	surface *wayland.Surface
+	format  uint32
+	count   int
+
+	// Receives a value (if one isn't already buffered) whenever a frame
+	// callback fires or a buffer is released.
+	wake chan struct{}
+
+	lock          sync.Mutex
+	width, height int
+	slots         []*slot
+	current       *slot // Returned by Next, and not yet presented.
+	framePending  bool
+	frameGen      uint64 // Incremented by Resize and Present, to spot stale callbacks.
+	destroyed     bool
+}
+
+type slot struct {
+	buffer *Buffer
+	damage []image.Rectangle
+}
+
+// Create a swapchain of count buffers (two or three is typical) of the given
+// size and format, allocated from pool, for drawing on surface. The buffers
+// are allocated as needed.
+func NewSwapchain(pool *Pool, surface *wayland.Surface, width, height int, format uint32, count int) (*Swapchain, error) {
+	if _, ok := formats[format]; !ok {
+		return nil, ErrUnsupportedFormat
+	}
+	if count < 1 {
+		count = 1
+	}
+	return &Swapchain{
+		pool:    pool,
+		surface: surface,
+		format:  format,
+		count:   count,
+		width:   width,
+		height:  height,
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+func (s *Swapchain) wakeup() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Wait until it's time to draw the next frame, and return the buffer to draw
+// on, together with the regions of it which are out of date, in buffer
+// coordinates. A new buffer is entirely out of date.
+//
+// Calling Next again before Present returns the same buffer.
+//
+// Next waits for events (frame callbacks and buffer releases) to be
+// dispatched on the surface's queue, so it must not be called from a handler
+// run by that queue. Returns early with ctx's error if it is canceled.
+func (s *Swapchain) Next(ctx context.Context) (*Buffer, []image.Rectangle, error) {
+	for {
+		s.lock.Lock()
+		if s.destroyed {
+			s.lock.Unlock()
+			return nil, nil, ErrDestroyed
+		}
+		if s.current == nil && !s.framePending {
+			sl, err := s.freeSlot()
+			if err != nil {
+				s.lock.Unlock()
+				return nil, nil, err
+			}
+			s.current = sl
+		}
+		if s.current != nil {
+			sl := s.current
+			s.lock.Unlock()
+			return sl.buffer, sl.damage, nil
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-s.wake:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// Return a slot whose buffer isn't busy, allocating a new one if there's
+// room, or nil if all of the buffers are busy. Must be called with the lock
+// held.
+func (s *Swapchain) freeSlot() (*slot, error) {
+	for _, sl := range s.slots {
+		if !sl.buffer.Busy() {
+			return sl, nil
+		}
+	}
+	if len(s.slots) == s.count {
+		return nil, nil
+	}
+	buf, err := s.pool.NewBuffer(s.width, s.height, s.format)
+	if err != nil {
+		return nil, err
+	}
+	s.pool.lock.Lock()
+	buf.onIdle = s.wakeup
+	s.pool.lock.Unlock()
+	sl := &slot{
+		buffer: buf,
+		damage: []image.Rectangle{image.Rect(0, 0, s.width, s.height)},
+	}
+	s.slots = append(s.slots, sl)
+	return sl, nil
+}
+
+// Present the buffer returned by Next: request a frame callback, attach the
+// buffer to the surface, damage it and commit. damage lists the regions which
+// changed since the previous frame, in buffer coordinates; if it's empty, the
+// whole buffer is assumed to have changed. The next call to Next will wait
+// for the frame callback. Returns ErrNoBuffer if there is no buffer from Next
+// to present.
+func (s *Swapchain) Present(damage []image.Rectangle) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.destroyed {
+		return ErrDestroyed
+	}
+	sl := s.current
+	if sl == nil {
+		return ErrNoBuffer
+	}
+	bounds := image.Rect(0, 0, s.width, s.height)
+	var clipped []image.Rectangle
+	for _, r := range damage {
+		if r = r.Intersect(bounds); !r.Empty() {
+			clipped = append(clipped, r)
+		}
+	}
+	if len(damage) == 0 {
+		clipped = []image.Rectangle{bounds}
+	}
+
+	callback, err := s.surface.Frame()
+	if err != nil {
+		return err
+	}
+	s.frameGen++
+	gen := s.frameGen
+	callback.OnDone(func(uint32) {
+		s.lock.Lock()
+		if s.frameGen == gen {
+			s.framePending = false
+		}
+		s.lock.Unlock()
+		s.wakeup()
+	})
+	if err := sl.buffer.Attach(s.surface, 0, 0); err != nil {
+		return err
+	}
+	for _, r := range clipped {
+		// damage_buffer is new in version 4; before that, we can only
+		// damage in surface coordinates, which are the same unless a
+		// scale or transform is set.
+		if s.surface.Version() >= 4 {
+			err = s.surface.DamageBuffer(int32(r.Min.X), int32(r.Min.Y), int32(r.Dx()), int32(r.Dy()))
+		} else {
+			err = s.surface.Damage(int32(r.Min.X), int32(r.Min.Y), int32(r.Dx()), int32(r.Dy()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.surface.Commit(); err != nil {
+		return err
+	}
+
+	s.framePending = true
+	s.current = nil
+	sl.damage = nil
+	for _, other := range s.slots {
+		if other != sl {
+			other.damage = addDamage(other.damage, clipped)
+		}
+	}
+	return nil
+}
+
+// Add rects to damage, merging everything if there are too many.
+func addDamage(damage, rects []image.Rectangle) []image.Rectangle {
+	damage = append(damage, rects...)
+	if len(damage) <= maxDamageRects {
+		return damage
+	}
+	var union image.Rectangle
+	for _, r := range damage {
+		union = union.Union(r)
+	}
+	return []image.Rectangle{union}
+}
+
+// Change the size of the buffers. Existing buffers are destroyed once the
+// compositor releases them, and new ones allocated as needed. Also stops
+// waiting for any outstanding frame callback, so the next frame can be drawn
+// at the new size right away.
+func (s *Swapchain) Resize(width, height int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if width == s.width && height == s.height {
+		return
+	}
+	s.width, s.height = width, height
+	s.destroyBuffers()
+	s.framePending = false
+	s.frameGen++
+	s.wakeup()
+}
+
+// Destroy the swapchain's buffers. Any buffer returned by Next must not be
+// used afterwards.
+func (s *Swapchain) Destroy() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.destroyed {
+		return
+	}
+	s.destroyed = true
+	s.destroyBuffers()
+	s.wakeup()
+}
+
+// Must be called with the lock held.
+func (s *Swapchain) destroyBuffers() {
+	for _, sl := range s.slots {
+		sl.buffer.Destroy()
+	}
+	s.slots = nil
+	s.current = nil
+}
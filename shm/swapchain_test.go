@@ -0,0 +1,182 @@
+package shm
+
+import (
+	"context"
+	"errors"
+	"image"
+	"reflect"
+	"testing"
+	"time"
+
+	"zenhack.net/go/wayland"
+)
+
+// More request opcodes.
+const (
+	surfaceAttach       = 1
+	surfaceFrame        = 3
+	surfaceCommit       = 6
+	surfaceDamageBuffer = 9
+)
+
+// Event opcodes.
+const (
+	callbackDone = 0
+)
+
+func TestSwapchain(t *testing.T) {
+	f := newFixture(t)
+	obj, err := f.client.Globals().BindGlobal(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	surface, err := obj.(*wayland.Compositor).CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool(f.shm, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+	sc, err := NewSwapchain(pool, surface, 10, 10, wayland.ShmFormatXrgb8888, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Destroy()
+
+	ctx := context.Background()
+	next := func() (*Buffer, []image.Rectangle) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		buf, damage, err := sc.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf, damage
+	}
+	// Check that Next blocks.
+	blocked := func() {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if _, _, err := sc.Next(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("Expected Next to block, but got %v", err)
+		}
+	}
+	// Send the done event for the most recent frame callback.
+	frameDone := func() {
+		t.Helper()
+		frames := f.rec.find(surface.Id(), surfaceFrame)
+		f.server.SendEvent(wayland.ObjectId(frames[len(frames)-1].Arg(0)), callbackDone, uint32(0))
+		f.roundtrip()
+	}
+	full := []image.Rectangle{image.Rect(0, 0, 10, 10)}
+
+	a, damage := next()
+	if !reflect.DeepEqual(damage, full) {
+		t.Errorf("New buffer should be fully damaged, but got %v", damage)
+	}
+	if again, _ := next(); again != a {
+		t.Error("Next returned a different buffer before Present")
+	}
+	if err := sc.Present([]image.Rectangle{image.Rect(1, 2, 3, 4), image.Rect(8, 8, 20, 20)}); err != nil {
+		t.Fatal(err)
+	}
+	f.roundtrip()
+	f.rec.lock.Lock()
+	var ops []uint16
+	for _, req := range f.rec.requests {
+		if req.Sender == surface.Id() {
+			ops = append(ops, req.Opcode)
+		}
+	}
+	f.rec.lock.Unlock()
+	want := []uint16{surfaceFrame, surfaceAttach, surfaceDamageBuffer, surfaceDamageBuffer, surfaceCommit}
+	if !reflect.DeepEqual(ops, want) {
+		t.Fatalf("Got requests %v, expected %v", ops, want)
+	}
+	damages := f.rec.find(surface.Id(), surfaceDamageBuffer)
+	if r := damages[1]; r.Arg(0) != 8 || r.Arg(1) != 8 || r.Arg(2) != 2 || r.Arg(3) != 2 {
+		t.Errorf("Damage not clipped to the buffer: %v", r.Body)
+	}
+
+	// The next frame should wait for the callback, and then use a new
+	// buffer, since the first hasn't been released:
+	blocked()
+	frameDone()
+	b, damage := next()
+	if b == a || !reflect.DeepEqual(damage, full) {
+		t.Fatalf("Expected a new, fully damaged buffer, but got %v", damage)
+	}
+	if err := sc.Present([]image.Rectangle{image.Rect(0, 0, 1, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	f.roundtrip()
+	frameDone()
+
+	// Both buffers are busy, so we should wait for a release, and then
+	// get the first one back with the damage since it was presented:
+	blocked()
+	f.server.SendEvent(a.Proxy().Id(), bufferRelease)
+	f.roundtrip()
+	buf, damage := next()
+	if buf != a || !reflect.DeepEqual(damage, []image.Rectangle{image.Rect(0, 0, 1, 1)}) {
+		t.Errorf("Expected the first buffer with damage [(0,0)-(1,1)], but got %v", damage)
+	}
+
+	// After a resize, we should get a new buffer right away:
+	if err := sc.Present(nil); err != nil {
+		t.Fatal(err)
+	}
+	sc.Resize(20, 5)
+	buf, damage = next()
+	if buf.Width() != 20 || buf.Height() != 5 ||
+		!reflect.DeepEqual(damage, []image.Rectangle{image.Rect(0, 0, 20, 5)}) {
+		t.Errorf("Bad buffer after resize: %dx%d, damage %v", buf.Width(), buf.Height(), damage)
+	}
+}
+
+// A Resize between Next and Present (e.g. from a configure handled on the
+// event goroutine) invalidates the buffer, which Present should report
+// rather than presenting a buffer which no longer exists.
+func TestSwapchainResizeBeforePresent(t *testing.T) {
+	f := newFixture(t)
+	obj, err := f.client.Globals().BindGlobal(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	surface, err := obj.(*wayland.Compositor).CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool(f.shm, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+	sc, err := NewSwapchain(pool, surface, 10, 10, wayland.ShmFormatXrgb8888, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Destroy()
+
+	if _, _, err := sc.Next(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sc.Resize(20, 20)
+	if err := sc.Present(nil); !errors.Is(err, ErrNoBuffer) {
+		t.Fatalf("Expected ErrNoBuffer, but got %v", err)
+	}
+	buf, _, err := sc.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Width() != 20 {
+		t.Errorf("Got a buffer %d pixels wide after resizing", buf.Width())
+	}
+	if err := sc.Present(nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -11,3 +11,10 @@ func sizeOf_string(s string) uint16 {
 	// XXX: we need to make sure this doesn't overflow somehow.
 	return uint16(4 + ceil32(len(s)+1))
 }
+
+func sizeOf_nullable_string(s string) uint16 {
+	if s == "" {
+		return 4
+	}
+	return sizeOf_string(s)
+}
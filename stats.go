@@ -0,0 +1,111 @@
+package wayland
+
+import (
+	"expvar"
+)
+
+// Counts of messages of some kind.
+type MessageStats struct {
+	Messages uint64
+	Bytes    uint64 // Including headers.
+	Fds      uint64
+}
+
+func (s *MessageStats) add(size, fds int) {
+	s.Messages++
+	s.Bytes += uint64(size)
+	s.Fds += uint64(fds)
+}
+
+// A snapshot of a client's activity, as returned by Client.Stats.
+type Stats struct {
+	// Totals for all requests sent and events received.
+	Sent, Received MessageStats
+
+	// The same, broken down by interface and message, keyed by names like
+	// "wl_surface.attach". Messages which have never been sent or received
+	// are omitted.
+	Requests map[string]MessageStats
+	Events   map[string]MessageStats
+
+	// The number of live objects, by interface.
+	Objects map[string]int
+
+	// The number of objects the client has destroyed, but whose ids the
+	// server has not yet released.
+	Zombies int
+
+	// The number of events waiting to be dispatched, in the default queue
+	// and in all queues. See also EventQueue.Len.
+	DefaultQueue int
+	Queued       int
+}
+
+// Identifies a request or event, without allocating.
+type messageKey struct {
+	info   *interfaceInfo
+	opcode uint16
+}
+
+func (k messageKey) name(msgs []messageInfo) string {
+	return k.info.name + "." + msgs[k.opcode].name
+}
+
+// Counters, guarded by Client.lock.
+type clientStats struct {
+	sent, received   MessageStats
+	requests, events map[messageKey]*MessageStats
+	queued           int
+}
+
+// Count a message sent or received by obj. c.lock must be held.
+func (c *Client) countMessage(m map[messageKey]*MessageStats, obj remoteProxy, opcode uint16, size, fds int) {
+	info, ok := interfaceRegistry[obj.Interface()]
+	if !ok {
+		return
+	}
+	k := messageKey{info: info, opcode: opcode}
+	s, ok := m[k]
+	if !ok {
+		s = &MessageStats{}
+		m[k] = s
+	}
+	s.add(size, fds)
+}
+
+// Return a snapshot of the client's activity so far.
+func (c *Client) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ret := Stats{
+		Sent:         c.stats.sent,
+		Received:     c.stats.received,
+		Requests:     make(map[string]MessageStats, len(c.stats.requests)),
+		Events:       make(map[string]MessageStats, len(c.stats.events)),
+		Objects:      make(map[string]int),
+		DefaultQueue: len(c.defaultQueue.events),
+		Queued:       c.stats.queued,
+	}
+	for k, s := range c.stats.requests {
+		ret.Requests[k.name(k.info.requests)] = *s
+	}
+	for k, s := range c.stats.events {
+		ret.Events[k.name(k.info.events)] = *s
+	}
+	for _, obj := range c.objects {
+		if isZombie(obj) {
+			ret.Zombies++
+		} else {
+			ret.Objects[obj.Interface()]++
+		}
+	}
+	return ret
+}
+
+// Publish the client's Stats via expvar, under the given name. Like
+// expvar.Publish, this panics if the name is already in use.
+func (c *Client) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return c.Stats()
+	}))
+}
@@ -0,0 +1,106 @@
+package wayland
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	client, server := newTestClient(t)
+	server.serveSync()
+
+	obj, err := client.GetRegistry().Bind(5, "wl_compositor", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compositor := obj.(*Compositor)
+	for i := 0; i < 2; i++ {
+		if _, err := compositor.CreateSurface(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	surface, err := compositor.CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := surface.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	obj, err = client.GetRegistry().Bind(6, "wl_shm", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.(*Shm).CreatePool(int(os.Stdin.Fd()), 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	// An event which stays queued, since nobody dispatches its queue:
+	q := client.NewQueue()
+	client.lock.Lock()
+	display := client.displayOnQueue(q)
+	client.lock.Unlock()
+	if _, err := display.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := client.Stats()
+	for name, want := range map[string]MessageStats{
+		// Header, plus 4 bytes for the new id:
+		"wl_compositor.create_surface": {Messages: 3, Bytes: 3 * 12},
+		"wl_surface.destroy":           {Messages: 1, Bytes: 8},
+		"wl_shm.create_pool":           {Messages: 1, Bytes: 16, Fds: 1},
+		"wl_display.sync":              {Messages: 2, Bytes: 2 * 12},
+	} {
+		if got := stats.Requests[name]; got != want {
+			t.Errorf("Got %+v for %s, expected %+v", got, name, want)
+		}
+	}
+	if got := stats.Events["wl_callback.done"]; got.Messages != 2 {
+		t.Errorf("Got %+v for wl_callback.done", got)
+	}
+	var sent, received MessageStats
+	for _, s := range stats.Requests {
+		sent.Messages += s.Messages
+		sent.Bytes += s.Bytes
+		sent.Fds += s.Fds
+	}
+	for _, s := range stats.Events {
+		received.Messages += s.Messages
+		received.Bytes += s.Bytes
+	}
+	if sent != stats.Sent || received != stats.Received {
+		t.Errorf("Totals %+v and %+v don't match the breakdown %+v and %+v",
+			stats.Sent, stats.Received, sent, received)
+	}
+	if stats.Objects["wl_surface"] != 2 || stats.Objects["wl_shm_pool"] != 1 || stats.Zombies != 1 {
+		t.Errorf("Bad object counts: %v, %d zombies", stats.Objects, stats.Zombies)
+	}
+	if stats.Queued != 1 || stats.DefaultQueue != 0 || q.Len() != 1 {
+		t.Errorf("Bad queue depths: %d, %d, %d", stats.Queued, stats.DefaultQueue, q.Len())
+	}
+	if err := q.DispatchPending(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := client.Stats(); stats.Queued != 0 {
+		t.Errorf("%d events queued after dispatching", stats.Queued)
+	}
+
+	// Names can't be reused, so make sure this one is unique if the test
+	// is run more than once:
+	name := fmt.Sprintf("wayland-stats-test-%p", client)
+	client.Publish(name)
+	var published Stats
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Requests["wl_surface.destroy"].Messages != 1 {
+		t.Errorf("Bad published stats: %+v", published)
+	}
+}
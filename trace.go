@@ -0,0 +1,300 @@
+package wayland
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing of protocol messages, like libwayland's WAYLAND_DEBUG.
+//
+// Each message sent or received is logged at debug level, with a message in
+// libwayland's format, e.g.:
+//
+//	-> wl_surface@7.attach(wl_buffer@12, 0, 0)
+//
+// for a request, and
+//
+//	wl_buffer@12.release()
+//
+// for an event.
+
+// Set the logger to which messages sent and received are traced, or, if
+// logger is nil, turn tracing off. Messages are logged at debug level, so
+// the logger's handler must be enabled for that level.
+//
+// Tracing is turned on automatically, with output to stderr, if the
+// WAYLAND_DEBUG environment variable is set to 1 or contains "client", as
+// with libwayland.
+func (c *Client) SetLogger(logger *slog.Logger) {
+	c.logger.Store(logger)
+}
+
+// Report whether the value of WAYLAND_DEBUG asks for tracing on the client
+// side.
+func debugEnabled(env string) bool {
+	return env == "1" || strings.Contains(env, "client")
+}
+
+// A message which has been formatted for tracing, but not yet logged.
+type tracedMessage struct {
+	logger *slog.Logger
+	msg    string
+}
+
+// Release c.lock, then log the messages traced while it was held. Logging
+// happens after unlocking so that slow handlers don't stall the client, and
+// so that handlers may call back into it, e.g. for Stats.
+func (c *Client) unlock() {
+	traced := c.traced
+	c.traced = nil
+	c.lock.Unlock()
+	for _, t := range traced {
+		t.logger.Debug(t.msg)
+	}
+}
+
+// Trace a request. data is the whole message, header included. c.lock must
+// be held; the message is logged by c.unlock.
+func (c *Client) traceRequest(logger *slog.Logger, data []byte, fds []int) {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	var hdr header
+	hdr.ReadFrom(bytes.NewReader(data[:8]))
+	obj, ok := c.objects[hdr.Sender]
+	if !ok {
+		return
+	}
+	info, ok := interfaceRegistry[obj.Interface()]
+	if !ok || int(hdr.Opcode) >= len(info.requests) {
+		return
+	}
+	c.traced = append(c.traced, tracedMessage{logger,
+		c.formatMessage("-> ", info.name, hdr.Sender, &info.requests[hdr.Opcode], data[8:], fds, nil)})
+}
+
+// Trace an event. data is the message body. c.lock must be held; the message
+// is logged by c.unlock.
+func (c *Client) traceEvent(logger *slog.Logger, sender remoteProxy, opcode uint16, data []byte, fds []int) {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	info, ok := interfaceRegistry[sender.Interface()]
+	if !ok || int(opcode) >= len(info.events) {
+		return
+	}
+	prefix := ""
+	if isZombie(sender) {
+		prefix = "discarded "
+	}
+	c.traced = append(c.traced, tracedMessage{logger,
+		c.formatMessage(prefix, info.name, sender.Id(), &info.events[opcode], data, fds, nil)})
+}
+
+// Format a message sent by iface@sender like libwayland does. c.lock must be
+// held.
+func (c *Client) formatMessage(prefix, iface string, sender ObjectId, msg *messageInfo, data []byte, fds []int, objs []string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString(iface)
+	b.WriteByte('@')
+	b.WriteString(strconv.FormatUint(uint64(sender), 10))
+	b.WriteByte('.')
+	b.WriteString(msg.name)
+	b.WriteByte('(')
+	offset := 0
+	for i, arg := range msg.args {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if !c.formatArg(&b, arg, data, &offset, &fds, &objs) {
+			b.WriteString("<truncated>")
+			break
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// Format the argument at *offset in data, advancing the offset (and
+// consuming an fd, for fd arguments). For object arguments, the object's
+// interface is taken from *objs, if it isn't empty, and otherwise looked up
+// in c.objects. Returns false if the message is too short.
+func (c *Client) formatArg(b *strings.Builder, arg argInfo, data []byte, offset *int, fds *[]int, objs *[]string) bool {
+	switch arg.type_ {
+	case "fd":
+		if len(*fds) == 0 {
+			b.WriteString("fd <missing>")
+			return true
+		}
+		b.WriteString("fd ")
+		b.WriteString(strconv.Itoa((*fds)[0]))
+		*fds = (*fds)[1:]
+	case "int":
+		v, err := read_int(offset, data)
+		if err != nil {
+			return false
+		}
+		b.WriteString(strconv.FormatInt(int64(v), 10))
+	case "uint":
+		v, err := read_uint(offset, data)
+		if err != nil {
+			return false
+		}
+		b.WriteString(strconv.FormatUint(uint64(v), 10))
+	case "fixed":
+		v, err := read_fixed(offset, data)
+		if err != nil {
+			return false
+		}
+		b.WriteString(strconv.FormatFloat(v.Float64(), 'f', 6, 64))
+	case "string":
+		size, err := readU32(offset, data)
+		if err != nil {
+			return false
+		}
+		if size == 0 {
+			b.WriteString("nil")
+			return true
+		}
+		*offset -= 4
+		s, err := read_string(offset, data)
+		if err != nil {
+			return false
+		}
+		b.WriteString(strconv.Quote(s))
+	case "array":
+		size, err := readU32(offset, data)
+		if err != nil {
+			return false
+		}
+		*offset += ceil32(int(size))
+		b.WriteString("array[")
+		b.WriteString(strconv.FormatUint(uint64(size), 10))
+		b.WriteByte(']')
+	case "object":
+		id, err := readU32(offset, data)
+		if err != nil {
+			return false
+		}
+		if len(*objs) == 0 {
+			c.formatObject(b, ObjectId(id), arg.interface_)
+			return true
+		}
+		iface := (*objs)[0]
+		*objs = (*objs)[1:]
+		if iface == "" {
+			iface = arg.interface_
+		}
+		writeObject(b, ObjectId(id), iface)
+	case "new_id":
+		iface := arg.interface_
+		if iface == "" {
+			// Generic new_ids, i.e. in wl_registry.bind, are sent
+			// with the interface name and version, which libwayland
+			// shows as separate arguments.
+			s, err := read_string(offset, data)
+			if err != nil {
+				return false
+			}
+			version, err := read_uint(offset, data)
+			if err != nil {
+				return false
+			}
+			b.WriteString(strconv.Quote(s))
+			b.WriteString(", ")
+			b.WriteString(strconv.FormatUint(uint64(version), 10))
+			b.WriteString(", ")
+			iface = s
+		}
+		id, err := read_new_id(offset, data)
+		if err != nil {
+			return false
+		}
+		if id == 0 {
+			b.WriteString("nil")
+			return true
+		}
+		b.WriteString("new id ")
+		c.formatObject(b, id, iface)
+	default:
+		*offset += 4
+		b.WriteByte('?')
+	}
+	return true
+}
+
+// Format a reference to an object, as interface@id, or nil for a null
+// object. iface is used if the object isn't one we know about. c.lock must be
+// held.
+func (c *Client) formatObject(b *strings.Builder, id ObjectId, iface string) {
+	if obj, ok := c.objects[id]; ok {
+		iface = obj.Interface()
+	}
+	writeObject(b, id, iface)
+}
+
+// Format a reference to an object with the given interface, as for
+// formatObject, but without looking the object up.
+func writeObject(b *strings.Builder, id ObjectId, iface string) {
+	if id == 0 {
+		b.WriteString("nil")
+		return
+	}
+	if iface == "" {
+		iface = "[unknown]"
+	}
+	b.WriteString(iface)
+	b.WriteByte('@')
+	b.WriteString(strconv.FormatUint(uint64(id), 10))
+}
+
+// A slog.Handler which writes messages as libwayland does for WAYLAND_DEBUG:
+// each message on its own line, preceded by a timestamp in milliseconds, and
+// without attributes.
+type debugHandler struct {
+	lock *sync.Mutex
+	w    io.Writer
+}
+
+func newDebugHandler(w io.Writer) *debugHandler {
+	return &debugHandler{lock: &sync.Mutex{}, w: w}
+}
+
+func (h *debugHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *debugHandler) Handle(_ context.Context, r slog.Record) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, err := io.WriteString(h.w, debugTimestamp(r.Time)+r.Message+"\n")
+	return err
+}
+
+func (h *debugHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *debugHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// Format t as libwayland does: milliseconds (wrapping around at 2^32) and
+// microseconds, since the epoch.
+func debugTimestamp(t time.Time) string {
+	us := t.UnixNano() / 1000
+	ms := uint32(us / 1000)
+	frac := strconv.Itoa(int(us % 1000))
+	ret := strconv.FormatUint(uint64(ms), 10)
+	if len(ret) < 7 {
+		ret = strings.Repeat(" ", 7-len(ret)) + ret
+	}
+	return "[" + ret + "." + strings.Repeat("0", 3-len(frac)) + frac + "] "
+}
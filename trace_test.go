@@ -0,0 +1,183 @@
+package wayland
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A slog.Handler which records the messages of debug records.
+type recordingHandler struct {
+	lock     sync.Mutex
+	level    slog.Level
+	messages []string
+}
+
+func (h *recordingHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.messages = append(h.messages, r.Message)
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler      { return h }
+
+func (h *recordingHandler) take() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ret := h.messages
+	h.messages = nil
+	return ret
+}
+
+func TestTrace(t *testing.T) {
+	client, server := newTestClient(t)
+	h := &recordingHandler{level: slog.LevelDebug}
+	client.SetLogger(slog.New(h))
+	server.serveSync()
+
+	obj, err := client.GetRegistry().Bind(5, "wl_compositor", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	surface, err := obj.(*Compositor).CreateSurface()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := surface.Attach(nil, 1, -2); err != nil {
+		t.Fatal(err)
+	}
+	obj, err = client.GetRegistry().Bind(6, "wl_shm", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := obj.(*Shm).CreatePool(int(os.Stdin.Fd()), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	server.sendEvent(2, 0, uint32(7), "wl_output", uint32(3))
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`-> wl_registry@2.bind(5, "wl_compositor", 4, new id wl_compositor@3)`,
+		`-> wl_compositor@3.create_surface(new id wl_surface@4)`,
+		`-> wl_surface@4.attach(nil, 1, -2)`,
+		`-> wl_registry@2.bind(6, "wl_shm", 1, new id wl_shm@5)`,
+		`-> wl_shm@5.create_pool(new id wl_shm_pool@6, fd 0, 4096)`,
+		`-> wl_shm_pool@6.destroy()`,
+		`-> wl_display@1.sync(new id wl_callback@7)`,
+		`wl_registry@2.global(7, "wl_output", 3)`,
+		`wl_callback@7.done(0)`,
+		`wl_display@1.delete_id(7)`,
+	}
+	if got := h.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got trace:\n%q\nexpected:\n%q", got, want)
+	}
+
+	// Turning tracing off:
+	client.SetLogger(nil)
+	if err := client.Roundtrip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.take(); len(got) != 0 {
+		t.Errorf("Traced %q after SetLogger(nil)", got)
+	}
+}
+
+// A slog.Handler which calls back into the client.
+type statsHandler struct {
+	recordingHandler
+	client *Client
+}
+
+func (h *statsHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.client.Stats()
+	return h.recordingHandler.Handle(ctx, r)
+}
+
+// Messages should be logged without the client's lock held, so handlers can
+// use the client.
+func TestTraceReentrant(t *testing.T) {
+	client, server := newTestClient(t)
+	h := &statsHandler{recordingHandler{level: slog.LevelDebug}, client}
+	client.SetLogger(slog.New(h))
+	server.serveSync()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Roundtrip(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Roundtrip deadlocked")
+	}
+	want := []string{
+		`-> wl_display@1.sync(new id wl_callback@3)`,
+		`wl_callback@3.done(0)`,
+		`wl_display@1.delete_id(3)`,
+	}
+	if got := h.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got trace:\n%q\nexpected:\n%q", got, want)
+	}
+}
+
+// A transport which discards what it's sent.
+type discardTransport struct {
+	Transport
+}
+
+func (discardTransport) Send(data []byte, fds []int) error {
+	return nil
+}
+
+// Tracing shouldn't cost anything when it's off, or the logger isn't enabled
+// for debug messages.
+func TestTraceDisabledAllocs(t *testing.T) {
+	c := newClient(discardTransport{})
+	msg := []byte{1, 0, 0, 0, 0, 0, 12, 0, 2, 0, 0, 0} // wl_display@1.sync(2)
+	send := func() {
+		c.lock.Lock()
+		defer c.unlock()
+		c.send(msg, nil)
+	}
+	for _, logger := range []*slog.Logger{nil, slog.New(&recordingHandler{level: slog.LevelInfo})} {
+		c.SetLogger(logger)
+		if n := testing.AllocsPerRun(100, send); n != 0 {
+			t.Errorf("With logger %v: %v allocations per send", logger, n)
+		}
+	}
+}
+
+func TestDebugFormat(t *testing.T) {
+	ts := time.Unix(0, 0).Add(1234*time.Millisecond + 56*time.Microsecond)
+	if got := debugTimestamp(ts); got != "[   1234.056] " {
+		t.Errorf("Got timestamp %q", got)
+	}
+	for env, want := range map[string]bool{
+		"":       false,
+		"0":      false,
+		"1":      true,
+		"client": true,
+		"server": false,
+	} {
+		if debugEnabled(env) != want {
+			t.Errorf("debugEnabled(%q) = %v", env, !want)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package wayland
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// The maximum number of file descriptors we will accept in a single call to
+// Transport.Recv. This matches libwayland's limit on the number of fds sent
+// in one sendmsg().
+const maxFdsPerRecv = 28
+
+var (
+	ErrTransportClosed = errors.New("Transport is closed")
+	ErrWouldBlock      = errors.New("Operation would block")
+)
+
+// A Transport carries wayland messages and file descriptors between the two
+// sides of a connection.
+//
+// Transports are stream oriented: message boundaries are not preserved, except
+// that file descriptors passed to Send must arrive no later than the first byte
+// of the accompanying data.
+type Transport interface {
+	// Send the data and file descriptors over the transport. len(data) must
+	// not be 0. The transport does not take ownership of fds; the caller may
+	// close them once Send returns.
+	Send(data []byte, fds []int) error
+
+	// Read data and file descriptors from the transport, blocking until at
+	// least some data is available. `n` indicates the number of bytes that
+	// were read, and `fdn` indicates the number of file descriptors that
+	// were read. The caller owns the received file descriptors.
+	//
+	// Returns io.EOF once the other side has closed the transport and all
+	// data has been read.
+	Recv(data []byte, fds []int) (n, fdn int, err error)
+
+	// Close the transport. Any file descriptors which have been sent to us
+	// but not yet received are closed.
+	Close() error
+}
+
+// A PollableTransport is a Transport which can be driven by an external event
+// loop.
+type PollableTransport interface {
+	Transport
+
+	// Return a file descriptor which polls as readable whenever Recv would
+	// not block, or -1 if one cannot be provided. The transport retains
+	// ownership of the file descriptor.
+	Fd() int
+
+	// Like Recv, except that it never blocks; if no data is available it
+	// returns ErrWouldBlock.
+	TryRecv(data []byte, fds []int) (n, fdn int, err error)
+}
+
+// Return a Transport which communicates over the unix domain socket conn. The
+// returned transport is also a PollableTransport.
+func NewUnixTransport(conn *net.UnixConn) Transport {
+	return &unixTransport{conn: conn}
+}
+
+type unixTransport struct {
+	conn *net.UnixConn
+}
+
+func (t *unixTransport) Send(data []byte, fds []int) error {
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+	_, _, err := t.conn.WriteMsgUnix(data, oob, nil)
+	return err
+}
+
+func (t *unixTransport) Recv(data []byte, fds []int) (n, fdn int, err error) {
+	oob := make([]byte, unix.CmsgSpace(len(fds)*4))
+	n, oobn, _, _, errRead := t.conn.ReadMsgUnix(data, oob)
+	if errRead != nil {
+		// Nothing was received; in particular, reads from a closed
+		// connection report -1 bytes, which callers can't slice with.
+		n, oobn = 0, 0
+	}
+	fdn, errParse := parseRights(oob[:oobn], fds)
+	if errRead == nil {
+		errRead = errParse
+	}
+	if n == 0 && errRead == nil && len(data) > 0 {
+		errRead = io.EOF
+	}
+	return n, fdn, errRead
+}
+
+func (t *unixTransport) TryRecv(data []byte, fds []int) (n, fdn int, err error) {
+	raw, err := t.conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	oob := make([]byte, unix.CmsgSpace(len(fds)*4))
+	var (
+		oobn    int
+		errRecv error
+	)
+	err = raw.Read(func(fd uintptr) bool {
+		n, oobn, _, _, errRecv = unix.Recvmsg(int(fd), data, oob,
+			unix.MSG_DONTWAIT|unix.MSG_CMSG_CLOEXEC)
+		// Only ever make one attempt, rather than waiting for the
+		// socket to become readable:
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	// Like Recv, report nothing received on errors, rather than passing
+	// on Recvmsg's -1 lengths.
+	if errRecv == unix.EAGAIN {
+		return 0, 0, ErrWouldBlock
+	} else if errRecv != nil {
+		return 0, 0, errRecv
+	}
+	fdn, err = parseRights(oob[:oobn], fds)
+	if n == 0 && err == nil && len(data) > 0 {
+		err = io.EOF
+	}
+	return n, fdn, err
+}
+
+// Extract the file descriptors from the socket control messages in oob,
+// copying them into fds and returning the number received.
+func parseRights(oob []byte, fds []int) (fdn int, err error) {
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, err
+	}
+
+	fdsRecv := []int{}
+	for _, cmsg := range cmsgs {
+		msgFds, err := unix.ParseUnixRights(&cmsg)
+		if err != nil {
+			closeAll(fdsRecv)
+			return 0, err
+		}
+		fdsRecv = append(fdsRecv, msgFds...)
+	}
+	if len(fdsRecv) > len(fds) {
+		// This should never happen; we allocated a buffer that was
+		// suposed to be the right size for len(fds) file descriptors,
+		// and no more.
+		panic("impossible")
+	}
+	return copy(fds, fdsRecv), nil
+}
+
+func (t *unixTransport) Fd() int {
+	raw, err := t.conn.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	ret := -1
+	raw.Control(func(fd uintptr) {
+		ret = int(fd)
+	})
+	return ret
+}
+
+func (t *unixTransport) Close() error {
+	return t.conn.Close()
+}
+
+// Return a pair of connected, in-process Transports. Data sent on one is
+// received on the other. File descriptors are passed by dup()ing them, so
+// they behave as they would when sent over a unix domain socket: the sender
+// and receiver each own their copy.
+//
+// The returned transports are also PollableTransports; their file descriptors
+// are eventfds, which are created the first time Fd is called.
+func Pipe() (Transport, Transport) {
+	ab := newPipeBuffer()
+	ba := newPipeBuffer()
+	return &pipeTransport{in: ba, out: ab}, &pipeTransport{in: ab, out: ba}
+}
+
+// One direction of a Pipe.
+type pipeBuffer struct {
+	lock   sync.Mutex
+	cond   sync.Cond
+	data   []byte
+	fds    []int
+	closed bool
+
+	// Set when the receiving end has been closed.
+	discarded bool
+
+	// An eventfd which is readable whenever the buffer is, or -1 if it has
+	// not been created yet. signaled indicates whether its counter is
+	// currently non-zero.
+	efd      int
+	signaled bool
+}
+
+func newPipeBuffer() *pipeBuffer {
+	ret := &pipeBuffer{efd: -1}
+	ret.cond.L = &ret.lock
+	return ret
+}
+
+// Update the state of the eventfd, if any, to reflect whether the buffer is
+// readable. b.lock must be held.
+func (b *pipeBuffer) updateSignal() {
+	if b.efd < 0 {
+		return
+	}
+	readable := len(b.data) > 0 || b.closed
+	var buf [8]byte
+	if readable && !b.signaled {
+		hostEndian.PutUint64(buf[:], 1)
+		unix.Write(b.efd, buf[:])
+	} else if !readable && b.signaled {
+		unix.Read(b.efd, buf[:])
+	}
+	b.signaled = readable
+}
+
+// Mark the buffer as closed, waking up any blocked readers. If discard is true,
+// also close any file descriptors which have not been read.
+func (b *pipeBuffer) close(discard bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	if discard {
+		b.discarded = true
+		closeAll(b.fds)
+		b.fds = nil
+		b.data = nil
+		if b.efd >= 0 {
+			unix.Close(b.efd)
+			b.efd = -1
+		}
+	}
+	b.updateSignal()
+	b.cond.Broadcast()
+}
+
+type pipeTransport struct {
+	in, out *pipeBuffer
+}
+
+func (t *pipeTransport) Send(data []byte, fds []int) error {
+	dups, err := dupAll(fds)
+	if err != nil {
+		return err
+	}
+
+	b := t.out
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		closeAll(dups)
+		return ErrTransportClosed
+	}
+	b.data = append(b.data, data...)
+	b.fds = append(b.fds, dups...)
+	b.updateSignal()
+	b.cond.Broadcast()
+	return nil
+}
+
+func (t *pipeTransport) Recv(data []byte, fds []int) (n, fdn int, err error) {
+	b := t.in
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for len(b.data) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	return b.recv(data, fds)
+}
+
+func (t *pipeTransport) TryRecv(data []byte, fds []int) (n, fdn int, err error) {
+	b := t.in
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.data) == 0 && !b.closed {
+		return 0, 0, ErrWouldBlock
+	}
+	return b.recv(data, fds)
+}
+
+// Copy out as much data and as many fds as will fit. b.lock must be held.
+func (b *pipeBuffer) recv(data []byte, fds []int) (n, fdn int, err error) {
+	fdn = copy(fds, b.fds)
+	b.fds = b.fds[fdn:]
+	n = copy(data, b.data)
+	b.data = b.data[n:]
+	b.updateSignal()
+	if n == 0 && len(data) > 0 {
+		err = io.EOF
+	}
+	return n, fdn, err
+}
+
+func (t *pipeTransport) Fd() int {
+	b := t.in
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.efd < 0 && !b.discarded {
+		efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+		if err != nil {
+			return -1
+		}
+		b.efd = efd
+		b.signaled = false
+		b.updateSignal()
+	}
+	return b.efd
+}
+
+func (t *pipeTransport) Close() error {
+	t.out.close(false)
+	t.in.close(true)
+	return nil
+}
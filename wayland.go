@@ -3,12 +3,17 @@ package wayland
 //go:generate go run internal/gen/main.go
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"golang.org/x/sys/unix"
 	"io"
+	"log/slog"
+	"math"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 // A side of the connection (server or client).
@@ -23,6 +28,15 @@ type Fixed struct {
 	value uint32
 }
 
+// Convert a float64 to a Fixed, rounding to the nearest representable value.
+func FixedFromFloat64(v float64) Fixed {
+	return Fixed{value: uint32(int32(math.Round(v * 256)))}
+}
+
+func (f Fixed) Float64() float64 {
+	return float64(int32(f.value)) / 256
+}
+
 type ObjectId uint32
 
 func (o ObjectId) Id() ObjectId {
@@ -56,15 +70,43 @@ type ServerError struct {
 	ObjectId  ObjectId
 	ErrorCode uint32
 	Message   string
+
+	// The interface and version of the object the error was for. If the
+	// client doesn't know about the object, these are "" and 0.
+	Interface string
+	Version   uint32
+
+	// The most recent messages (out of the last few hundred sent or
+	// received) involving the object, oldest first, formatted as for
+	// tracing (see Client.SetLogger). For errors reported against the
+	// display which name another object, such as "invalid object 42",
+	// these are the messages involving that object instead.
+	Recent []string
 }
 
 func (e *ServerError) Error() string {
 	return fmt.Sprintf(
-		"Server error: %q (object id = %d, error code = %d)",
-		e.Message, e.ObjectId, e.ErrorCode,
+		"Server error: %q (object = %s@%d, error code = %d)",
+		e.Message, e.Interface, e.ObjectId, e.ErrorCode,
 	)
 }
 
+// Return the error code as a value of the interface's error type (e.g.
+// ShmError for wl_shm), so that errors.Is and errors.As may be used to
+// examine it. Returns nil if the interface is unknown or does not define any
+// error codes.
+//
+// Note that libwayland-based servers report requests with invalid opcodes
+// using DisplayErrorInvalidMethod, but against the object the request was
+// sent to; such errors will be interpreted using that object's error type.
+func (e *ServerError) Unwrap() error {
+	toError, ok := errorRegistry[e.Interface]
+	if !ok {
+		return nil
+	}
+	return toError(e.ErrorCode)
+}
+
 type UnknownInterface struct {
 	id         ObjectId
 	interface_ string
@@ -106,32 +148,96 @@ func (h *header) ReadFrom(r io.Reader) (int64, error) {
 	return int64(n), nil
 }
 
+// A Client is a connection to a wayland compositor.
+//
+// Clients are safe for concurrent use: requests may be sent on any object
+// from any goroutine. Messages from the server are read by a dedicated
+// goroutine, which is started the first time a queue is dispatched. It sorts
+// incoming events into event queues (see EventQueue), and each queue is
+// dispatched by whichever goroutine calls its Dispatch methods. Events
+// for the display itself (errors and id deletion) are handled directly by
+// the reader. Alternatively, the client can be driven by an external event
+// loop, without a reader goroutine; see PrepareRead.
+//
+// Event handlers may be installed from any goroutine, but note that an event
+// may be dispatched before the handler for it is installed, if its queue is
+// being dispatched concurrently. To avoid this, install handlers for an object
+// from the goroutine which dispatches its queue, or before anything
+// dispatches that queue.
 type Client struct {
-	lock    sync.Mutex
-	socket  *net.UnixConn
-	nextId  uint32
-	objects map[ObjectId]remoteProxy
+	// Guards everything below which is not documented otherwise, as well
+	// as the state of the objects belonging to the client. It is also held
+	// while sending a message, so that ids are allocated in the order in
+	// which they appear on the wire.
+	lock      sync.Mutex
+	transport Transport
+	ids       idAllocator
+	objects   map[ObjectId]remoteProxy
+
+	// Data and file descriptors which have been received, but not yet
+	// consumed by a message. Only accessed by the reader.
+	inData []byte
+	inFds  []int
+
+	// How messages are read from the transport; see poll.go.
+	readMode readMode
+
+	// When the connection fails, either because reading from it failed or
+	// because the server sent a protocol error, err is set to the error and
+	// failed is closed.
+	failed chan struct{}
+	err    error
+
+	// Where to trace messages to, if anywhere; see SetLogger. Accessed
+	// atomically, so that checking it costs next to nothing.
+	logger atomic.Pointer[slog.Logger]
+
+	// Messages traced while lock was held, which unlock will log.
+	traced []tracedMessage
+
+	// See Stats.
+	stats clientStats
+
+	// Recent messages, for ServerError.Recent; see history.go.
+	history history
+
+	// Coordination between goroutines using PrepareRead and ReadEvents.
+	// readers is the number of goroutines which have called PrepareRead,
+	// but not yet ReadEvents or CancelRead, and readSerial is incremented
+	// after each read. readCond uses lock.
+	readers    int
+	readSerial uint64
+	readCond   sync.Cond
+
+	defaultQueue *EventQueue
 
 	display  *Display
 	registry *Registry
+	globals  *Globals
 	onGlobal func(obj Object)
-
-	// An error received from the server's Display object. if this is set,
-	// the next iteration in MainLoop will exit, returning it.
-	receivedError error
 }
 
-func newClient(uconn *net.UnixConn) *Client {
+func newClient(transport Transport) *Client {
 	ret := &Client{
-		socket: uconn,
-		nextId: 2,
+		transport: transport,
+		ids:       idAllocator{next: 2},
+		failed:    make(chan struct{}),
 	}
-	ret.objects = map[ObjectId]remoteProxy{1: &Display{
+	ret.readCond.L = &ret.lock
+	ret.defaultQueue = ret.NewQueue()
+	ret.display = &Display{
 		remoteObject: remoteObject{
-			id:   1,
-			conn: ret,
+			id:      1,
+			conn:    ret,
+			version: 1,
 		},
-	}}
+	}
+	ret.objects = map[ObjectId]remoteProxy{1: ret.display}
+	ret.stats.requests = make(map[messageKey]*MessageStats)
+	ret.stats.events = make(map[messageKey]*MessageStats)
+	if debugEnabled(os.Getenv("WAYLAND_DEBUG")) {
+		ret.logger.Store(slog.New(newDebugHandler(os.Stderr)))
+	}
 	return ret
 }
 
@@ -151,50 +257,59 @@ func Dial(path string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	client := newClient(uconn)
-	client.display = &Display{
-		remoteObject: remoteObject{
-			id:   1,
-			conn: client,
-		},
-	}
-	client.display.OnError(func(oid ObjectId, code uint32, message string) {
-		client.receivedError = &ServerError{
+	return NewClient(NewUnixTransport(uconn))
+}
+
+// Create a client which speaks the wayland protocol over the given transport.
+// The client takes ownership of the transport.
+func NewClient(transport Transport) (*Client, error) {
+	client := newClient(transport)
+	client.display.AddErrorListener(func(oid ObjectId, code uint32, message string) {
+		err := &ServerError{
 			ObjectId:  oid,
 			ErrorCode: code,
 			Message:   message,
 		}
+		client.lock.Lock()
+		if obj, ok := client.objects[oid]; ok {
+			err.Interface = obj.Interface()
+			err.Version = obj.Version()
+		}
+		err.Recent = client.recentMessages(errorSubject(oid, message))
+		client.lock.Unlock()
+		client.fail(err)
 	})
-	client.display.OnDeleteId(func(id uint32) {
-		delete(client.objects, ObjectId(id))
-		// TODO: we probably need to do some bookkeeping to coordinate
-		// with nextId().
+	client.display.AddDeleteIdListener(func(id uint32) {
+		client.deleteId(ObjectId(id))
 	})
+	var err error
 	client.registry, err = client.display.GetRegistry()
 	if err != nil {
-		uconn.Close()
+		transport.Close()
 		return nil, err
 	}
-	client.registry.OnGlobal(func(name uint32, interface_ string, version uint32) {
-		if client.onGlobal == nil {
+	client.globals = newGlobals(client)
+	client.registry.AddGlobalListener(func(name uint32, interface_ string, version uint32) {
+		client.globals.add(Global{
+			Name:      name,
+			Interface: interface_,
+			Version:   version,
+		})
+		client.lock.Lock()
+		onGlobal := client.onGlobal
+		client.lock.Unlock()
+		if onGlobal == nil {
 			return
 		}
-		ifaceFn, ok := interfaceRegistry[interfaceIdent{
-			Name:    interface_,
-			Version: version,
-		}]
-		if ok {
-			id, err := client.registry.Bind(name)
+		if _, ok := interfaceRegistry[interface_]; ok {
+			obj, err := client.globals.BindGlobal(name, 0)
 			if err != nil {
-				//TODO: better error handling.
-				client.receivedError = err
+				client.fail(err)
 				return
 			}
-			obj := ifaceFn(client, id)
-			client.objects[id] = obj
-			client.onGlobal(obj)
+			onGlobal(obj)
 		} else {
-			client.onGlobal(&UnknownInterface{
+			onGlobal(&UnknownInterface{
 				// We don't call Bind, so this has a null id:
 				id: 0,
 
@@ -203,9 +318,30 @@ func Dial(path string) (*Client, error) {
 			})
 		}
 	})
+	client.registry.AddGlobalRemoveListener(func(name uint32) {
+		client.globals.remove(name)
+	})
 	return client, nil
 }
 
+// Block until the server has processed all requests sent so far, dispatching
+// the default queue in the meantime. See EventQueue.Roundtrip.
+func (c *Client) Roundtrip(ctx context.Context) error {
+	return c.defaultQueue.Roundtrip(ctx)
+}
+
+// Return a proxy for the display, whose children will be assigned to q.
+func (c *Client) displayOnQueue(q *EventQueue) *Display {
+	return &Display{
+		remoteObject: remoteObject{
+			id:      1,
+			conn:    c,
+			queue:   q,
+			version: 1,
+		},
+	}
+}
+
 func (c *Client) Sync(fn func()) error {
 	cb, err := c.display.Sync()
 	if err != nil {
@@ -215,6 +351,11 @@ func (c *Client) Sync(fn func()) error {
 	return nil
 }
 
+// Close the connection.
+func (c *Client) Close() error {
+	return c.transport.Close()
+}
+
 func (c *Client) GetDisplay() *Display {
 	return c.display
 }
@@ -223,11 +364,22 @@ func (c *Client) GetRegistry() *Registry {
 	return c.registry
 }
 
-// Send the data and file descriptors over the connection's socket. len(data)
-// must not be 0.
+// Send the data and file descriptors over the connection's transport.
+// len(data) must not be 0. c.lock must be held, and released with c.unlock,
+// so that the message is traced.
 func (c *Client) send(data []byte, fds []int) error {
-	_, _, err := c.socket.WriteMsgUnix(data, unix.UnixRights(fds...), nil)
-	return err
+	if logger := c.logger.Load(); logger != nil {
+		c.traceRequest(logger, data, fds)
+	}
+	c.stats.sent.add(len(data), len(fds))
+	sender := ObjectId(hostEndian.Uint32(data[0:4]))
+	if obj, ok := c.objects[sender]; ok {
+		opcode := uint16(hostEndian.Uint32(data[4:8]))
+		c.countMessage(c.stats.requests, obj, opcode, len(data), len(fds))
+		c.recordMessage(obj, true, opcode, data[8:], fds)
+		c.recordOrigins(obj, opcode, data)
+	}
+	return c.transport.Send(data, fds)
 }
 
 func closeAll(fds []int) {
@@ -236,122 +388,251 @@ func closeAll(fds []int) {
 	}
 }
 
-// Read data and file descriptors from the connection. `n` indicates the number
-// of bytes that were read, and `fdn` indicates the number of file descriptors
-// that were read.
-func (c *Client) recv(data []byte, fds []int) (n, fdn int, err error) {
-	oob := make([]byte, unix.CmsgSpace(len(fds)*4))
-	n, oobn, _, _, errRead := c.socket.ReadMsgUnix(data, oob)
-
-	// Keep going, even if errRead != nil. This is designed to deal with the
-	// situation where we've gotten a short read, receiving some file descriptors
-	// in spite of the error.  We should close the fds in this case, to avoid
-	// leaking them. We rely on ReadMsgUnix to correctly report the lengths,
-	// so if there is a short read that results in an invalid message, it won't
-	// parse.
-	//
-	// TODO: I(zenhack) am not sure the above can actually happen; it would
-	// be nice to investigate and, if safe, simplify this.
-	firstErr := func(e1, e2 error) error {
-		if e1 != nil {
-			return e1
-		}
-		return e2
+// Read more data from the transport into the client's input buffers. If block
+// is false, returns ErrWouldBlock rather than waiting for data.
+func (c *Client) fill(block bool) error {
+	var (
+		data [4096]byte
+		fds  [maxFdsPerRecv]int
+
+		n, fdn int
+		err    error
+	)
+	if block {
+		n, fdn, err = c.transport.Recv(data[:], fds[:])
+	} else if pt, ok := c.transport.(PollableTransport); ok {
+		n, fdn, err = pt.TryRecv(data[:], fds[:])
+	} else {
+		return ErrNotPollable
 	}
+	c.inData = append(c.inData, data[:n]...)
+	c.inFds = append(c.inFds, fds[:fdn]...)
+	if n > 0 || fdn > 0 {
+		// Don't report errors (most importantly EOF) until we've
+		// consumed whatever we were able to read.
+		return nil
+	}
+	return err
+}
 
-	cmsgs, errParse := unix.ParseSocketControlMessage(oob[:oobn])
-	if errParse != nil {
-		return n, 0, firstErr(errRead, errParse)
+// Start the reader goroutine, if it is not already running and the client is
+// not being driven by an external event loop. Returns the client's read mode.
+func (c *Client) startReader() readMode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.readMode == readModeUnset {
+		c.readMode = readModeGoroutine
+		go c.readLoop()
 	}
+	return c.readMode
+}
 
-	fdsRecv := []int{}
-	for _, cmsg := range cmsgs {
-		msgFds, errParse := unix.ParseUnixRights(&cmsg)
-		if errParse != nil {
-			closeAll(fdsRecv)
-			return n, 0, firstErr(errRead, errParse)
+func (c *Client) readLoop() {
+	for {
+		if err := c.readAvailable(true); err != nil {
+			c.fail(err)
+			return
 		}
-		fdsRecv = append(fdsRecv, msgFds...)
 	}
-	fdn = len(fdsRecv)
-	if len(fdsRecv) > len(fds) {
-		// This should never happen; we allocated a buffer that was
-		// suposed to be the right size for len(fds) file descriptors,
-		// and no more.
-		panic("impossible")
+}
+
+// Record the error which caused the connection to fail. Only the first such
+// error is kept.
+func (c *Client) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.failed)
+		// Wake up goroutines waiting in ReadEvents for a read which
+		// may now never happen:
+		c.readCond.Broadcast()
 	}
-	copy(fds[:fdn], fdsRecv)
-	return n, fdn, nil
 }
 
-func (c *Client) nextMsg() error {
-	hdr := header{}
-	_, err := (&hdr).ReadFrom(c.socket)
-	if err != nil {
-		return err
+// Read from the connection and handle any complete messages. If block is
+// true, wait until at least one message has been handled. Otherwise, only read
+// what is immediately available.
+func (c *Client) readAvailable(block bool) error {
+	handled := false
+	for {
+		ok, err := c.readMsg()
+		if err != nil {
+			return err
+		}
+		if ok {
+			handled = true
+			continue
+		}
+		if block && handled {
+			return nil
+		}
+		err = c.fill(block)
+		if err == ErrWouldBlock {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Handle the next message in the input buffer, if it has been received in full.
+// Events for the display and for zombies are handled immediately, while others
+// are added to the appropriate queue. Returns false if there was no complete
+// message.
+func (c *Client) readMsg() (bool, error) {
+	if len(c.inData) < 8 {
+		return false, nil
 	}
+	hdr := header{}
+	(&hdr).ReadFrom(bytes.NewReader(c.inData[:8]))
 	if hdr.Size < 8 {
-		return fmt.Errorf("Received message's header specifies a "+
+		return false, fmt.Errorf("Received message's header specifies a "+
 			"size (%d) that is too small (minmum is 8)", hdr.Size)
 	}
+	if len(c.inData) < int(hdr.Size) {
+		return false, nil
+	}
+	c.lock.Lock()
 	sender, ok := c.objects[hdr.Sender]
+	c.lock.Unlock()
 	if !ok {
-		return fmt.Errorf("Unknown object id: %d\n", hdr.Sender)
+		return false, fmt.Errorf("Unknown object id: %d\n", hdr.Sender)
 	}
 	events := sender.getFdCounts().events
 	if len(events) <= int(hdr.Opcode) {
-		return fmt.Errorf("Opcode %d for object %d is out of range",
+		return false, fmt.Errorf("Opcode %d for object %d is out of range",
 			hdr.Opcode, hdr.Sender)
 	}
-	fds := make([]int, events[hdr.Opcode])
+	nfds := events[hdr.Opcode]
+	if len(c.inFds) < nfds {
+		// The fds are sent along with the first byte of the message, so
+		// if we have the whole message they should be here by now.
+		return false, fmt.Errorf("Missing file descriptors for message "+
+			"(opcode %d, object %d)", hdr.Opcode, hdr.Sender)
+	}
 	data := make([]byte, hdr.Size-8)
-	n, nfds, err := c.recv(data, fds)
-	if err != nil {
-		closeAll(fds[:nfds])
-		return err
+	copy(data, c.inData[8:hdr.Size])
+	c.inData = c.inData[hdr.Size:]
+	fds := make([]int, nfds)
+	copy(fds, c.inFds)
+	c.inFds = c.inFds[nfds:]
+	c.lock.Lock()
+	c.stats.received.add(int(hdr.Size), nfds)
+	c.countMessage(c.stats.events, sender, hdr.Opcode, int(hdr.Size), nfds)
+	c.recordMessage(sender, false, hdr.Opcode, data, fds)
+	if logger := c.logger.Load(); logger != nil {
+		c.traceEvent(logger, sender, hdr.Opcode, data, fds)
 	}
-	if n != len(data) || nfds != len(fds) {
-		// TODO: can we handle this gracefully? Do we need to?
-		closeAll(fds[:nfds])
-		return fmt.Errorf("Short read")
+	if sender == remoteProxy(c.display) {
+		c.unlock()
+		sender.handleEvent(hdr.Opcode, data, fds)
+		return true, nil
 	}
-	sender.handleEvent(hdr.Opcode, data, fds)
-	return nil
+	info := interfaceRegistry[sender.Interface()]
+	if err := c.registerNewObjects(sender, info, hdr.Opcode, data); err != nil {
+		c.unlock()
+		closeAll(fds)
+		return false, err
+	}
+	if isZombie(sender) {
+		c.unlock()
+		sender.handleEvent(hdr.Opcode, data, fds)
+		return true, nil
+	}
+	defer c.unlock()
+	sender.base().getQueue().push(event{
+		sender: sender,
+		opcode: hdr.Opcode,
+		data:   data,
+		fds:    fds,
+	})
+	return true, nil
 }
 
+// Set a callback to be invoked for each global the server advertises. Globals
+// whose interfaces this library supports are bound (at the highest version
+// both sides support) before being passed to the callback; others are passed
+// as an *UnknownInterface with a null id.
+//
+// Note that this binds every supported global; to bind only what you need,
+// use Globals instead.
 func (c *Client) OnGlobal(callback func(Object)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.onGlobal = callback
 }
 
+// Return the client's default event queue.
+func (c *Client) DefaultQueue() *EventQueue {
+	return c.defaultQueue
+}
+
+// Dispatch events on the default queue until an error occurs. If the server
+// reports a protocol error, MainLoop returns it (as a *ServerError) as soon as
+// it arrives, without dispatching the remaining events.
 func (c *Client) MainLoop() error {
 	for {
-		if err := c.nextMsg(); err != nil {
+		if err := c.defaultQueue.Dispatch(); err != nil {
+			return err
+		}
+		if err := c.serverError(); err != nil {
 			return err
 		}
 	}
 }
 
-// Allocate and return a fresh object id.
+// Return the protocol error reported by the server, if any.
+func (c *Client) serverError() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err, ok := c.err.(*ServerError); ok {
+		return err
+	}
+	return nil
+}
+
+// Allocate and return a fresh object id. c.lock must be held.
 func (c *Client) newId() ObjectId {
-	ret := c.nextId
-	c.nextId++
-	return ObjectId(ret)
+	return c.ids.alloc()
 }
 
 // An object hosted on the other side of a connection.
 //
 // TODO: pick better names/document the distinction between this and remoteProxy.
 type remoteObject struct {
-	id   ObjectId
-	conn *Client
+	id    ObjectId
+	conn  *Client
+	queue *EventQueue
+
+	// The version of the interface the object was bound with. Objects
+	// created from other objects have the same version as their parent.
+	version uint32
+
+	// The message which created the object; see Client.Objects.
+	createdBy origin
+
+	// Set when the client destroys the object, so that events which
+	// were already queued for it are dropped. Guarded by conn.lock.
+	destroyed bool
+
+	// See listeners.go.
+	userData     interface{}
+	listeners    map[uint16][]listener
+	nextListener uint64
 }
 
 func (o *remoteObject) Id() ObjectId {
 	return o.id
 }
 
+func (o *remoteObject) base() *remoteObject {
+	return o
+}
+
 type remoteProxy interface {
 	Object
+	base() *remoteObject
 	getFdCounts() *fdCounts
 	handleEvent(opcode uint16, buf []byte, fds []int)
 }
@@ -2,6 +2,7 @@ package wayland
 
 import (
 	"io"
+	"reflect"
 )
 
 func writeU32(w io.Writer, val uint32) (int64, error) {
@@ -15,11 +16,23 @@ func write_new_id(w io.Writer, val hasObjectId) (int64, error) { return writeU32
 func write_int(w io.Writer, val int32) (int64, error)          { return writeU32(w, uint32(val)) }
 func write_uint(w io.Writer, val uint32) (int64, error)        { return writeU32(w, uint32(val)) }
 func write_fixed(w io.Writer, val Fixed) (int64, error)        { return writeU32(w, val.value) }
-func write_object(w io.Writer, val Object) (int64, error)      { return writeU32(w, uint32(val.Id())) }
 func write_fd(w io.Writer, val ObjectId) (int64, error)        { return 0, nil }
 
+func write_object(w io.Writer, val Object) (int64, error) {
+	// Nullable arguments may be passed as nil, either untyped or as a nil
+	// pointer of the argument's type; either way they are sent as id 0.
+	if val == nil {
+		return writeU32(w, 0)
+	}
+	if v := reflect.ValueOf(val); v.Kind() == reflect.Ptr && v.IsNil() {
+		return writeU32(w, 0)
+	}
+	return writeU32(w, uint32(val.Id()))
+}
+
 func write_string(w io.Writer, s string) (n int64, err error) {
-	n, err = writeU32(w, uint32(len(s)))
+	// The length includes the terminating NUL.
+	n, err = writeU32(w, uint32(len(s)+1))
 	if err != nil {
 		return
 	}
@@ -34,3 +47,13 @@ func write_string(w io.Writer, s string) (n int64, err error) {
 	n += int64(n_)
 	return
 }
+
+// Nullable string arguments are sent as null if they are empty; there's no
+// way to send an empty (but non-null) string for such arguments, but none of
+// the protocols we know of distinguish the two.
+func write_nullable_string(w io.Writer, s string) (int64, error) {
+	if s == "" {
+		return writeU32(w, 0)
+	}
+	return write_string(w, s)
+}
@@ -0,0 +1,105 @@
+//go:build ignore
+// +build ignore
+
+// Generate keysyms_table.go from X11's keysymdef.h. Usage:
+//
+//	go run gen_keysyms.go /usr/include/X11/keysymdef.h
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var defineRe = regexp.MustCompile(
+	`^#define XK_([a-zA-Z_0-9]+)\s+0x([0-9a-fA-F]+)\s*(?:/\*\s*(\()?U\+([0-9A-Fa-f]+))?`)
+
+type keysym struct {
+	name  string
+	value uint64
+}
+
+func chkfatal(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	f, err := os.Open(os.Args[1])
+	chkfatal(err)
+	defer f.Close()
+
+	var names []keysym
+	runes := map[uint64]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := defineRe.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		value, err := strconv.ParseUint(m[2], 16, 32)
+		chkfatal(err)
+		names = append(names, keysym{name: m[1], value: value})
+
+		// Keysyms in the Unicode range map to their code point
+		// directly, so they don't need an entry. Mappings in
+		// parentheses are approximate; libxkbcommon uses them
+		// anyway, and so do we.
+		if m[4] != "" && value < 0x01000000 {
+			r, err := strconv.ParseUint(m[4], 16, 32)
+			chkfatal(err)
+			if _, ok := runes[value]; !ok {
+				runes[value] = r
+			}
+		}
+	}
+	chkfatal(scanner.Err())
+
+	w := &bytes.Buffer{}
+
+	fmt.Fprintln(w, "// Code generated by gen_keysyms.go from keysymdef.h; DO NOT EDIT.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "package xkb")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "var keysymsByName = map[string]Keysym{")
+	for _, k := range names {
+		fmt.Fprintf(w, "\t%q: 0x%x,\n", k.name, k.value)
+	}
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+
+	// The first name listed for a keysym is the canonical one.
+	fmt.Fprintln(w, "var keysymNames = map[Keysym]string{")
+	seen := map[uint64]bool{}
+	for _, k := range names {
+		if !seen[k.value] {
+			seen[k.value] = true
+			fmt.Fprintf(w, "\t0x%x: %q,\n", k.value, k.name)
+		}
+	}
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+
+	values := make([]uint64, 0, len(runes))
+	for v := range runes {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	fmt.Fprintln(w, "var keysymRunes = map[Keysym]rune{")
+	for _, v := range values {
+		fmt.Fprintf(w, "\t0x%x: 0x%04x,\n", v, runes[v])
+	}
+	fmt.Fprintln(w, "}")
+
+	src, err := format.Source(w.Bytes())
+	chkfatal(err)
+	chkfatal(os.WriteFile("keysyms_table.go", src, 0644))
+}
@@ -0,0 +1,794 @@
+// Package xkb interprets keyboard input according to an XKB keymap, as sent
+// by wayland compositors via wl_keyboard.keymap, without depending on
+// libxkbcommon.
+//
+// Only the compiled keymap format (wl_keyboard.keymap_format.xkb_v1) is
+// supported, i.e. the output of xkbcomp or xkb_keymap_get_as_string, which
+// has no include statements. Actions are parsed but ignored: the compositor
+// tracks modifier state and sends it to the client, so all a client needs is
+// a mapping from keys and modifiers to keysyms. Typical usage with the
+// input package:
+//
+//	case input.Keymap:
+//		km, err := xkb.KeymapFromFd(ev.Fd, ev.Size)
+//		unix.Close(ev.Fd)
+//		...
+//		state = xkb.NewState(km)
+//	case input.Modifiers:
+//		state.UpdateMask(ev.Depressed, ev.Latched, ev.Locked, ev.Group)
+//	case input.Key:
+//		text := state.UTF8(ev.Key + 8)
+package xkb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The real modifiers, in order of their indices.
+var realModNames = []string{"Shift", "Lock", "Control", "Mod1", "Mod2", "Mod3", "Mod4", "Mod5"}
+
+const (
+	modShift   = 1 << 0
+	modLock    = 1 << 1
+	modControl = 1 << 2
+	modAllReal = 0xff
+)
+
+// A Keymap maps keys and modifiers to keysyms.
+type Keymap struct {
+	// Modifiers by index: the real modifiers, then the virtual ones in the
+	// order they were declared.
+	mods []modifier
+
+	keys     map[uint32]*key   // By keycode.
+	keycodes map[string]uint32 // By key name, including aliases.
+	types    map[string]*keyType
+
+	groupNames []string
+}
+
+type modifier struct {
+	name string
+
+	// The real modifiers this corresponds to; for a real modifier, just
+	// itself.
+	mapping uint32
+}
+
+// A key type determines which level of a key's group is selected by the
+// active modifiers.
+type keyType struct {
+	name    string
+	mods    uint32 // The modifiers the type cares about.
+	levels  int
+	entries []typeEntry
+}
+
+type typeEntry struct {
+	mods     uint32
+	level    int
+	preserve uint32 // Modifiers which aren't consumed when this matches.
+
+	// Whether the entry can match. Entries mentioning only virtual
+	// modifiers which aren't mapped to any real ones are disabled.
+	active bool
+}
+
+type key struct {
+	name    string
+	keycode uint32
+	groups  []keyGroup
+
+	// How to bring an out of range group into range: one of wrapGroups,
+	// clampGroups or redirectGroups, in which case the group to use
+	// is redirectTo.
+	outOfRange int
+	redirectTo int
+
+	modMap      uint32 // Real modifiers, from modifier_map.
+	vmodMap     uint32 // Virtual modifiers, by index.
+	explicitVmr bool   // Whether vmodMap was given, or derived.
+}
+
+const (
+	wrapGroups = iota
+	clampGroups
+	redirectGroups
+)
+
+type keyGroup struct {
+	typ          *keyType
+	explicitType string
+
+	// The keysyms for each level; usually one, but possibly none or
+	// several.
+	levels [][]Keysym
+}
+
+// Parse a keymap in the compiled text format.
+func ParseKeymap(src []byte) (km *Keymap, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			perr, ok := e.(*ParseError)
+			if !ok {
+				panic(e)
+			}
+			km, err = nil, perr
+		}
+	}()
+	b := newBuilder()
+	p := &parser{lex: lexer{src: src, line: 1}, b: b}
+	p.parseKeymap()
+	b.finish()
+	return b.km, nil
+}
+
+// Read a keymap from a file descriptor, as passed with wl_keyboard.keymap.
+// The fd is not closed.
+func KeymapFromFd(fd int, size uint32) (*Keymap, error) {
+	data, err := unix.Mmap(fd, 0, int(size), unix.PROT_READ, unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("xkb: mapping keymap: %w", err)
+	}
+	defer unix.Munmap(data)
+	return ParseKeymap(data)
+}
+
+// Return the keycode of the key with the given name (e.g. "AC01", without
+// angle brackets), if there is one.
+func (km *Keymap) Keycode(name string) (uint32, bool) {
+	code, ok := km.keycodes[name]
+	return code, ok
+}
+
+// Return the names of the keymap's groups (i.e. layouts), e.g.
+// "English (US)". Groups with no name have an empty string.
+func (km *Keymap) GroupNames() []string {
+	return append([]string(nil), km.groupNames...)
+}
+
+// Return the index of the named modifier, if there is one. Modifier names
+// are case-insensitive.
+func (km *Keymap) modIndex(name string) (int, bool) {
+	for i, m := range km.mods {
+		if strings.EqualFold(m.name, name) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Translate a set of modifiers by index into the real modifiers they
+// correspond to.
+func (km *Keymap) realMods(mods uint32) uint32 {
+	var real uint32
+	for i, m := range km.mods {
+		if mods&(1<<i) != 0 {
+			real |= m.mapping
+		}
+	}
+	return real
+}
+
+// Choose the group to use for the key, given the effective group.
+func (k *key) group(group int32) *keyGroup {
+	n := int32(len(k.groups))
+	if n == 0 {
+		return nil
+	}
+	if group < 0 || group >= n {
+		switch k.outOfRange {
+		case wrapGroups:
+			group %= n
+			if group < 0 {
+				group += n
+			}
+		case clampGroups:
+			if group < 0 {
+				group = 0
+			} else {
+				group = n - 1
+			}
+		case redirectGroups:
+			group = int32(k.redirectTo)
+			if group >= n {
+				group = 0
+			}
+		}
+	}
+	return &k.groups[group]
+}
+
+// Return the level selected by the (real) modifiers, and which modifiers
+// were used to select it.
+func (t *keyType) level(km *Keymap, mods uint32) (level int, consumed uint32) {
+	mask := km.realMods(t.mods)
+	active := mods & mask
+	for _, e := range t.entries {
+		if e.active && km.realMods(e.mods) == active {
+			return e.level, mask &^ km.realMods(e.preserve)
+		}
+	}
+	return 0, mask
+}
+
+// A builder assembles a Keymap from the declarations found by the parser.
+// Some things can only be worked out once everything has been seen, which
+// is done by finish.
+type builder struct {
+	km      *Keymap
+	interps []interp
+	modMaps []modMapEntry
+}
+
+type interp struct {
+	sym      Keysym
+	anySym   bool
+	pred     int
+	mods     uint32
+	vmod     int // -1 if none.
+	levelOne bool
+}
+
+// Interpretation predicates.
+const (
+	predNoneOf = iota
+	predAnyOfOrNone
+	predAnyOf
+	predAllOf
+	predExactly
+)
+
+type modMapEntry struct {
+	mod   uint32
+	items []*expr
+}
+
+func newBuilder() *builder {
+	km := &Keymap{
+		keys:     make(map[uint32]*key),
+		keycodes: make(map[string]uint32),
+		types:    make(map[string]*keyType),
+	}
+	for i, name := range realModNames {
+		km.mods = append(km.mods, modifier{name: name, mapping: 1 << i})
+	}
+	return &builder{km: km}
+}
+
+func errorf(e *expr, format string, args ...interface{}) {
+	panic(&ParseError{Line: e.line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (b *builder) keycode(name string, code uint32) {
+	b.km.keycodes[name] = code
+	if _, ok := b.km.keys[code]; !ok {
+		b.km.keys[code] = &key{name: name, keycode: code}
+	}
+}
+
+func (b *builder) alias(alias, real string) {
+	if code, ok := b.km.keycodes[real]; ok {
+		if _, ok := b.km.keycodes[alias]; !ok {
+			b.km.keycodes[alias] = code
+		}
+	}
+}
+
+func (b *builder) virtualMod(name string, mapping *expr, line int) {
+	i, ok := b.km.modIndex(name)
+	if !ok {
+		if len(b.km.mods) >= 32 {
+			panic(&ParseError{Line: line, Msg: "too many modifiers"})
+		}
+		i = len(b.km.mods)
+		b.km.mods = append(b.km.mods, modifier{name: name})
+	}
+	if mapping != nil && i >= len(realModNames) {
+		// Keys may add to this later, in finish.
+		b.km.mods[i].mapping = b.modMask(mapping) & modAllReal
+	}
+}
+
+func (b *builder) keyType(name string, stmts []*expr) {
+	t := &keyType{name: name, levels: 1}
+	entry := func(mods uint32) *typeEntry {
+		for i := range t.entries {
+			if t.entries[i].mods == mods {
+				return &t.entries[i]
+			}
+		}
+		t.entries = append(t.entries, typeEntry{mods: mods})
+		return &t.entries[len(t.entries)-1]
+	}
+	for _, stmt := range stmts {
+		lhs, rhs := assignment(stmt)
+		switch strings.ToLower(lhs.str) {
+		case "modifiers":
+			t.mods = b.modMask(rhs)
+		case "map":
+			e := entry(b.modMask(index(lhs)))
+			e.level = levelIndex(rhs)
+			if e.level >= t.levels {
+				t.levels = e.level + 1
+			}
+		case "preserve":
+			entry(b.modMask(index(lhs))).preserve = b.modMask(rhs)
+		case "level_name", "levelname":
+			if l := levelIndex(index(lhs)); l >= t.levels {
+				t.levels = l + 1
+			}
+		default:
+			errorf(lhs, "unknown field %q in key type", lhs.str)
+		}
+	}
+	// Entries can only match modifiers the type cares about.
+	for i := range t.entries {
+		t.entries[i].mods &= t.mods
+	}
+	b.km.types[name] = t
+}
+
+func (b *builder) interpret(match *expr, stmts []*expr) {
+	in := interp{pred: predAnyOfOrNone, mods: modAllReal, vmod: -1}
+	sym := match
+	if match.kind == exprBinary && match.op == '+' {
+		sym = match.args[0]
+		pred := match.args[1]
+		if pred.kind != exprCall {
+			errorf(pred, "expected a predicate")
+		}
+		switch strings.ToLower(pred.str) {
+		case "noneof":
+			in.pred = predNoneOf
+		case "anyofornone":
+			in.pred = predAnyOfOrNone
+		case "anyof":
+			in.pred = predAnyOf
+		case "allof":
+			in.pred = predAllOf
+		case "exactly":
+			in.pred = predExactly
+		default:
+			errorf(pred, "unknown predicate %q", pred.str)
+		}
+		if len(pred.args) != 1 {
+			errorf(pred, "predicates take one argument")
+		}
+		in.mods = b.modMask(pred.args[0]) & modAllReal
+	}
+	if sym.kind == exprIdent && strings.EqualFold(sym.str, "any") {
+		in.anySym = true
+	} else {
+		in.sym = keysym(sym)
+	}
+	for _, stmt := range stmts {
+		if stmt.kind != exprAssign {
+			continue
+		}
+		lhs, rhs := stmt.args[0], stmt.args[1]
+		switch strings.ToLower(lhs.str) {
+		case "virtualmodifier", "virtualmod":
+			if rhs.kind != exprIdent {
+				errorf(rhs, "expected a modifier name")
+			}
+			i, ok := b.km.modIndex(rhs.str)
+			if !ok {
+				errorf(rhs, "unknown modifier %q", rhs.str)
+			}
+			in.vmod = i
+		case "usemodmapmods", "usemodmap":
+			in.levelOne = rhs.kind == exprIdent &&
+				(strings.EqualFold(rhs.str, "level1") || strings.EqualFold(rhs.str, "levelone"))
+		}
+	}
+	b.interps = append(b.interps, in)
+}
+
+func (b *builder) key(name string, items []*expr) {
+	code, ok := b.km.keycodes[name]
+	if !ok {
+		// Keys without a keycode are ignored, as in xkbcomp.
+		return
+	}
+	k := b.km.keys[code]
+	groupAt := func(i int) *keyGroup {
+		for len(k.groups) <= i {
+			k.groups = append(k.groups, keyGroup{})
+		}
+		return &k.groups[i]
+	}
+	implicitGroup := 0
+	allTypes := "" // From a type without a group index.
+	for _, item := range items {
+		if item.kind == exprList {
+			groupAt(implicitGroup).levels = levels(item)
+			implicitGroup++
+			continue
+		}
+		lhs, rhs := assignment(item)
+		switch strings.ToLower(lhs.str) {
+		case "type":
+			if rhs.kind != exprString {
+				errorf(rhs, "expected a type name")
+			}
+			if lhs.index == nil {
+				allTypes = rhs.str
+			} else {
+				groupAt(groupIndex(lhs.index)).explicitType = rhs.str
+			}
+		case "symbols":
+			g := implicitGroup
+			if lhs.index != nil {
+				g = groupIndex(lhs.index)
+			} else {
+				implicitGroup++
+			}
+			if rhs.kind != exprList {
+				errorf(rhs, "expected a list of keysyms")
+			}
+			groupAt(g).levels = levels(rhs)
+		case "vmods", "virtualmods", "virtualmodifiers":
+			k.vmodMap = b.modMask(rhs) &^ modAllReal
+			k.explicitVmr = true
+		case "groupswrap", "wrapgroups":
+			k.outOfRange = wrapGroups
+		case "groupsclamp", "clampgroups":
+			k.outOfRange = clampGroups
+		case "groupsredirect", "redirectgroups":
+			k.outOfRange = redirectGroups
+			k.redirectTo = groupIndex(rhs)
+		default:
+			// actions, repeat, locking, overlays: not our
+			// concern.
+		}
+	}
+	if allTypes != "" {
+		for i := range k.groups {
+			if k.groups[i].explicitType == "" {
+				k.groups[i].explicitType = allTypes
+			}
+		}
+	}
+}
+
+func (b *builder) modMap(mod string, items []*expr, line int) {
+	i, ok := b.km.modIndex(mod)
+	if !ok || i >= len(realModNames) {
+		if strings.EqualFold(mod, "none") {
+			return
+		}
+		panic(&ParseError{Line: line, Msg: fmt.Sprintf("%q is not a real modifier", mod)})
+	}
+	b.modMaps = append(b.modMaps, modMapEntry{mod: 1 << i, items: items})
+}
+
+func (b *builder) assign(stmt *expr) {
+	lhs, rhs := assignment(stmt)
+	switch strings.ToLower(lhs.str) {
+	case "name", "groupname":
+		if lhs.index == nil || rhs.kind != exprString {
+			errorf(stmt, "bad group name")
+		}
+		g := groupIndex(lhs.index)
+		for len(b.km.groupNames) <= g {
+			b.km.groupNames = append(b.km.groupNames, "")
+		}
+		b.km.groupNames[g] = rhs.str
+	default:
+		// minimum, maximum, and the like.
+	}
+}
+
+// Work out everything which depends on more than one section.
+func (b *builder) finish() {
+	km := b.km
+
+	keys := make([]*key, 0, len(km.keys))
+	for _, k := range km.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].keycode < keys[j].keycode })
+
+	for _, m := range b.modMaps {
+		for _, item := range m.items {
+			if k := b.findKey(keys, item); k != nil {
+				k.modMap |= m.mod
+			}
+		}
+	}
+
+	for _, k := range keys {
+		for i := range k.groups {
+			g := &k.groups[i]
+			name := g.explicitType
+			if name == "" {
+				name = autoType(g.levels)
+			}
+			g.typ = km.types[name]
+			if g.typ == nil {
+				// A type the keymap doesn't define, which can
+				// only happen with a hand written keymap; make
+				// do with a single level.
+				g.typ = &keyType{name: name, levels: 1}
+			}
+			for len(g.levels) < g.typ.levels {
+				g.levels = append(g.levels, nil)
+			}
+		}
+		if !k.explicitVmr {
+			k.vmodMap = b.interpretVmods(k)
+		}
+	}
+
+	// Virtual modifiers map to the real modifiers of the keys which
+	// set them.
+	for _, k := range keys {
+		for i := len(realModNames); i < len(km.mods); i++ {
+			if k.vmodMap&(1<<i) != 0 {
+				km.mods[i].mapping |= k.modMap
+			}
+		}
+	}
+
+	for _, t := range km.types {
+		for i := range t.entries {
+			e := &t.entries[i]
+			e.active = e.mods == 0 || km.realMods(e.mods) != 0
+		}
+	}
+}
+
+// Find the key referred to in a modifier_map, either by name or by a keysym
+// it produces. In the latter case it's the key with the lowest keycode
+// producing the keysym, in any group or level.
+func (b *builder) findKey(keys []*key, item *expr) *key {
+	if item.kind == exprKeyname {
+		code, ok := b.km.keycodes[item.str]
+		if !ok {
+			return nil
+		}
+		return b.km.keys[code]
+	}
+	sym := keysym(item)
+	for _, k := range keys {
+		for _, g := range k.groups {
+			for _, l := range g.levels {
+				for _, s := range l {
+					if s == sym {
+						return k
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Compute a key's virtual modifiers from the interpretations which match its
+// keysyms.
+func (b *builder) interpretVmods(k *key) uint32 {
+	var vmods uint32
+	for g := range k.groups {
+		for level, syms := range k.groups[g].levels {
+			if len(syms) != 1 {
+				continue
+			}
+			in := b.findInterp(k, syms[0], level)
+			if in == nil || in.vmod < 0 {
+				continue
+			}
+			if g == 0 && level == 0 || !in.levelOne {
+				vmods |= 1 << in.vmod
+			}
+		}
+	}
+	return vmods
+}
+
+// Find the interpretation for a keysym on the given level of a key. The most
+// specific one wins: those for a particular keysym beat those for Any, and
+// stricter predicates beat looser ones.
+func (b *builder) findInterp(k *key, sym Keysym, level int) *interp {
+	var best *interp
+	for i := range b.interps {
+		in := &b.interps[i]
+		if !in.anySym && in.sym != sym {
+			continue
+		}
+		mods := k.modMap
+		if in.levelOne && level != 0 {
+			mods = 0
+		}
+		var match bool
+		switch in.pred {
+		case predNoneOf:
+			match = mods&in.mods == 0
+		case predAnyOfOrNone:
+			match = mods == 0 || mods&in.mods != 0
+		case predAnyOf:
+			match = mods&in.mods != 0
+		case predAllOf:
+			match = mods&in.mods == in.mods
+		case predExactly:
+			match = mods == in.mods
+		}
+		if match && (best == nil || in.moreSpecific(best)) {
+			best = in
+		}
+	}
+	return best
+}
+
+func (in *interp) moreSpecific(other *interp) bool {
+	if in.anySym != other.anySym {
+		return !in.anySym
+	}
+	return predRank[in.pred] < predRank[other.pred]
+}
+
+// How specific each predicate is, from most to least.
+var predRank = map[int]int{
+	predExactly:     0,
+	predAllOf:       1,
+	predNoneOf:      2,
+	predAnyOf:       3,
+	predAnyOfOrNone: 4,
+}
+
+// Choose a type for a group which doesn't specify one, based on its
+// keysyms, as xkbcomp does.
+func autoType(levels [][]Keysym) string {
+	sym := func(i int) Keysym {
+		if i < len(levels) && len(levels[i]) == 1 {
+			return levels[i][0]
+		}
+		return NoSymbol
+	}
+	alphabetic := func(i int) bool {
+		return sym(i).isLower() && sym(i+1).isUpper()
+	}
+	keypad := sym(0).isKeypad() || sym(1).isKeypad()
+	switch {
+	case len(levels) <= 1:
+		return "ONE_LEVEL"
+	case len(levels) == 2 && alphabetic(0):
+		return "ALPHABETIC"
+	case len(levels) == 2 && keypad:
+		return "KEYPAD"
+	case len(levels) == 2:
+		return "TWO_LEVEL"
+	case alphabetic(0) && alphabetic(2):
+		return "FOUR_LEVEL_ALPHABETIC"
+	case alphabetic(0):
+		return "FOUR_LEVEL_SEMIALPHABETIC"
+	case keypad:
+		return "FOUR_LEVEL_KEYPAD"
+	default:
+		return "FOUR_LEVEL"
+	}
+}
+
+// Evaluate an expression denoting a set of modifiers, e.g. Shift+Mod1.
+func (b *builder) modMask(e *expr) uint32 {
+	switch e.kind {
+	case exprIdent:
+		switch strings.ToLower(e.str) {
+		case "none":
+			return 0
+		case "all":
+			return modAllReal
+		}
+		i, ok := b.km.modIndex(e.str)
+		if !ok {
+			errorf(e, "unknown modifier %q", e.str)
+		}
+		return 1 << i
+	case exprInt:
+		return uint32(e.num)
+	case exprBinary:
+		l, r := b.modMask(e.args[0]), b.modMask(e.args[1])
+		switch e.op {
+		case '+':
+			return l | r
+		case '-':
+			return l &^ r
+		}
+	}
+	errorf(e, "expected modifiers")
+	return 0
+}
+
+// Evaluate an expression denoting a keysym.
+func keysym(e *expr) Keysym {
+	switch e.kind {
+	case exprIdent:
+		// Unknown keysyms are ignored, as in xkbcomp: the keymap
+		// may be newer than our table.
+		k, _ := KeysymFromName(e.str)
+		return k
+	case exprInt:
+		if e.num >= 0 && e.num <= 9 {
+			// Plain digits are the keysyms for those digits.
+			return Keysym('0' + e.num)
+		}
+		return Keysym(e.num)
+	}
+	errorf(e, "expected a keysym")
+	return NoSymbol
+}
+
+// Evaluate the list of levels in a key's group: [ a, A, { b, c } ].
+func levels(e *expr) [][]Keysym {
+	ret := make([][]Keysym, len(e.args))
+	for i, arg := range e.args {
+		if arg.kind == exprBraces {
+			for _, a := range arg.args {
+				if k := keysym(a); k != NoSymbol {
+					ret[i] = append(ret[i], k)
+				}
+			}
+		} else if k := keysym(arg); k != NoSymbol {
+			ret[i] = []Keysym{k}
+		}
+	}
+	return ret
+}
+
+// Evaluate a 1-based index with an optional prefix, e.g. Group2 or Level3,
+// returning it zero-based.
+func prefixedIndex(e *expr, prefix string) int {
+	n := e.num
+	if e.kind == exprIdent {
+		if len(e.str) <= len(prefix) || !strings.EqualFold(e.str[:len(prefix)], prefix) {
+			errorf(e, "expected %s1, %s2, ...", prefix, prefix)
+		}
+		if _, err := fmt.Sscanf(e.str[len(prefix):], "%d", &n); err != nil {
+			errorf(e, "bad %s %q", strings.ToLower(prefix), e.str)
+		}
+	} else if e.kind != exprInt {
+		errorf(e, "expected a %s", strings.ToLower(prefix))
+	}
+	if n < 1 || n > 32 {
+		errorf(e, "%s %d out of range", strings.ToLower(prefix), n)
+	}
+	return int(n - 1)
+}
+
+func groupIndex(e *expr) int {
+	return prefixedIndex(e, "Group")
+}
+
+func levelIndex(e *expr) int {
+	return prefixedIndex(e, "Level")
+}
+
+// Split an assignment statement into its sides. Statements in the form
+// "!foo" or "foo" are shorthand for foo = false and foo = true; these are
+// only used for flags we don't care about, so we just return the name.
+func assignment(stmt *expr) (lhs, rhs *expr) {
+	switch stmt.kind {
+	case exprAssign:
+		lhs, rhs = stmt.args[0], stmt.args[1]
+	case exprUnary:
+		lhs, rhs = stmt.args[0], &expr{kind: exprIdent, str: "false", line: stmt.line}
+	default:
+		lhs, rhs = stmt, &expr{kind: exprIdent, str: "true", line: stmt.line}
+	}
+	if lhs.kind != exprIdent {
+		errorf(lhs, "expected a field name")
+	}
+	return lhs, rhs
+}
+
+// Return the index of foo[index], which must be present.
+func index(e *expr) *expr {
+	if e.index == nil {
+		errorf(e, "expected %s[...]", e.str)
+	}
+	return e.index
+}
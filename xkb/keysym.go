@@ -0,0 +1,143 @@
+package xkb
+
+//go:generate go run gen_keysyms.go /usr/include/X11/keysymdef.h
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A Keysym identifies the symbol a key produces, e.g. a letter, or a function
+// such as Shift or Return. Values are as in X11's keysymdef.h.
+type Keysym uint32
+
+const (
+	// No symbol; used to fill out levels which don't have one.
+	NoSymbol Keysym = 0
+
+	// Keysyms in this range map directly to unicode code points, which
+	// are added to this offset.
+	unicodeOffset Keysym = 0x01000000
+)
+
+// Look up a keysym by name. Besides the names in keysymdef.h (without the XK_
+// prefix), this accepts hexadecimal values of the form 0x1234 and unicode code
+// points of the form U1234 or U+1234.
+func KeysymFromName(name string) (Keysym, bool) {
+	if k, ok := keysymsByName[name]; ok {
+		return k, true
+	}
+	if strings.HasPrefix(name, "0x") {
+		v, err := strconv.ParseUint(name[2:], 16, 32)
+		return Keysym(v), err == nil
+	}
+	if strings.HasPrefix(name, "U") {
+		v, err := strconv.ParseUint(strings.TrimPrefix(name[1:], "+"), 16, 32)
+		if err != nil || v > unicode.MaxRune {
+			return NoSymbol, false
+		}
+		return keysymFromRune(rune(v)), true
+	}
+	return NoSymbol, false
+}
+
+// Return the keysym's name, as used in keymaps.
+func (k Keysym) String() string {
+	if name, ok := keysymNames[k]; ok {
+		return name
+	}
+	if k >= unicodeOffset && k <= unicodeOffset+unicode.MaxRune {
+		return fmt.Sprintf("U%04X", uint32(k-unicodeOffset))
+	}
+	return fmt.Sprintf("0x%08x", uint32(k))
+}
+
+// Return the character the keysym produces, or 0 if it doesn't correspond
+// to one (e.g. modifiers and function keys).
+func (k Keysym) Rune() rune {
+	switch {
+	case k >= 0x20 && k <= 0x7e, k >= 0xa0 && k <= 0xff:
+		// Latin-1 keysyms are the same as their code points.
+		return rune(k)
+	case k >= unicodeOffset && k <= unicodeOffset+unicode.MaxRune:
+		return rune(k - unicodeOffset)
+	case k == 0xff80: // KP_Space
+		return ' '
+	case k == 0xffbd: // KP_Equal
+		return '='
+	case k >= 0xffaa && k <= 0xffb9, k >= 0xff08 && k <= 0xff0b,
+		k == 0xff0d, k == 0xff1b, k == 0xffff, k == 0xff89, k == 0xff8d:
+		// KP_Multiply through KP_9, BackSpace through Clear, Return,
+		// Escape, Delete, KP_Tab and KP_Enter are all ascii, in the
+		// low bits.
+		return rune(k & 0x7f)
+	}
+	return keysymRunes[k]
+}
+
+// Return the keysym which produces the given character.
+func keysymFromRune(r rune) Keysym {
+	if r >= 0x20 && r <= 0x7e || r >= 0xa0 && r <= 0xff {
+		return Keysym(r)
+	}
+	runeKeysymsOnce.Do(func() {
+		runeKeysyms = make(map[rune]Keysym, len(keysymRunes))
+		for k, r := range keysymRunes {
+			if old, ok := runeKeysyms[r]; !ok || k < old {
+				runeKeysyms[r] = k
+			}
+		}
+	})
+	if k, ok := runeKeysyms[r]; ok {
+		return k
+	}
+	return unicodeOffset + Keysym(r)
+}
+
+// The inverse of keysymRunes, preferring the lowest keysym where there are
+// several. Built on first use.
+var (
+	runeKeysymsOnce sync.Once
+	runeKeysyms     map[rune]Keysym
+)
+
+// Return the upper case version of k, or k itself if it has none.
+func (k Keysym) toUpper() Keysym {
+	return k.convertCase(unicode.ToUpper)
+}
+
+// Return the lower case version of k, or k itself if it has none.
+func (k Keysym) toLower() Keysym {
+	return k.convertCase(unicode.ToLower)
+}
+
+func (k Keysym) convertCase(conv func(rune) rune) Keysym {
+	r := k.Rune()
+	if r == 0 || k.isKeypad() {
+		return k
+	}
+	if c := conv(r); c != r {
+		return keysymFromRune(c)
+	}
+	return k
+}
+
+// Report whether k is a lower case letter, i.e. one with a distinct upper
+// case version.
+func (k Keysym) isLower() bool {
+	return k.toUpper() != k
+}
+
+// Report whether k is an upper case letter, i.e. one with a distinct lower
+// case version.
+func (k Keysym) isUpper() bool {
+	return k.toLower() != k
+}
+
+// Report whether k is on the keypad.
+func (k Keysym) isKeypad() bool {
+	return k >= 0xff80 && k <= 0xffbd
+}
@@ -0,0 +1,189 @@
+package xkb
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF     tokenKind = iota
+	tokIdent             // foo, Mod1, 3270_Duplicate
+	tokInt               // 12, 0x1f
+	tokString            // "foo", with escapes already processed
+	tokKeyname           // <AE01>, without the angle brackets
+	tokPunct             // a single character: {}[]()=;,+-!~.
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	num  int64
+	line int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokString:
+		return strconv.Quote(t.text)
+	case tokKeyname:
+		return "<" + t.text + ">"
+	default:
+		return strconv.Quote(t.text)
+	}
+}
+
+// A lexer splits a keymap into tokens.
+type lexer struct {
+	src  []byte
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) {
+	panic(&ParseError{Line: l.line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Skip white space and comments.
+func (l *lexer) skipSpace() {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v' || c == 0:
+			l.pos++
+		case c == '#' || c == '/' && l.peekByte(1) == '/':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '/' && l.peekByte(1) == '*':
+			end := bytes.Index(l.src[l.pos+2:], []byte("*/"))
+			if end < 0 {
+				l.errorf("unterminated comment")
+			}
+			end += l.pos + 4
+			for ; l.pos < end; l.pos++ {
+				if l.src[l.pos] == '\n' {
+					l.line++
+				}
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) peekByte(offset int) byte {
+	if l.pos+offset < len(l.src) {
+		return l.src[l.pos+offset]
+	}
+	return 0
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+func (l *lexer) next() token {
+	l.skipSpace()
+	tok := token{line: l.line}
+	if l.pos >= len(l.src) {
+		tok.kind = tokEOF
+		return tok
+	}
+	c := l.src[l.pos]
+	switch {
+	case isWordByte(c):
+		start := l.pos
+		for l.pos < len(l.src) && isWordByte(l.src[l.pos]) {
+			l.pos++
+		}
+		tok.text = string(l.src[start:l.pos])
+		tok.kind = tokIdent
+		if c >= '0' && c <= '9' {
+			// Words starting with digits are numbers, unless they
+			// are keysym names like 3270_Enter.
+			base, digits := 10, tok.text
+			if strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X") {
+				base, digits = 16, digits[2:]
+			}
+			if v, err := strconv.ParseInt(digits, base, 64); err == nil {
+				tok.kind = tokInt
+				tok.num = v
+			}
+		}
+	case c == '"':
+		tok.kind = tokString
+		tok.text = l.lexString()
+	case c == '<':
+		end := bytes.IndexByte(l.src[l.pos:], '>')
+		if end < 0 {
+			l.errorf("unterminated key name")
+		}
+		tok.kind = tokKeyname
+		tok.text = string(l.src[l.pos+1 : l.pos+end])
+		l.pos += end + 1
+	case strings.IndexByte("{}[]()=;,+-!~.*/", c) >= 0:
+		tok.kind = tokPunct
+		tok.text = string(c)
+		l.pos++
+	default:
+		l.errorf("unexpected character %q", c)
+	}
+	return tok
+}
+
+// Lex a string literal, starting at the opening quote.
+func (l *lexer) lexString() string {
+	var sb strings.Builder
+	l.pos++
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			l.errorf("unterminated string")
+		}
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case '"':
+			return sb.String()
+		case '\\':
+			c = l.peekByte(0)
+			l.pos++
+			switch c {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'v':
+				sb.WriteByte('\v')
+			case 'e':
+				sb.WriteByte('\033')
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				// Up to three octal digits.
+				v := int(c - '0')
+				for i := 0; i < 2 && l.peekByte(0) >= '0' && l.peekByte(0) <= '7'; i++ {
+					v = v*8 + int(l.peekByte(0)-'0')
+					l.pos++
+				}
+				sb.WriteByte(byte(v))
+			default:
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package xkb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A ParseError is returned when a keymap is malformed.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("xkb: line %d: %s", e.Line, e.Msg)
+}
+
+type exprKind int
+
+const (
+	exprIdent   exprKind = iota // str; foo.bar is a single ident
+	exprInt                     // num
+	exprString                  // str
+	exprKeyname                 // str
+	exprList                    // [args...]
+	exprBraces                  // {args...}
+	exprCall                    // str(args...)
+	exprUnary                   // op args[0]
+	exprBinary                  // args[0] op args[1]
+	exprAssign                  // args[0] = args[1]
+)
+
+// A node in the syntax tree. The keymap format's expressions are simple
+// enough that a single type covers them all.
+type expr struct {
+	kind  exprKind
+	line  int
+	op    byte
+	str   string
+	num   int64
+	index *expr // for idents: foo[index]
+	args  []*expr
+}
+
+// A parser reads a keymap's syntax, and hands the declarations it finds to
+// a builder, which does the rest.
+type parser struct {
+	lex lexer
+	tok token
+	b   *builder
+}
+
+func (p *parser) errorf(format string, args ...interface{}) {
+	panic(&ParseError{Line: p.tok.line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) next() {
+	p.tok = p.lex.next()
+}
+
+func (p *parser) isPunct(c string) bool {
+	return p.tok.kind == tokPunct && p.tok.text == c
+}
+
+func (p *parser) isIdent(name string) bool {
+	return p.tok.kind == tokIdent && strings.EqualFold(p.tok.text, name)
+}
+
+func (p *parser) expectPunct(c string) {
+	if !p.isPunct(c) {
+		p.errorf("expected %q, but got %v", c, p.tok)
+	}
+	p.next()
+}
+
+func (p *parser) expect(kind tokenKind, what string) token {
+	tok := p.tok
+	if tok.kind != kind {
+		p.errorf("expected %s, but got %v", what, tok)
+	}
+	p.next()
+	return tok
+}
+
+// Parse the top level of a keymap, which is a single xkb_keymap block
+// containing the sections.
+func (p *parser) parseKeymap() {
+	p.next()
+	if !p.isIdent("xkb_keymap") {
+		p.errorf("expected xkb_keymap, but got %v", p.tok)
+	}
+	p.next()
+	if p.tok.kind == tokString {
+		p.next()
+	}
+	p.expectPunct("{")
+	for !p.isPunct("}") {
+		section := p.expect(tokIdent, "section")
+		if p.tok.kind == tokString {
+			p.next()
+		}
+		p.expectPunct("{")
+		switch strings.ToLower(section.text) {
+		case "xkb_keycodes", "xkb_types", "xkb_compatibility", "xkb_compat",
+			"xkb_compatibility_map", "xkb_symbols":
+			for !p.isPunct("}") {
+				p.parseDecl()
+			}
+			p.next()
+			p.expectPunct(";")
+		case "xkb_geometry":
+			// Only of interest for drawing keyboards.
+			p.skipBlock()
+			p.expectPunct(";")
+		default:
+			p.errorf("unknown section %q", section.text)
+		}
+	}
+	p.next()
+	if p.isPunct(";") {
+		p.next()
+	}
+	if p.tok.kind != tokEOF {
+		p.errorf("unexpected %v after keymap", p.tok)
+	}
+}
+
+// Parse a declaration in one of the sections. Which declarations may appear
+// depends on the section, but there's no ambiguity, so we accept any of
+// them anywhere.
+func (p *parser) parseDecl() {
+	if p.tok.kind == tokKeyname {
+		// <AE01> = 10;
+		name := p.tok.text
+		p.next()
+		p.expectPunct("=")
+		code := p.expect(tokInt, "keycode")
+		p.expectPunct(";")
+		p.b.keycode(name, uint32(code.num))
+		return
+	}
+	if p.tok.kind != tokIdent {
+		p.errorf("unexpected %v", p.tok)
+	}
+	line := p.tok.line
+	switch strings.ToLower(p.tok.text) {
+	case "alias":
+		p.next()
+		alias := p.expect(tokKeyname, "key name")
+		p.expectPunct("=")
+		real := p.expect(tokKeyname, "key name")
+		p.expectPunct(";")
+		p.b.alias(alias.text, real.text)
+	case "virtual_modifiers":
+		p.next()
+		for {
+			name := p.expect(tokIdent, "modifier name")
+			var mapping *expr
+			if p.isPunct("=") {
+				p.next()
+				mapping = p.parseExpr()
+			}
+			p.b.virtualMod(name.text, mapping, name.line)
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		p.expectPunct(";")
+	case "type":
+		p.next()
+		name := p.expect(tokString, "type name")
+		p.b.keyType(name.text, p.parseBlock())
+	case "interpret":
+		p.next()
+		if p.isPunct(".") {
+			// Defaults for the interpretations that follow; the
+			// compiled format spells everything out, so we can
+			// ignore these.
+			p.skipDecl()
+			return
+		}
+		match := p.parseExpr()
+		p.b.interpret(match, p.parseBlock())
+	case "key":
+		p.next()
+		if p.tok.kind != tokKeyname {
+			// key.repeat = ...; and the like.
+			p.skipDecl()
+			return
+		}
+		name := p.tok.text
+		p.next()
+		p.expectPunct("{")
+		var items []*expr
+		for !p.isPunct("}") {
+			items = append(items, p.parseArg())
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		p.expectPunct("}")
+		p.expectPunct(";")
+		p.b.key(name, items)
+	case "modifier_map", "modmap", "mod_map":
+		p.next()
+		mod := p.expect(tokIdent, "modifier name")
+		p.expectPunct("{")
+		var items []*expr
+		for !p.isPunct("}") {
+			items = append(items, p.parseExpr())
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		p.expectPunct("}")
+		p.expectPunct(";")
+		p.b.modMap(mod.text, items, line)
+	case "indicator", "virtual", "group", "include", "augment", "override", "replace":
+		// Nothing we need: indicators, and group compatibility
+		// maps, which don't concern clients. The compiled format
+		// doesn't use include statements.
+		p.skipDecl()
+	default:
+		// A plain assignment, e.g. name[Group1] = "English (US)";
+		stmt := p.parseArg()
+		p.expectPunct(";")
+		p.b.assign(stmt)
+	}
+}
+
+// Skip to the end of the current declaration.
+func (p *parser) skipDecl() {
+	depth := 0
+	for {
+		switch {
+		case p.tok.kind == tokEOF:
+			p.errorf("unexpected end of input")
+		case p.isPunct("{"), p.isPunct("["), p.isPunct("("):
+			depth++
+		case p.isPunct("}"), p.isPunct("]"), p.isPunct(")"):
+			depth--
+		case p.isPunct(";") && depth == 0:
+			p.next()
+			return
+		}
+		p.next()
+	}
+}
+
+// Skip the rest of a block, whose opening brace has been consumed.
+func (p *parser) skipBlock() {
+	for depth := 1; depth > 0; p.next() {
+		switch {
+		case p.tok.kind == tokEOF:
+			p.errorf("unexpected end of input")
+		case p.isPunct("{"):
+			depth++
+		case p.isPunct("}"):
+			depth--
+		}
+	}
+}
+
+// Parse a block of statements, e.g. the body of a type:
+//
+//	{ modifiers = Shift; map[Shift] = Level2; };
+func (p *parser) parseBlock() []*expr {
+	p.expectPunct("{")
+	var stmts []*expr
+	for !p.isPunct("}") {
+		stmts = append(stmts, p.parseArg())
+		p.expectPunct(";")
+	}
+	p.next()
+	p.expectPunct(";")
+	return stmts
+}
+
+// Parse an expression, or an assignment. These appear as statements, and as
+// arguments to actions: SetMods(modifiers=Shift,clearLocks).
+func (p *parser) parseArg() *expr {
+	lhs := p.parseExpr()
+	if !p.isPunct("=") {
+		return lhs
+	}
+	line := p.tok.line
+	p.next()
+	return &expr{kind: exprAssign, line: line, args: []*expr{lhs, p.parseExpr()}}
+}
+
+func (p *parser) parseExpr() *expr {
+	e := p.parseTerm()
+	for p.isPunct("+") || p.isPunct("-") || p.isPunct("*") || p.isPunct("/") {
+		op := p.tok.text[0]
+		line := p.tok.line
+		p.next()
+		e = &expr{kind: exprBinary, line: line, op: op, args: []*expr{e, p.parseTerm()}}
+	}
+	return e
+}
+
+func (p *parser) parseTerm() *expr {
+	tok := p.tok
+	e := &expr{line: tok.line}
+	switch tok.kind {
+	case tokInt:
+		p.next()
+		e.kind = exprInt
+		e.num = tok.num
+	case tokString:
+		p.next()
+		e.kind = exprString
+		e.str = tok.text
+	case tokKeyname:
+		p.next()
+		e.kind = exprKeyname
+		e.str = tok.text
+	case tokIdent:
+		p.next()
+		e.kind = exprIdent
+		e.str = tok.text
+		for p.isPunct(".") {
+			p.next()
+			e.str += "." + p.expect(tokIdent, "field name").text
+		}
+		switch {
+		case p.isPunct("("):
+			e.kind = exprCall
+			e.args = p.parseList("(", ")")
+		case p.isPunct("["):
+			p.next()
+			e.index = p.parseExpr()
+			p.expectPunct("]")
+		}
+	case tokPunct:
+		switch tok.text {
+		case "-", "+", "!", "~":
+			p.next()
+			e.kind = exprUnary
+			e.op = tok.text[0]
+			e.args = []*expr{p.parseTerm()}
+		case "(":
+			p.next()
+			e = p.parseExpr()
+			p.expectPunct(")")
+		case "[":
+			e.kind = exprList
+			e.args = p.parseList("[", "]")
+		case "{":
+			e.kind = exprBraces
+			e.args = p.parseList("{", "}")
+		default:
+			p.errorf("unexpected %v", tok)
+		}
+	default:
+		p.errorf("unexpected %v", tok)
+	}
+	return e
+}
+
+// Parse a comma separated list of arguments, between the given delimiters.
+func (p *parser) parseList(open, close string) []*expr {
+	p.expectPunct(open)
+	var args []*expr
+	for !p.isPunct(close) {
+		args = append(args, p.parseArg())
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	p.expectPunct(close)
+	return args
+}
@@ -0,0 +1,134 @@
+package xkb
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// A State tracks the modifiers and group of a keyboard, and translates its
+// keys into keysyms and text accordingly.
+//
+// Keycodes are XKB keycodes, which are the linux input event codes sent by
+// wl_keyboard.key, plus 8.
+type State struct {
+	keymap *Keymap
+	group  uint32
+
+	// The effective modifiers, as real modifiers.
+	mods uint32
+}
+
+// Create a State for the keymap, with no modifiers active.
+func NewState(km *Keymap) *State {
+	return &State{keymap: km}
+}
+
+// Return the state's keymap.
+func (s *State) Keymap() *Keymap {
+	return s.keymap
+}
+
+// Update the state with the arguments of a wl_keyboard.modifiers event.
+// The modifier masks are by modifier index, as in the keymap; group is the
+// effective group.
+func (s *State) UpdateMask(depressed, latched, locked, group uint32) {
+	s.group = group
+	s.mods = s.keymap.realMods(depressed | latched | locked)
+}
+
+// Report whether the named modifier is active, e.g. "Shift", "Mod1", or a
+// virtual modifier such as "NumLock" or "Alt". Virtual modifiers are active
+// if all of the real modifiers they map to are.
+func (s *State) ModActive(name string) bool {
+	i, ok := s.keymap.modIndex(name)
+	if !ok {
+		return false
+	}
+	mapping := s.keymap.mods[i].mapping
+	return mapping != 0 && s.mods&mapping == mapping
+}
+
+// Look up the level of the key selected by the current state, and which
+// modifiers were consumed selecting it. Returns nil if the key has no
+// symbols.
+func (s *State) level(keycode uint32) (syms []Keysym, consumed uint32) {
+	k := s.keymap.keys[keycode]
+	if k == nil {
+		return nil, 0
+	}
+	g := k.group(int32(s.group))
+	if g == nil {
+		return nil, 0
+	}
+	level, consumed := g.typ.level(s.keymap, s.mods)
+	if level >= len(g.levels) {
+		return nil, consumed
+	}
+	return g.levels[level], consumed
+}
+
+// Return the keysyms the key currently produces. This is usually one keysym,
+// but may be none, or several. Unlike Keysym, no transformations are applied
+// for modifiers the key's type doesn't handle.
+func (s *State) Keysyms(keycode uint32) []Keysym {
+	syms, _ := s.level(keycode)
+	return syms
+}
+
+// Return the keysym the key currently produces, or NoSymbol if it produces
+// none, or more than one. If Lock is active and wasn't used to select the
+// keysym, the keysym is converted to upper case; so with caps lock on, keys
+// which don't have a type aware of Lock still produce capitals.
+func (s *State) Keysym(keycode uint32) Keysym {
+	syms, consumed := s.level(keycode)
+	if len(syms) != 1 {
+		return NoSymbol
+	}
+	return s.capsTransform(syms[0], consumed)
+}
+
+func (s *State) capsTransform(k Keysym, consumed uint32) Keysym {
+	if s.mods&modLock != 0 && consumed&modLock == 0 {
+		return k.toUpper()
+	}
+	return k
+}
+
+// Return the text the key currently produces, or "" if none.
+//
+// If Control is active and wasn't used to select the keysym, the text is
+// converted to the corresponding control character as terminals do, e.g.
+// Ctrl+A produces "\x01".
+func (s *State) UTF8(keycode uint32) string {
+	syms, consumed := s.level(keycode)
+	var sb strings.Builder
+	for _, k := range syms {
+		r := s.capsTransform(k, consumed).Rune()
+		if r == 0 || !utf8.ValidRune(r) {
+			continue
+		}
+		if len(syms) == 1 && s.mods&modControl != 0 && consumed&modControl == 0 {
+			r = toControl(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// Convert a character to the control character for Ctrl plus that
+// character, if there is one.
+func toControl(r rune) rune {
+	switch {
+	case r >= '@' && r < 0x7f, r == ' ':
+		return r & 0x1f
+	case r == '2':
+		return 0
+	case r >= '3' && r <= '7':
+		return r - '3' + 0x1b
+	case r == '8':
+		return 0x7f
+	case r == '/':
+		return '_' & 0x1f
+	}
+	return r
+}
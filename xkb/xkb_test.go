@@ -0,0 +1,209 @@
+package xkb
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Modifier masks, as sent in wl_keyboard.modifiers.
+const (
+	shift   = 1 << 0
+	lock    = 1 << 1
+	control = 1 << 2
+	mod2    = 1 << 4
+	mod5    = 1 << 7
+)
+
+func loadKeymap(t *testing.T, name string) *Keymap {
+	t.Helper()
+	src, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km, err := ParseKeymap(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return km
+}
+
+func keycode(t *testing.T, km *Keymap, name string) uint32 {
+	t.Helper()
+	code, ok := km.Keycode(name)
+	if !ok {
+		t.Fatalf("No key named %q", name)
+	}
+	return code
+}
+
+type lookupTest struct {
+	key    string
+	mods   uint32
+	group  uint32
+	keysym Keysym
+	text   string
+}
+
+func checkLookups(t *testing.T, km *Keymap, tests []lookupTest) {
+	t.Helper()
+	s := NewState(km)
+	for _, test := range tests {
+		s.UpdateMask(test.mods, 0, 0, test.group)
+		code := keycode(t, km, test.key)
+		if got := s.Keysym(code); got != test.keysym {
+			t.Errorf("%s with mods %#x, group %d: got keysym %v, expected %v",
+				test.key, test.mods, test.group, got, test.keysym)
+		}
+		if got := s.UTF8(code); got != test.text {
+			t.Errorf("%s with mods %#x, group %d: got text %q, expected %q",
+				test.key, test.mods, test.group, got, test.text)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	km := loadKeymap(t, "us.xkb")
+	ks := func(name string) Keysym {
+		k, ok := KeysymFromName(name)
+		if !ok {
+			t.Fatalf("Unknown keysym %q", name)
+		}
+		return k
+	}
+	checkLookups(t, km, []lookupTest{
+		{key: "AC01", keysym: 'a', text: "a"},
+		{key: "AC01", mods: shift, keysym: 'A', text: "A"},
+		{key: "AC01", mods: lock, keysym: 'A', text: "A"},
+		{key: "AC01", mods: shift | lock, keysym: 'a', text: "a"},
+		{key: "AC01", mods: control, keysym: 'a', text: "\x01"},
+		{key: "AC01", mods: control | shift, keysym: 'A', text: "\x01"},
+		{key: "AE01", keysym: '1', text: "1"},
+		{key: "AE01", mods: shift, keysym: '!', text: "!"},
+		{key: "AE01", mods: lock, keysym: '1', text: "1"},
+		{key: "AE02", mods: control, keysym: '2', text: "\x00"},
+		{key: "SPCE", keysym: ' ', text: " "},
+		{key: "ESC", keysym: ks("Escape"), text: "\x1b"},
+		{key: "RTRN", keysym: ks("Return"), text: "\r"},
+		{key: "TAB", mods: shift, keysym: ks("ISO_Left_Tab")},
+		{key: "LFSH", keysym: ks("Shift_L")},
+		{key: "KP7", keysym: ks("KP_Home")},
+		{key: "KP7", mods: mod2, keysym: ks("KP_7"), text: "7"},
+		// Shift cancels NumLock:
+		{key: "KP1", mods: mod2 | shift, keysym: ks("KP_End")},
+		{key: "KPEN", keysym: ks("KP_Enter"), text: "\r"},
+		// Aliases:
+		{key: "LMTA", keysym: ks("Super_L")},
+	})
+}
+
+func TestGroups(t *testing.T) {
+	km := loadKeymap(t, "us-ru.xkb")
+	if got := km.GroupNames(); !reflect.DeepEqual(got, []string{"English (US)", "Russian"}) {
+		t.Errorf("Wrong group names: %q", got)
+	}
+	checkLookups(t, km, []lookupTest{
+		{key: "AD03", keysym: 'e', text: "e"},
+		{key: "AD03", mods: shift, keysym: 'E', text: "E"},
+		{key: "AD03", mods: lock, keysym: 'E', text: "E"},
+		{key: "AD03", mods: mod5, keysym: 0x20ac, text: "€"},
+		{key: "AD03", mods: mod5 | shift, keysym: 0xa2, text: "¢"},
+		// Lock is preserved, but the euro sign has no upper case:
+		{key: "AD03", mods: mod5 | lock, keysym: 0x20ac, text: "€"},
+		{key: "AD03", group: 1, keysym: 0x6d5, text: "у"},
+		{key: "AD03", group: 1, mods: shift, keysym: 0x6f5, text: "У"},
+		// No level three in the second group:
+		{key: "AD03", group: 1, mods: mod5, keysym: 0x6d5, text: "у"},
+		// Out of range groups wrap:
+		{key: "AD03", group: 2, keysym: 'e', text: "e"},
+		{key: "AC01", group: 1, mods: shift, keysym: 0x6e6, text: "Ф"},
+		{key: "AC01", group: 3, keysym: 0x6c6, text: "ф"},
+		{key: "AE01", group: 1, mods: shift, keysym: '!', text: "!"},
+	})
+
+	s := NewState(km)
+	s.UpdateMask(0, 0, mod5, 0)
+	if !s.ModActive("LevelThree") || !s.ModActive("mod5") || s.ModActive("Shift") {
+		t.Error("Wrong modifiers active")
+	}
+	// Nothing sets LevelFive, so it can't be active, and the type which
+	// depends on it always selects the first level:
+	s.UpdateMask(0xff, 0, 0, 0)
+	if s.ModActive("LevelFive") {
+		t.Error("Unmapped modifier active")
+	}
+	code := keycode(t, km, "I250")
+	if got, want := s.Keysyms(code), []Keysym{'H', 'E', 'L', 'L', 'O'}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got keysyms %v, expected %v", got, want)
+	}
+	if s.Keysym(code) != NoSymbol || s.UTF8(code) != "HELLO" {
+		t.Errorf("Wrong lookup for multiple keysyms: %v %q", s.Keysym(code), s.UTF8(code))
+	}
+	if s.Keysyms(8) != nil || s.UTF8(8) != "" {
+		t.Error("Got symbols for a key not in the keymap")
+	}
+}
+
+func TestKeysymNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		keysym Keysym
+		str    string
+		r      rune
+	}{
+		{"a", 'a', "a", 'a'},
+		{"Return", 0xff0d, "Return", '\r'},
+		{"Cyrillic_ef", 0x6c6, "Cyrillic_ef", 'ф'},
+		{"U263A", 0x100263a, "U263A", '☺'},
+		{"U+20AC", 0x20ac, "EuroSign", '€'},
+		{"0xff51", 0xff51, "Left", 0},
+		{"0x12345678", 0x12345678, "0x12345678", 0},
+	}
+	for _, test := range tests {
+		k, ok := KeysymFromName(test.name)
+		if !ok || k != test.keysym {
+			t.Errorf("KeysymFromName(%q) = %#x, %v; expected %#x", test.name, k, ok, test.keysym)
+		}
+		if k.String() != test.str || k.Rune() != test.r {
+			t.Errorf("%#x: got %q, %q; expected %q, %q", k, k.String(), k.Rune(), test.str, test.r)
+		}
+	}
+	if _, ok := KeysymFromName("NotAKeysym"); ok {
+		t.Error("Unknown keysym name accepted")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	_, err := ParseKeymap([]byte("xkb_keymap {\nxkb_types {\n\ttype \"X\" { modifiers = Bogus; };\n};\n};"))
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Line != 3 {
+		t.Fatalf("Expected a parse error on line 3, but got %v", err)
+	}
+}
+
+func TestKeymapFromFd(t *testing.T) {
+	src, err := os.ReadFile("testdata/us.xkb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := unix.MemfdCreate("keymap", unix.MFD_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	// Compositors include a terminating nul:
+	src = append(src, 0)
+	if _, err := unix.Write(fd, src); err != nil {
+		t.Fatal(err)
+	}
+	km, err := KeymapFromFd(fd, uint32(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := NewState(km).Keysym(keycode(t, km, "AD01")); got != 'q' {
+		t.Fatalf("Got %v, expected q", got)
+	}
+}